@@ -0,0 +1,230 @@
+// Package balancer spreads the requests for a site across several
+// origin servers, and stops sending them to origins which are down.
+package balancer
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Strategy decides which origin a request is sent to.
+type Strategy int
+
+const (
+	// RoundRobin sends requests to each origin in turn
+	RoundRobin Strategy = iota
+	// LeastConnections sends requests to the origin with the
+	// fewest requests in progress
+	LeastConnections
+	// ConsistentHash always sends requests with the same cache
+	// key to the same origin, while it is available
+	ConsistentHash
+)
+
+// ParseStrategy returns the Strategy named round-robin,
+// least-connections or consistent-hash.
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", "round-robin":
+		return RoundRobin, nil
+	case "least-connections":
+		return LeastConnections, nil
+	case "consistent-hash":
+		return ConsistentHash, nil
+	}
+	return RoundRobin, errors.New("balancer: unknown strategy " + name)
+}
+
+// ErrNoOrigins is returned by Next if the Balancer has no origins.
+var ErrNoOrigins = errors.New("balancer: no origins")
+
+// An Origin is one of the servers a Balancer sends requests to.
+type Origin struct {
+	URL *url.URL
+	// active is the number of requests in progress
+	active int64
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+// Active returns the number of requests in progress on the origin.
+func (o *Origin) Active() int64 {
+	return atomic.LoadInt64(&o.active)
+}
+
+func (o *Origin) available(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return !o.unhealthy && !now.Before(o.ejectedUntil)
+}
+
+// A Balancer picks which origin each request is sent to.  Origins
+// which fail the health check, or which fail MaxFails requests in
+// a row (with a 5xx or by not responding), are not sent requests
+// until they pass a health check, or for FailTimeout, respectively.
+// If every origin is unavailable, requests are sent to all of them,
+// since a site which may be down is better than one which is.
+type Balancer struct {
+	origins  []*Origin
+	strategy Strategy
+	next     uint64
+
+	maxFails    int
+	failTimeout time.Duration
+	clock       func() time.Time
+}
+
+// New returns a Balancer which sends requests to origins using
+// strategy.  Origins are ejected for 30 seconds after 3 failures
+// in a row.
+func New(strategy Strategy, origins ...*url.URL) *Balancer {
+	b := &Balancer{
+		strategy:    strategy,
+		maxFails:    3,
+		failTimeout: 30 * time.Second,
+		clock:       time.Now,
+	}
+	for _, u := range origins {
+		b.origins = append(b.origins, &Origin{URL: u})
+	}
+	return b
+}
+
+// SetPassiveEjection sets how many requests in a row an origin
+// must fail before it is ejected, and for how long.  If maxFails
+// is 0, origins are never ejected.
+func (b *Balancer) SetPassiveEjection(maxFails int, failTimeout time.Duration) {
+	b.maxFails = maxFails
+	b.failTimeout = failTimeout
+}
+
+// SetClock replaces the function the Balancer uses to tell the time.
+func (b *Balancer) SetClock(clock func() time.Time) {
+	b.clock = clock
+}
+
+// Origins returns the origins of the Balancer.
+func (b *Balancer) Origins() []*Origin {
+	return b.origins
+}
+
+// Next returns the origin the request with the cache key key should
+// be sent to.  The caller must call Done once it has the response.
+func (b *Balancer) Next(key string) (*Origin, error) {
+	if len(b.origins) == 0 {
+		return nil, ErrNoOrigins
+	}
+	now := b.clock()
+	origins := make([]*Origin, 0, len(b.origins))
+	for _, o := range b.origins {
+		if o.available(now) {
+			origins = append(origins, o)
+		}
+	}
+	if len(origins) == 0 {
+		origins = b.origins
+	}
+	var origin *Origin
+	switch b.strategy {
+	case LeastConnections:
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(len(origins)))
+		for i := range origins {
+			o := origins[(start+i)%len(origins)]
+			if origin == nil || o.Active() < origin.Active() {
+				origin = o
+			}
+		}
+	case ConsistentHash:
+		// Rendezvous hashing, so that only the keys of an origin
+		// which becomes unavailable move to other origins.
+		var best uint64
+		for _, o := range origins {
+			h := fnv.New64a()
+			h.Write([]byte(o.URL.String()))
+			h.Write([]byte(key))
+			if score := h.Sum64(); origin == nil || score > best {
+				origin, best = o, score
+			}
+		}
+	default:
+		origin = origins[int((atomic.AddUint64(&b.next, 1)-1)%uint64(len(origins)))]
+	}
+	atomic.AddInt64(&origin.active, 1)
+	return origin, nil
+}
+
+// Done records the result of a request sent to origin.  failed
+// should be true if the origin did not respond, or responded with
+// a 5xx status.
+func (b *Balancer) Done(origin *Origin, failed bool) {
+	atomic.AddInt64(&origin.active, -1)
+	origin.mu.Lock()
+	defer origin.mu.Unlock()
+	if !failed {
+		origin.failures = 0
+		return
+	}
+	origin.failures++
+	if b.maxFails > 0 && origin.failures >= b.maxFails {
+		origin.failures = 0
+		origin.ejectedUntil = b.clock().Add(b.failTimeout)
+	}
+}
+
+// setHealthy marks whether origin passed its last health check.
+func (b *Balancer) setHealthy(origin *Origin, healthy bool) {
+	origin.mu.Lock()
+	defer origin.mu.Unlock()
+	origin.unhealthy = !healthy
+}
+
+// RoundTripper returns an http.RoundTripper which sends each request
+// to the origin chosen for it, using next.  key returns the cache
+// key of a request, for the ConsistentHash strategy.  The url of the
+// request is changed to the origin's, but the Host header isn't, so
+// the origins serve the site they would have if requested directly.
+func (b *Balancer) RoundTripper(next http.RoundTripper, key func(*http.Request) string) http.RoundTripper {
+	return &transport{balancer: b, next: next, key: key}
+}
+
+type transport struct {
+	balancer *Balancer
+	next     http.RoundTripper
+	key      func(*http.Request) string
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var key string
+	if t.balancer.strategy == ConsistentHash && t.key != nil {
+		key = t.key(r)
+	}
+	origin, err := t.balancer.Next(key)
+	if err != nil {
+		return nil, err
+	}
+	outReq := new(http.Request)
+	*outReq = *r
+	u := *r.URL
+	u.Scheme = origin.URL.Scheme
+	u.Host = origin.URL.Host
+	outReq.URL = &u
+	if outReq.Host == "" {
+		outReq.Host = r.URL.Host
+	}
+	resp, err := t.next.RoundTrip(outReq)
+	t.balancer.Done(origin, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	if resp != nil {
+		// The response is cached under the hash of the request
+		// as it was before the origin was chosen.
+		resp.Request = r
+	}
+	return resp, err
+}
@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func origins(hosts ...string) []*url.URL {
+	var urls []*url.URL
+	for _, host := range hosts {
+		urls = append(urls, &url.URL{Scheme: "http", Host: host})
+	}
+	return urls
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := New(RoundRobin, origins("a", "b", "c")...)
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		o, err := b.Next("")
+		assert.NoError(t, err)
+		hosts = append(hosts, o.URL.Host)
+		b.Done(o, false)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a"}, hosts)
+}
+
+func TestLeastConnections(t *testing.T) {
+	b := New(LeastConnections, origins("a", "b")...)
+	busy, _ := b.Next("")
+	for i := 0; i < 3; i++ {
+		o, _ := b.Next("")
+		assert.NotEqual(t, busy, o, "The origin with a request in progress should not be picked")
+		b.Done(o, false)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := New(ConsistentHash, origins("a", "b", "c")...)
+	first, _ := b.Next("GET :: https://www.insomniac.com/events")
+	b.Done(first, false)
+	for i := 0; i < 5; i++ {
+		o, _ := b.Next("GET :: https://www.insomniac.com/events")
+		assert.Equal(t, first, o, "The same key should go to the same origin")
+		b.Done(o, false)
+	}
+}
+
+func TestNoOrigins(t *testing.T) {
+	_, err := New(RoundRobin).Next("")
+	assert.Equal(t, ErrNoOrigins, err)
+}
+
+func TestPassiveEjection(t *testing.T) {
+	now := time.Now()
+	b := New(RoundRobin, origins("a", "b")...)
+	b.SetClock(func() time.Time { return now })
+	b.SetPassiveEjection(2, time.Minute)
+	for i := 0; i < 4; i++ {
+		o, _ := b.Next("")
+		b.Done(o, o.URL.Host == "a")
+	}
+	for i := 0; i < 3; i++ {
+		o, _ := b.Next("")
+		assert.Equal(t, "b", o.URL.Host, "An ejected origin should not be sent requests")
+		b.Done(o, false)
+	}
+	now = now.Add(time.Minute)
+	hosts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		o, _ := b.Next("")
+		hosts[o.URL.Host] = true
+		b.Done(o, false)
+	}
+	assert.True(t, hosts["a"], "An origin should be sent requests once its FailTimeout is over")
+}
+
+func TestAllOriginsUnavailable(t *testing.T) {
+	b := New(RoundRobin, origins("a")...)
+	b.setHealthy(b.Origins()[0], false)
+	o, err := b.Next("")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", o.URL.Host, "If every origin is down, they should still be tried")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRoundTripper(t *testing.T) {
+	b := New(RoundRobin, origins("10.0.0.1", "10.0.0.2")...)
+	b.SetPassiveEjection(1, time.Minute)
+	var sent []*http.Request
+	rt := b.RoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		sent = append(sent, r)
+		if r.URL.Host == "10.0.0.1" {
+			return nil, errors.New("timeout")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), nil)
+	r := httptest.NewRequest(http.MethodGet, "https://www.insomniac.com/events", nil)
+	_, err := rt.RoundTrip(r)
+	assert.Error(t, err)
+	resp, err := rt.RoundTrip(r)
+	assert.NoError(t, err)
+	assert.Equal(t, r, resp.Request, "The response should be for the original request")
+	assert.Equal(t, "www.insomniac.com", sent[1].Host, "The Host header should not change")
+	assert.Equal(t, "https://www.insomniac.com/events", r.URL.String(), "The original request should not change")
+	rt.RoundTrip(r)
+	assert.Equal(t, "10.0.0.2", sent[2].URL.Host, "The failed origin should be ejected")
+}
+
+func TestHealthChecks(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/wp-json/", r.URL.Path)
+		assert.Equal(t, "www.insomniac.com", r.Host)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	upURL, _ := url.Parse(up.URL)
+	downURL, _ := url.Parse(down.URL)
+	b := New(RoundRobin, downURL, upURL)
+	b.CheckHealth(context.Background(), HealthCheck{Path: "/wp-json/", Host: "www.insomniac.com", Timeout: time.Second})
+	for i := 0; i < 3; i++ {
+		o, _ := b.Next("")
+		assert.Equal(t, upURL, o.URL, "An origin which fails its health check should not be sent requests")
+		b.Done(o, false)
+	}
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// A HealthCheck is an HTTP request sent to every origin on an
+// interval.  An origin passes it if it responds with a 2xx or
+// 3xx status within Timeout.
+type HealthCheck struct {
+	// Path is requested from each origin, e.g. /wp-json/
+	Path string
+	// Host is sent as the Host header, so the origin serves
+	// the site being balanced.  If empty, the origin's is used.
+	Host     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Client sends the requests.  It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// StartHealthChecks runs check against every origin now, and then
+// every check.Interval, until ctx is done.
+func (b *Balancer) StartHealthChecks(ctx context.Context, check HealthCheck) {
+	b.CheckHealth(ctx, check)
+	go func() {
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.CheckHealth(ctx, check)
+			}
+		}
+	}()
+}
+
+// CheckHealth runs check against every origin once, and marks
+// the origins which fail it as unavailable until they pass it.
+func (b *Balancer) CheckHealth(ctx context.Context, check HealthCheck) {
+	client := check.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for _, origin := range b.origins {
+		b.setHealthy(origin, healthy(ctx, client, origin, check))
+	}
+}
+
+func healthy(ctx context.Context, client *http.Client, origin *Origin, check HealthCheck) bool {
+	if check.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, check.Timeout)
+		defer cancel()
+	}
+	u := *origin.URL
+	u.Path = check.Path
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(ctx)
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -18,6 +18,11 @@ type Cacher interface {
 	// hashes to the same value will be returned the
 	// same response.
 	Hash(*http.Request) string
+	// Variant returns the part of the hash which selects
+	// which variant of a url a request should receive if
+	// the response has the given Vary header.  Requests
+	// multiplexed into one singleflight are bucketed by it.
+	Variant(r *http.Request, vary string) string
 	// Standardize takes an http.Response, and modifies
 	// it to a response that can be returned to any client.
 	// E.g. It removes unncessary headers, etc.
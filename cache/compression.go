@@ -0,0 +1,363 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressionOptions decide which responses are stored compressed, and
+// how.  Compressible responses are stored once in each encoding with a
+// level above 0, as well as as they were received, and served in the
+// one the client prefers - or as they are to clients which accept
+// neither.
+type CompressionOptions struct {
+	// BrotliLevel is the brotli quality, from 1 to 11.  If it is 0,
+	// responses aren't stored with brotli.
+	BrotliLevel int
+	// GzipLevel is the gzip level, from 1 to 9.  If it is 0,
+	// responses aren't stored with gzip.
+	GzipLevel int
+	// ContentTypes are the media types of responses which are
+	// compressible.  A type ending in /*, like text/*, matches any
+	// subtype.
+	ContentTypes []string
+	// MinSize is the smallest response body which is compressed.
+	MinSize int
+}
+
+// DefaultCompressionOptions returns CompressionOptions which store text,
+// scripts, json, xml, svg and fonts of at least 256 bytes with brotli
+// at quality 9 and gzip at level 9.  Since a response is only compressed
+// once, when it is cached, it is worth compressing it well.
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{
+		BrotliLevel: 9,
+		GzipLevel:   gzip.BestCompression,
+		ContentTypes: []string{
+			"text/*",
+			"application/javascript",
+			"application/x-javascript",
+			"application/json",
+			"application/ld+json",
+			"application/manifest+json",
+			"application/xml",
+			"application/rss+xml",
+			"application/atom+xml",
+			"application/xhtml+xml",
+			"image/svg+xml",
+			"image/x-icon",
+			"font/ttf",
+			"font/otf",
+			"application/vnd.ms-fontobject",
+		},
+		MinSize: 256,
+	}
+}
+
+// SetCompression sets the CompressionOptions for responses.
+func (c *defaultCacher) SetCompression(opts CompressionOptions) {
+	c.compression = opts
+}
+
+// decodeBody decompresses the body of resp if the backend sent it
+// compressed, so that it is stored the same whatever the Accept-Encoding
+// of the request which fetched it, and removes the Content-Encoding from
+// resp and r, its http.Response.  Responses which mustn't be transformed,
+// or are in an encoding which can't be decompressed, are left alone.
+func decodeBody(resp *responseImpl, r *http.Response) {
+	encoding := r.Header.Get("Content-Encoding")
+	// https://tools.ietf.org/html/rfc7234#section-5.2.2.4
+	if encoding == "" || !canDecode(encoding) || HasDirective(r.Header.Get("Cache-Control"), "no-transform") {
+		return
+	}
+	body, err := decode(encoding, resp.body)
+	if err != nil {
+		return
+	}
+	resp.body = body
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	for _, h := range []http.Header{r.Header, resp.headers} {
+		h.Del("Content-Encoding")
+		h.Del("Content-Length")
+	}
+}
+
+// compressible returns whether the response with headers h and
+// body should be stored compressed.
+func (c *defaultCacher) compressible(h http.Header, body []byte) bool {
+	opts := c.compression
+	if opts.BrotliLevel <= 0 && opts.GzipLevel <= 0 {
+		return false
+	}
+	if len(body) == 0 || len(body) < opts.MinSize {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || HasDirective(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return MatchContentType(h.Get("Content-Type"), opts.ContentTypes)
+}
+
+// compress stores the body of resp in each encoding enabled by the
+// CompressionOptions as well as as it is, and removes the Content-Length
+// from resp and r, its http.Response.  Vary: Accept-Encoding is removed
+// too, since the response is the same for every client - it is added
+// again by Encode.
+func (c *defaultCacher) compress(resp *responseImpl, r *http.Response) {
+	for _, h := range []http.Header{r.Header, resp.headers} {
+		h.Del("Content-Length")
+		if vary := without(h.Get("Vary"), "accept-encoding"); vary != "" {
+			h.Set("Vary", vary)
+		} else {
+			h.Del("Vary")
+		}
+	}
+	resp.compress(c.compression)
+}
+
+// compress adds the encodings of the body of the response at the levels
+// in opts.  The body is kept, so that it isn't decompressed for every
+// client which accepts neither.
+func (r *responseImpl) compress(opts CompressionOptions) {
+	encodings := make(map[string][]byte)
+	if opts.BrotliLevel > 0 {
+		var buffer bytes.Buffer
+		writer := brotli.NewWriterLevel(&buffer, opts.BrotliLevel)
+		writer.Write(r.body)
+		writer.Close()
+		encodings["br"] = buffer.Bytes()
+	}
+	if opts.GzipLevel > 0 {
+		var buffer bytes.Buffer
+		writer, err := gzip.NewWriterLevel(&buffer, opts.GzipLevel)
+		if err != nil {
+			writer = gzip.NewWriter(&buffer)
+		}
+		writer.Write(r.body)
+		writer.Close()
+		encodings["gzip"] = buffer.Bytes()
+	}
+	r.encodings = encodings
+	r.compression = opts
+}
+
+// SetHeader replaces the headers of resp with header.  It returns false
+// if resp isn't a Response Standardize returned, so its headers can't be
+// replaced.
+func SetHeader(resp Response, header http.Header) bool {
+	impl, ok := resp.(*responseImpl)
+	if !ok {
+		return false
+	}
+	impl.headers = http.Header{}
+	copyHeader(impl.headers, header)
+	return true
+}
+
+// SetBody replaces the body of resp, e.g. with a minified one, and
+// updates its Etag and Content-Length to match.  If it is stored
+// compressed, it is compressed again.  It returns false if resp isn't
+// a Response Standardize returned, so its body can't be replaced.
+func SetBody(resp Response, body []byte) bool {
+	impl, ok := resp.(*responseImpl)
+	if !ok {
+		return false
+	}
+	if impl.headers.Get("Etag") != "" {
+		impl.headers.Set("Etag", etag(body))
+	}
+	if impl.headers.Get("Content-Length") != "" {
+		impl.headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	impl.body = body
+	if len(impl.encodings) > 0 {
+		impl.compress(impl.compression)
+	}
+	return true
+}
+
+// Encode returns the body of resp in the encoding the Accept-Encoding
+// header acceptEncoding prefers, out of those it is stored in, and sets
+// the Content-Encoding and Vary headers in h to match, and the Etag to
+// the EncodedEtag of the encoding.  If it isn't stored compressed, its
+// body is returned as it is.
+func Encode(h http.Header, resp Response, acceptEncoding string) []byte {
+	impl, ok := resp.(*responseImpl)
+	if !ok || len(impl.encodings) == 0 {
+		return resp.Body()
+	}
+	h.Del("Content-Length")
+	if vary := h.Get("Vary"); vary == "" {
+		h.Set("Vary", "Accept-Encoding")
+	} else if !containsToken(vary, "accept-encoding") {
+		h.Set("Vary", vary+", Accept-Encoding")
+	}
+	encoding := negotiate(acceptEncoding, impl.encodings)
+	if encoding == "" {
+		h.Del("Content-Encoding")
+		return impl.Body()
+	}
+	h.Set("Content-Encoding", encoding)
+	if etag := h.Get("Etag"); etag != "" {
+		h.Set("Etag", EncodedEtag(etag, encoding))
+	}
+	return impl.encodings[encoding]
+}
+
+// EncodedEtag returns the Etag of the representation of a response with
+// etag in encoding, which has the encoding added to it, since a strong
+// Etag has to differ between representations.
+// https://tools.ietf.org/html/rfc7232#section-2.3.3
+func EncodedEtag(etag, encoding string) string {
+	if strings.HasSuffix(etag, `"`) && len(etag) > 1 {
+		return etag[:len(etag)-1] + "-" + encoding + `"`
+	}
+	return etag + "-" + encoding
+}
+
+// MatchEtag returns whether the If-None-Match header ifNoneMatch is
+// etag, or the EncodedEtag of one of the encodings it is stored in.
+func MatchEtag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if ifNoneMatch == etag {
+		return true
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if ifNoneMatch == EncodedEtag(etag, encoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate returns the encoding out of encodings with the highest
+// q-value in acceptEncoding, preferring br to gzip, or "" if none of
+// them are acceptable.
+// https://tools.ietf.org/html/rfc7231#section-5.3.4
+func negotiate(acceptEncoding string, encodings map[string][]byte) string {
+	var best string
+	var bestQ float64
+	for _, encoding := range []string{"br", "gzip"} {
+		if _, found := encodings[encoding]; !found {
+			continue
+		}
+		if q := qValue(acceptEncoding, encoding); q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// qValue returns the q-value of coding in the Accept-Encoding header
+// acceptEncoding, which is that of * if coding isn't listed, and 0
+// if neither is.
+func qValue(acceptEncoding, coding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		value := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					value = parsed
+				}
+			}
+		}
+		if name == coding {
+			return value
+		}
+		wildcard = value
+	}
+	return wildcard
+}
+
+// decodedBody returns the body of the response, decompressed from one
+// of the encodings it is stored in.
+func canDecode(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip", "br", "deflate":
+		return true
+	}
+	return false
+}
+
+// decode decompresses body from the Content-Encoding encoding.
+func decode(encoding string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return body, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// MatchContentType returns whether the Content-Type header
+// contentType is one of the media types in types, which may end
+// in /* to match any subtype.
+func MatchContentType(contentType string, types []string) bool {
+	if len(types) == 0 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType ||
+			(strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the comma separated list of header names list
+// without name.
+func without(list, name string) string {
+	var kept []string
+	for _, header := range strings.Split(list, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !strings.EqualFold(header, name) {
+			kept = append(kept, header)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// containsToken returns whether the comma separated list has token.
+func containsToken(list, token string) bool {
+	for _, part := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+var compressibleBody = strings.Repeat("<p>Hello, world</p>", 50)
+
+func newCompressibleResponse(contentType string, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   []string{contentType},
+			"Content-Length": []string{"950"},
+			"Vary":           []string{"Accept-Encoding"},
+		},
+		Body:    ioutil.NopCloser(bytes.NewReader(body)),
+		Request: validRequest(),
+	}
+}
+
+func TestCompressionStoresEncodings(t *testing.T) {
+	cache := NewDefaultCacher()
+	response := newCompressibleResponse("text/html; charset=utf-8", []byte(compressibleBody))
+	r := cache.Standardize(response)
+	impl := r.(*responseImpl)
+	assert.Contains(t, impl.encodings, "br")
+	assert.Contains(t, impl.encodings, "gzip")
+	assert.Equal(t, compressibleBody, string(impl.body), "The body should be kept for clients which accept neither")
+	assert.Equal(t, compressibleBody, string(r.Body()))
+	assert.Empty(t, r.Header().Get("Content-Length"))
+	assert.Empty(t, r.Header().Get("Vary"), "The cache negotiates the encoding, so it shouldn't vary on it")
+	body, _ := ioutil.ReadAll(response.Body)
+	assert.Equal(t, compressibleBody, string(body), "The backend response should keep its body")
+}
+
+func TestCompressionDecodesBackendEncoding(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(compressibleBody))
+	writer.Close()
+	response := newCompressibleResponse("application/javascript", buffer.Bytes())
+	response.Header.Set("Content-Encoding", "gzip")
+	r := NewDefaultCacher().Standardize(response)
+	assert.Equal(t, compressibleBody, string(r.Body()))
+	assert.Empty(t, r.Header().Get("Content-Encoding"))
+	assert.Empty(t, response.Header.Get("Content-Encoding"))
+}
+
+func TestCompressionSkipsIncompressible(t *testing.T) {
+	cache := NewDefaultCacher()
+	r := cache.Standardize(newCompressibleResponse("image/png", []byte(compressibleBody)))
+	assert.Empty(t, r.(*responseImpl).encodings, "Images should not be compressed")
+	r = cache.Standardize(newCompressibleResponse("text/html", []byte("<p>Hi</p>")))
+	assert.Empty(t, r.(*responseImpl).encodings, "Small responses should not be compressed")
+	response := newCompressibleResponse("text/html", []byte(compressibleBody))
+	response.Header.Set("Cache-Control", "no-transform")
+	r = cache.Standardize(response)
+	assert.Empty(t, r.(*responseImpl).encodings, "no-transform responses should not be compressed")
+	cache.SetCompression(CompressionOptions{})
+	r = cache.Standardize(newCompressibleResponse("text/html", []byte(compressibleBody)))
+	assert.Empty(t, r.(*responseImpl).encodings, "Nothing should be compressed with compression off")
+	assert.Equal(t, "Accept-Encoding", r.Header().Get("Vary"))
+}
+
+func TestEncodeNegotiates(t *testing.T) {
+	r := NewDefaultCacher().Standardize(newCompressibleResponse("text/css", []byte(compressibleBody)))
+
+	h := http.Header{}
+	body := Encode(h, r, "gzip, deflate, br")
+	assert.Equal(t, "br", h.Get("Content-Encoding"), "Brotli should be preferred")
+	assert.Equal(t, "Accept-Encoding", h.Get("Vary"))
+	decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, compressibleBody, string(decoded))
+
+	h = http.Header{"Vary": []string{"Accept-Language"}}
+	body = Encode(h, r, "gzip;q=1, br;q=0.5")
+	assert.Equal(t, "gzip", h.Get("Content-Encoding"), "The higher q-value should win")
+	assert.Equal(t, "Accept-Language, Accept-Encoding", h.Get("Vary"))
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		decoded, _ = ioutil.ReadAll(reader)
+		assert.Equal(t, compressibleBody, string(decoded))
+	}
+
+	h = http.Header{}
+	Encode(h, r, "*;q=0.5, br;q=0")
+	assert.Equal(t, "gzip", h.Get("Content-Encoding"), "* should stand for unlisted encodings")
+
+	h = http.Header{"Content-Encoding": []string{"gzip"}}
+	body = Encode(h, r, "identity")
+	assert.Empty(t, h.Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, string(body), "Clients which accept neither should get the decompressed body")
+}
+
+func TestSetBodyRecompresses(t *testing.T) {
+	response := newCompressibleResponse("text/html", []byte(compressibleBody))
+	r := NewDefaultCacher().Standardize(response)
+	before := r.Header().Get("Etag")
+	smaller := strings.Repeat("<p>Hi</p>", 50)
+	assert.True(t, SetBody(r, []byte(smaller)))
+	assert.Equal(t, smaller, string(r.Body()))
+	assert.NotEqual(t, before, r.Header().Get("Etag"), "The Etag should match the new body")
+	assert.Equal(t, before, response.Header.Get("Etag"), "The response it was standardized from shouldn't be changed")
+	h := http.Header{}
+	body := Encode(h, r, "gzip")
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		decoded, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, smaller, string(decoded), "The new body should be compressed again")
+	}
+}
+
+func TestEncodeGivesEachEncodingItsOwnEtag(t *testing.T) {
+	r := NewDefaultCacher().Standardize(newCompressibleResponse("text/html", []byte(compressibleBody)))
+	etag := r.Header().Get("Etag")
+	etags := make(map[string]bool)
+	for _, acceptEncoding := range []string{"br", "gzip", "identity"} {
+		h := http.Header{"Etag": []string{etag}}
+		Encode(h, r, acceptEncoding)
+		etags[h.Get("Etag")] = true
+		assert.True(t, MatchEtag(h.Get("Etag"), etag), "The Etag sent for %s should match the stored one", acceptEncoding)
+	}
+	assert.Len(t, etags, 3, "Each representation should have a different strong Etag")
+}
+
+func TestEncodedEtag(t *testing.T) {
+	assert.Equal(t, `"abc-br"`, EncodedEtag(`"abc"`, "br"))
+	assert.Equal(t, `W/"abc-gzip"`, EncodedEtag(`W/"abc"`, "gzip"))
+	assert.Equal(t, "abc-br", EncodedEtag("abc", "br"))
+	assert.True(t, MatchEtag(`"abc-gzip"`, `"abc"`))
+	assert.False(t, MatchEtag(`"abc-deflate"`, `"abc"`))
+	assert.False(t, MatchEtag("", ""))
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,8 +21,17 @@ type defaultCacher struct {
 	allowedCookies     map[string]bool
 	allowedCookieNames []string
 	skipRegex          []*regexp.Regexp
+	maxVariants        int
+	keyRules           KeyRules
+	keyTemplate        *KeyTemplate
+	keyRoutes          []keyRoute
+	keyAttributes      map[string]KeyAttribute
+	namespace          string
+	immutable          []*regexp.Regexp
+	static             StaticPolicy
+	staticExtensions   map[string]bool
+	compression        CompressionOptions
 	entries            sync.Map
-	vary               sync.Map
 }
 
 // NewDefaultCacher returns a cacher optimized
@@ -35,23 +45,28 @@ func NewDefaultCacher() *defaultCacher {
 		},
 		allowedCookies:     make(map[string]bool),
 		allowedCookieNames: []string{},
+		maxVariants:        DefaultMaxVariants,
+		keyRules:           DefaultKeyRules(),
+		keyAttributes:      map[string]KeyAttribute{"geo": GeoAttribute},
 		entries:            sync.Map{},
-		vary:               sync.Map{},
 	}
+	cacher.SetStaticPolicy(DefaultStaticPolicy())
+	cacher.SetCompression(DefaultCompressionOptions())
 
 	return cacher
 }
 
 // CanCache will return true if the method is a GET or
-// HEAD request, does not have a static file extension,
-// does not have an Authorization header, does not
+// HEAD request, is not for a static file when the
+// StaticPolicy has no MaxAge, does not have an
+// Authorization header, does not
 // have preview=true in the query string, and is not
 // for a url containing /wp-admin, /wp-login, or /feed
 func (c *defaultCacher) CanCache(r *http.Request) bool {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		return false
 	}
-	if utilities.IsStaticFile(r.URL.Path) {
+	if c.static.MaxAge <= 0 && c.isStaticPath(r.URL.Path) {
 		return false
 	}
 	if r.Header.Get("Authorization") != "" {
@@ -72,22 +87,130 @@ func (c *defaultCacher) CanCache(r *http.Request) bool {
 }
 
 // Hash creates a unique string for a request.  It includes
-// the method, the url, and any allowed cookies.  It also
-// includes the X-Honey-Vary header - which is used internally
-// on multiplexed requests.
+// the method and the url (as rewritten by the KeyRules for its
+// path), or the url placeholders of the KeyTemplate for its
+// path if there is one.  After that come the request placeholders
+// of the KeyTemplate, and, if the url has been cached with a Vary
+// header, the values of the headers and allowed cookies it varies
+// on.  If the X-Honey-Vary header - which is used internally on
+// multiplexed requests - is set, it is used in place of both.
 func (c *defaultCacher) Hash(r *http.Request) string {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s :: %s", r.Method, r.URL.String()))
+	primary, attributes := c.render(r)
+	key := r.Header.Get("X-Honey-Vary")
+	if key == "" {
+		var vary string
+		if v, found := c.entries.Load(primary); found {
+			vary = v.(*variants).currentVary()
+		}
+		key = joinVariant(attributes, utilities.GetVaryHeadersHash(r.Header, r, c.allowedCookieNames, vary))
+	}
+	return joinHash(primary, key)
+}
+
+// Variant returns the part of the hash which selects the variant
+// of a url request r should receive, if the response to it has
+// the Vary header vary.
+func (c *defaultCacher) Variant(r *http.Request, vary string) string {
+	_, attributes := c.render(r)
+	return joinVariant(attributes, utilities.GetVaryHeadersHash(r.Header, r, c.allowedCookieNames, normalizeVary(vary)))
+}
+
+// render returns the primary part of the hash of a request, and
+// the request placeholders of its KeyTemplate.
+func (c *defaultCacher) render(r *http.Request) (primary, attributes string) {
+	rules, template := c.keyFor(r.URL.Path)
+	if template == nil {
+		primary = fmt.Sprintf("%s :: %s", r.Method, rules.Key(r.URL))
+	} else {
+		primary, attributes = template.Render(r, rules, c.keyAttributes)
+	}
+	if c.namespace != "" {
+		primary = c.namespace + " :: " + primary
+	}
+	return primary, attributes
+}
+
+// SetNamespace prefixes the hash of every request with namespace,
+// so that sites which share a backend host don't share responses.
+func (c *defaultCacher) SetNamespace(namespace string) {
+	c.namespace = namespace
+}
+
+// SetKeyRules sets the KeyRules used to build the hash of any
+// request whose path doesn't match a route added with AddKeyRoute.
+func (c *defaultCacher) SetKeyRules(rules KeyRules) {
+	c.keyRules = rules
+}
+
+// SetKeyTemplate sets the KeyTemplate used to build the hash of any
+// request whose path doesn't match a route added with AddKeyRoute or
+// AddKeyTemplate.  If it is nil, the hash is the method and the url.
+func (c *defaultCacher) SetKeyTemplate(template *KeyTemplate) {
+	c.keyTemplate = template
+}
+
+// AddKeyRoute sets the KeyRules used to build the hash of requests
+// whose path matches match, e.g. to allow only the query parameters
+// a search page uses.  Routes are checked in the order they were
+// added.
+func (c *defaultCacher) AddKeyRoute(match *regexp.Regexp, rules KeyRules) {
+	c.keyRoutes = append(c.keyRoutes, keyRoute{match: match, rules: rules})
+}
+
+// AddKeyTemplate sets the KeyTemplate used to build the hash of
+// requests whose path matches match, along with the current KeyRules.
+// Routes are checked in the order they were added.
+func (c *defaultCacher) AddKeyTemplate(match *regexp.Regexp, template *KeyTemplate) {
+	c.keyRoutes = append(c.keyRoutes, keyRoute{match: match, rules: c.keyRules, template: template})
+}
+
+// AddKeyAttribute makes the value returned by attribute available
+// to key templates as {attr:name}.  Adding one named geo replaces
+// the GeoAttribute used for {geo}.
+func (c *defaultCacher) AddKeyAttribute(name string, attribute KeyAttribute) {
+	if c.keyAttributes == nil {
+		c.keyAttributes = make(map[string]KeyAttribute)
+	}
+	c.keyAttributes[name] = attribute
+}
 
-	v, found := c.vary.Load(buffer.String())
-	if found {
-		vary := v.(string)
-		buffer.WriteString(utilities.GetVaryHeadersHash(r.Header, r, c.allowedCookieNames, vary))
+func (c *defaultCacher) keyFor(path string) (KeyRules, *KeyTemplate) {
+	for _, route := range c.keyRoutes {
+		if route.match.MatchString(path) {
+			if route.template != nil {
+				return route.rules, route.template
+			}
+			return route.rules, c.keyTemplate
+		}
+	}
+	return c.keyRules, c.keyTemplate
+}
+
+// AddSkipRegex adds a regular expression for paths which
+// will never be cached, like the WP RSS feed or wp-admin.
+func (c *defaultCacher) AddSkipRegex(regex *regexp.Regexp) {
+	c.skipRegex = append(c.skipRegex, regex)
+}
+
+// AddImmutable marks the responses to requests whose path matches
+// match as immutable - they get Cache-Control: immutable with a max-age
+// of ImmutableMaxAge, and are never revalidated while they are fresh,
+// even if the client asks for it.  FingerprintRegexp matches asset
+// names with a hash of their content in them.
+func (c *defaultCacher) AddImmutable(match *regexp.Regexp) {
+	c.immutable = append(c.immutable, match)
+}
+
+func (c *defaultCacher) isImmutable(r *http.Request) bool {
+	if r == nil || r.URL == nil {
+		return false
 	}
-	if vary := r.Header.Get("X-Honey-Vary"); vary != "" {
-		buffer.WriteString(vary)
+	for _, match := range c.immutable {
+		if match.MatchString(r.URL.Path) {
+			return true
+		}
 	}
-	return buffer.String()
+	return false
 }
 
 // AddAllowedCookie adds a name to the list of cookies which
@@ -97,6 +220,15 @@ func (c *defaultCacher) AddAllowedCookie(name string) {
 	c.allowedCookieNames = append(c.allowedCookieNames, name)
 }
 
+// SetMaxVariants sets the number of variants (responses with
+// different values for the headers in Vary) which will be kept
+// for a single url.  Once there are more, the least recently
+// used are removed from the cache.  If max is 0, there is no
+// limit.
+func (c *defaultCacher) SetMaxVariants(max int) {
+	c.maxVariants = max
+}
+
 var replacer = strings.NewReplacer(`no-cache="set-cookie"`, "", ",,", "", "public", "")
 
 func ccReplacer(cc string) string {
@@ -104,8 +236,9 @@ func ccReplacer(cc string) string {
 }
 
 // Standardize removes set-cookie headers unless they are listed
-// in the allowed cookies, reads the response, and saves it to
-// a Response interface.
+// in the allowed cookies, applies the StaticPolicy to static files,
+// reads the response, compresses it if it is compressible, and saves
+// it to a Response interface.
 func (c *defaultCacher) Standardize(r *http.Response) Response {
 	for i := 0; i < len(r.Header["Set-Cookie"]); i++ {
 		line := r.Header["Set-Cookie"][i]
@@ -124,10 +257,17 @@ func (c *defaultCacher) Standardize(r *http.Response) Response {
 			i--
 		}
 	}
+	// The status and headers are copied, since r is sent on to the
+	// requester which fetched it, and may be changed for them - e.g.
+	// to a 304 Not Modified
 	resp := responseImpl{
-		now:      time.Now(),
-		headers:  http.Header{},
-		response: r,
+		now:        time.Now(),
+		headers:    http.Header{},
+		status:     r.Status,
+		statusCode: r.StatusCode,
+	}
+	if initial, err := strconv.Atoi(r.Header.Get("Age")); err == nil && initial > 0 {
+		resp.initialAge = time.Duration(initial) * time.Second
 	}
 	copyHeader(resp.headers, r.Header)
 
@@ -148,6 +288,21 @@ func (c *defaultCacher) Standardize(r *http.Response) Response {
 		resp.headers.Set("Cache-Control", cc)
 	}
 
+	if c.static.MaxAge > 0 && r.StatusCode < 400 && c.isStatic(r) {
+		c.standardizeStatic(r, resp.headers)
+		cc = resp.headers.Get("Cache-Control")
+	}
+
+	// Only successful responses are immutable - a redirect or an error
+	// may be fixed - and ones the backend says are private or mustn't
+	// be stored are left alone
+	if c.isImmutable(r.Request) && r.StatusCode == http.StatusOK &&
+		!strings.Contains(cc, "private") && !strings.Contains(cc, "no-store") {
+		cc = immutableCacheControl
+		resp.headers.Set("Cache-Control", cc)
+		r.Header.Set("Cache-Control", cc)
+	}
+
 	if r.Header.Get("Last-Modified") == "" {
 		r.Header.Set("Last-Modified", time.Now().Format(time.RFC1123))
 	}
@@ -156,23 +311,25 @@ func (c *defaultCacher) Standardize(r *http.Response) Response {
 		r.Header.Set("Expires", time.Now().Add(time.Hour*1).Format(time.RFC1123))
 	}
 
-	resp.response = r
 	resp.body, _ = ioutil.ReadAll(r.Body)
 	r.Body.Close()
 	r.Body = ioutil.NopCloser(bytes.NewReader(resp.body))
+	decodeBody(&resp, r)
 	if !strings.Contains(cc, "no-store") {
-		hasher := blake2b.New256()
-		hasher.Write(resp.body)
-		etag := base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+		etag := etag(resp.body)
 		resp.Header().Set("Etag", etag)
 		r.Header.Set("Etag", etag)
 	}
+	if c.compressible(r.Header, resp.body) {
+		c.compress(&resp, r)
+	}
 	resp.cookies = make(map[string]*http.Cookie)
-	for _, cookie := range resp.response.Cookies() {
+	for _, cookie := range r.Cookies() {
 		resp.cookies[cookie.Name] = cookie
 	}
 	if r.Request != nil {
-		resp.requestHeaders = r.Request.Header
+		resp.requestHeaders = http.Header{}
+		copyHeader(resp.requestHeaders, r.Request.Header)
 	} else {
 		resp.requestHeaders = http.Header{}
 	}
@@ -180,26 +337,37 @@ func (c *defaultCacher) Standardize(r *http.Response) Response {
 	return &resp
 }
 
-// Cache will store the Response in the cache for later retrieval
+// etag returns the Etag of a response with body.
+func etag(body []byte) string {
+	hasher := blake2b.New256()
+	hasher.Write(body)
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// Cache will store the Response in the cache for later retrieval.
+// It is stored as a variant of the url in hash, keyed by the
+// request placeholders of the KeyTemplate in hash, and the request
+// headers named in the response's Vary header.
 func (c *defaultCacher) Cache(hash string, r Response) {
-	vary := r.Header().Get("Vary")
-	if vary != "" {
-		c.vary.Store(hash, vary)
-	}
-	hash += utilities.GetVaryHeadersHash(r.RequestHeaders(), r, c.allowedCookieNames, vary)
-	c.entries.Store(hash, r)
+	primary, key := splitHash(hash)
+	attributes, _ := splitVariant(key)
+	vary := normalizeVary(r.Header().Get("Vary"))
+	request := &http.Request{Header: r.RequestHeaders()}
+	key = joinVariant(attributes, utilities.GetVaryHeadersHash(request.Header, request, c.allowedCookieNames, vary))
+	v, _ := c.entries.LoadOrStore(primary, &variants{})
+	v.(*variants).store(key, vary, r, c.maxVariants)
 }
 
 // Load returns a Response from the cache.  It returns the Response, if found, and
 // a boolean indicating whether or not it was found (and matched the Vary header, if
 // present)
 func (c *defaultCacher) Load(hash string, request *http.Request) (Response, bool) {
-	var r Response
-	tmp, ok := c.entries.Load(hash)
-	if ok {
-		r = tmp.(Response)
+	primary, key := splitHash(hash)
+	v, ok := c.entries.Load(primary)
+	if !ok {
+		return nil, false
 	}
-	return r, ok
+	return v.(*variants).load(key)
 }
 
 func (c *defaultCacher) AllowedCookies() []string {
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,6 +72,18 @@ func TestDefaultCacheCannotCacheStaticFiles(t *testing.T) {
 		t.Error("Default cacher should not be able to cache static files: ", request.URL.Path)
 	}
 }
+
+func TestDefaultCacheCanCacheStaticFilesWithStaticPolicy(t *testing.T) {
+	var request = newValidRequest("https://www.example.com/images/test.jpg")
+	var cache = NewDefaultCacher()
+	if !cache.CanCache(request) {
+		t.Error("Default cacher should cache static files under the default static policy: ", request.URL.Path)
+	}
+	cache.SetStaticPolicy(StaticPolicy{Extensions: []string{".jpg"}})
+	if cache.CanCache(request) {
+		t.Error("Default cacher should not cache static files if the static policy has no max-age")
+	}
+}
 func TestDefaultCacheCannotCacheIfAuthorizationHeader(t *testing.T) {
 	request := validRequest()
 	request.Header.Add("Authorization", "P@ssw0rd")
@@ -124,6 +138,26 @@ func TestDefaultCacheHashesAreDifferentIfDomainsAreDifferent(t *testing.T) {
 	}
 }
 
+func TestDefaultCacheHashesAreDifferentIfNamespacesAreDifferent(t *testing.T) {
+	request := newValidRequest("https://www.insomniac.com/feed")
+	var cacheA = NewDefaultCacher()
+	var cacheB = NewDefaultCacher()
+	cacheA.SetNamespace("insomniac")
+	cacheB.SetNamespace("nightowls")
+	if cacheA.Hash(request) == cacheB.Hash(request) {
+		t.Error("Default cacher should hash different namespaces differently")
+	}
+}
+
+func TestDefaultCacheDoesNotCacheSkipRegex(t *testing.T) {
+	request := newValidRequest("https://www.insomniac.com/cart")
+	var cache = NewDefaultCacher()
+	cache.AddSkipRegex(regexp.MustCompile("^/cart"))
+	if cache.CanCache(request) {
+		t.Error("Default cacher should not cache paths matching an added skip regex")
+	}
+}
+
 func TestDefaultCacheHashesAreDifferentIfPathsAreDifferent(t *testing.T) {
 	requestA := newValidRequest("https://www.insomniac.com/feed")
 	requestB := newValidRequest("https://www.insomniac.com/home")
@@ -142,8 +176,8 @@ func TestDefaultCacheHashDoesNotIncludeCookiesUnlessAllowed(t *testing.T) {
 	})
 	var cache = NewDefaultCacher()
 	hash := cache.Hash(requestA)
-	cache.vary.Store(hash, "cookie")
-	defer cache.vary.Delete(hash)
+	cache.entries.Store(hash, &variants{vary: "cookie"})
+	defer cache.entries.Delete(hash)
 	assert.Equal(t, cache.Hash(requestA), cache.Hash(requestB), "Hash should be equal if cookie not in allowed list")
 
 }
@@ -158,9 +192,8 @@ func TestDefaultCacheHashDoesIncludeCookiesIfAllowed(t *testing.T) {
 	var cache = NewDefaultCacher()
 	cache.AddAllowedCookie("site_lang_id")
 	hash := cache.Hash(requestA)
-	cache.vary.Store(hash, "cookie")
-	cache.vary.Store(hash, "cookie")
-	defer cache.vary.Delete(hash)
+	cache.entries.Store(hash, &variants{vary: "cookie"})
+	defer cache.entries.Delete(hash)
 	assert.NotEqual(t, cache.Hash(requestA), cache.Hash(requestB), "Hash should not be equal if allowed cookies are different")
 }
 
@@ -225,3 +258,74 @@ func TestDefaultCacheDoesntFindIfCookiesDontMatch(t *testing.T) {
 		t.Error("Cacher should not match if cookies don't match")
 	}
 }
+
+func TestDefaultCacheMarksImmutableRoutes(t *testing.T) {
+	response := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": []string{"public, max-age=60"}},
+		Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("test"))),
+		Request:    newValidRequest("https://www.insomniac.com/app.3f9a2c1d.js"),
+	}
+	var cache = NewDefaultCacher()
+	cache.AddImmutable(FingerprintRegexp)
+	r := cache.Standardize(&response)
+	if cc := r.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("Default cacher should mark responses to immutable routes immutable, got %q", cc)
+	}
+	if response.Header.Get("Cache-Control") != r.Header().Get("Cache-Control") {
+		t.Error("Default cacher should send immutable to the client too")
+	}
+}
+
+func TestDefaultCacheDoesNotMarkOtherRoutesImmutable(t *testing.T) {
+	response := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": []string{"public, max-age=60"}},
+		Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("test"))),
+		Request:    newValidRequest("https://www.insomniac.com/app.js"),
+	}
+	var cache = NewDefaultCacher()
+	cache.AddImmutable(FingerprintRegexp)
+	r := cache.Standardize(&response)
+	if strings.Contains(r.Header().Get("Cache-Control"), "immutable") {
+		t.Error("Default cacher should not mark responses to other routes immutable")
+	}
+}
+
+func TestDefaultCacheOnlyMarksCacheableSuccessesImmutable(t *testing.T) {
+	for _, tt := range []struct {
+		statusCode int
+		cc         string
+	}{
+		{http.StatusMovedPermanently, "public, max-age=60"},
+		{http.StatusNotFound, "public, max-age=60"},
+		{http.StatusOK, "private, max-age=60"},
+		{http.StatusOK, "no-store"},
+	} {
+		response := http.Response{
+			StatusCode: tt.statusCode,
+			Header:     http.Header{"Cache-Control": []string{tt.cc}},
+			Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("test"))),
+			Request:    newValidRequest("https://www.insomniac.com/app.3f9a2c1d.js"),
+		}
+		var cache = NewDefaultCacher()
+		cache.AddImmutable(FingerprintRegexp)
+		r := cache.Standardize(&response)
+		if strings.Contains(r.Header().Get("Cache-Control"), "immutable") {
+			t.Errorf("Default cacher should not mark a %d with %q immutable", tt.statusCode, tt.cc)
+		}
+	}
+}
+
+func TestFingerprintRegexp(t *testing.T) {
+	for _, path := range []string{"/app.3f9a2c1d.js", "/main.3F9A2C1D.css", "/js/vendor.0123456789abcdef0123.js", "/a.12345678ab.js", "/a.ab12345678.js"} {
+		if !FingerprintRegexp.MatchString(path) {
+			t.Errorf("%s should be fingerprinted", path)
+		}
+	}
+	for _, path := range []string{"/photo-20180512.jpg", "/photo.20180512.jpg", "/img/bg-facade.png", "/decade.css", "/theme.facade.css", "/app.js", "/logo.1a.png", "/v.2b.css", "/app.3f9a2c.js", "/a.1234567a"} {
+		if FingerprintRegexp.MatchString(path) {
+			t.Errorf("%s should not be fingerprinted", path)
+		}
+	}
+}
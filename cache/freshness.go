@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjwilkins/honey/utilities"
+)
+
+var minFreshFinder = regexp.MustCompile(`min-fresh=(?:\")?(\d+)(?:\")?(?:,|$)`)
+var maxStaleFinder = regexp.MustCompile(`max-stale(?:=(?:\")?(\d+)(?:\")?)?(?:,|$)`)
+
+// Fresh returns whether the response may be served for req without
+// going to the backend, and whether it is stale.  Like any shared
+// cache, the response's own freshness lifetime decides this, and the
+// request's max-age and min-fresh can only make it shorter, unless
+// the response is immutable.  The
+// request's max-stale allows it to be served stale - for as long as
+// its value, or for any time if it has none - unless the response
+// must be revalidated once stale.
+// https://tools.ietf.org/html/rfc7234#section-4.2
+// https://tools.ietf.org/html/rfc7234#section-5.2.1
+func (r *responseImpl) Fresh(req *http.Request) (ok bool, stale bool) {
+	lifetime := r.lifetime()
+	age := r.age()
+	stale = age >= lifetime
+	// An immutable response won't change while it is fresh, so the
+	// request can't ask for a newer one.
+	// https://tools.ietf.org/html/rfc8246
+	if !stale && HasDirective(r.Header().Get("Cache-Control"), "immutable") {
+		return true, false
+	}
+	cc := req.Header.Get("Cache-Control")
+	if maxAge, found := utilities.GetMaxAge(cc); found && age > time.Duration(maxAge)*time.Second {
+		return false, stale
+	}
+	if tmp := minFreshFinder.FindStringSubmatch(cc); len(tmp) == 2 {
+		minFresh, _ := strconv.Atoi(tmp[1])
+		if lifetime-age < time.Duration(minFresh)*time.Second {
+			return false, stale
+		}
+	}
+	if !stale {
+		return true, false
+	}
+	// https://tools.ietf.org/html/rfc7234#section-5.2.2.1
+	respCC := r.Header().Get("Cache-Control")
+	if HasDirective(respCC, "must-revalidate") || HasDirective(respCC, "proxy-revalidate") ||
+		HasDirective(respCC, "no-cache") {
+		return false, true
+	}
+	tmp := maxStaleFinder.FindStringSubmatch(cc)
+	if len(tmp) != 2 {
+		return false, true
+	}
+	if tmp[1] == "" {
+		return true, true
+	}
+	maxStale, _ := strconv.Atoi(tmp[1])
+	return age-lifetime <= time.Duration(maxStale)*time.Second, true
+}
+
+// Staleness returns how long resp has been stale - its age, less its
+// freshness lifetime - which is negative while it is fresh.
+func Staleness(resp Response) time.Duration {
+	if impl, ok := resp.(*responseImpl); ok {
+		return impl.age() - impl.lifetime()
+	}
+	age, _ := strconv.Atoi(resp.Age())
+	maxAge, _ := utilities.GetMaxAge(resp.Header().Get("Cache-Control"))
+	return time.Duration(age-maxAge) * time.Second
+}
+
+// lifetime returns the freshness lifetime of the response - from its
+// s-maxage, max-age, or Expires and Date headers - or 0 if it has
+// none, or must be revalidated every time with no-cache.
+// https://tools.ietf.org/html/rfc7234#section-4.2.1
+func (r *responseImpl) lifetime() time.Duration {
+	cc := r.Header().Get("Cache-Control")
+	if HasDirective(cc, "no-cache") {
+		return 0
+	}
+	if maxAge, found := utilities.GetMaxAge(cc); found {
+		return time.Duration(maxAge) * time.Second
+	}
+	expires, err := http.ParseTime(r.Header().Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(r.Header().Get("Date"))
+	if err != nil {
+		date = r.now
+	}
+	if expires.Before(date) {
+		return 0
+	}
+	return expires.Sub(date)
+}
+
+// age returns how long it has been since the response was generated
+// by the backend - the time it has been in the cache, plus the Age
+// header it was received with, if any.
+// https://tools.ietf.org/html/rfc7234#section-4.2.3
+func (r *responseImpl) age() time.Duration {
+	return time.Since(r.now) + r.initialAge
+}
+
+// HasDirective returns whether the Cache-Control cc has directive,
+// without a field-name (e.g. no-cache, but not no-cache="set-cookie").
+func HasDirective(cc, directive string) bool {
+	for _, part := range strings.Split(cc, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), directive) {
+			return true
+		}
+	}
+	return false
+}
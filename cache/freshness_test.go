@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+func newAgedResponse(age time.Duration, cc string) *responseImpl {
+	response := &responseImpl{
+		headers: http.Header{},
+		now:     time.Now().Add(-age),
+	}
+	response.headers.Set("Cache-Control", cc)
+	return response
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshWithinMaxAge() {
+	fresh, stale := newAgedResponse(30*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().True(fresh, "A response younger than its max-age should be fresh")
+	suite.Assert().False(stale)
+}
+
+func (suite *ResponseTestSuite) TestResponseNotFreshAfterMaxAge() {
+	fresh, stale := newAgedResponse(90*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().False(fresh, "A response older than its max-age should not be fresh")
+	suite.Assert().True(stale)
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshPrefersSMaxAge() {
+	fresh, _ := newAgedResponse(90*time.Second, "public, max-age=60, s-maxage=120").Fresh(suite.request)
+	suite.Assert().True(fresh, "A shared cache should use s-maxage over max-age")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshUsesExpires() {
+	response := newAgedResponse(30*time.Second, "public")
+	date := time.Now().Add(-30 * time.Second)
+	response.headers.Set("Date", date.UTC().Format(http.TimeFormat))
+	response.headers.Set("Expires", date.Add(time.Minute).UTC().Format(http.TimeFormat))
+	fresh, _ := response.Fresh(suite.request)
+	suite.Assert().True(fresh, "A response before its Expires should be fresh")
+	response.headers.Set("Expires", date.Add(10*time.Second).UTC().Format(http.TimeFormat))
+	fresh, _ = response.Fresh(suite.request)
+	suite.Assert().False(fresh, "A response after its Expires should not be fresh")
+}
+
+func (suite *ResponseTestSuite) TestResponseNoCacheIsNeverFresh() {
+	fresh, _ := newAgedResponse(0, "no-cache").Fresh(suite.request)
+	suite.Assert().False(fresh, "A no-cache response must always be revalidated")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshCountsInitialAge() {
+	response := newAgedResponse(30*time.Second, "public, max-age=60")
+	response.initialAge = 40 * time.Second
+	fresh, _ := response.Fresh(suite.request)
+	suite.Assert().False(fresh, "The Age the response arrived with should count towards its age")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshRequestMaxAge() {
+	suite.request.Header.Set("Cache-Control", "max-age=10")
+	fresh, stale := newAgedResponse(30*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().False(fresh, "A request max-age should make the response's lifetime shorter")
+	suite.Assert().False(stale, "The response should not be stale just because the request wants a newer one")
+	suite.request.Header.Set("Cache-Control", "max-age=600")
+	fresh, _ = newAgedResponse(90*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().False(fresh, "A request max-age should not make the response's lifetime longer")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshImmutableIgnoresRequestMaxAge() {
+	suite.request.Header.Set("Cache-Control", "max-age=0")
+	fresh, _ := newAgedResponse(30*time.Second, "public, max-age=60, immutable").Fresh(suite.request)
+	suite.Assert().True(fresh, "An immutable response should be fresh whatever the request asks for")
+	fresh, _ = newAgedResponse(90*time.Second, "public, max-age=60, immutable").Fresh(suite.request)
+	suite.Assert().False(fresh, "An immutable response should not be fresh after its lifetime")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshRequestMinFresh() {
+	suite.request.Header.Set("Cache-Control", "min-fresh=40")
+	fresh, _ := newAgedResponse(30*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().False(fresh, "A response which won't be fresh for min-fresh should not be served")
+	suite.request.Header.Set("Cache-Control", "min-fresh=20")
+	fresh, _ = newAgedResponse(30*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().True(fresh, "A response which will be fresh for min-fresh should be served")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshRequestMaxStale() {
+	suite.request.Header.Set("Cache-Control", "max-stale=60")
+	fresh, stale := newAgedResponse(90*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().True(fresh, "A response stale for less than max-stale should be served")
+	suite.Assert().True(stale)
+	fresh, _ = newAgedResponse(150*time.Second, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().False(fresh, "A response stale for more than max-stale should not be served")
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshRequestMaxStaleWithoutValue() {
+	suite.request.Header.Set("Cache-Control", "max-stale, no-transform")
+	fresh, stale := newAgedResponse(24*time.Hour, "public, max-age=60").Fresh(suite.request)
+	suite.Assert().True(fresh, "max-stale without a value should accept a response however stale")
+	suite.Assert().True(stale)
+}
+
+func (suite *ResponseTestSuite) TestResponseFreshMaxStaleMustRevalidate() {
+	suite.request.Header.Set("Cache-Control", "max-stale")
+	fresh, _ := newAgedResponse(90*time.Second, "public, max-age=60, must-revalidate").Fresh(suite.request)
+	suite.Assert().False(fresh, "A must-revalidate response should never be served stale")
+}
+
+func (suite *ResponseTestSuite) TestResponseStaleness() {
+	response := newAgedResponse(90*time.Second, "public, max-age=60")
+	staleness := Staleness(response)
+	suite.Assert().True(staleness >= 30*time.Second && staleness < 31*time.Second, "Staleness should be the age past the max-age")
+	response.initialAge = 40 * time.Second
+	suite.Assert().True(Staleness(response) >= 70*time.Second, "Staleness should include the Age it was received with")
+	suite.Assert().True(Staleness(newAgedResponse(0, "public, max-age=60")) < 0, "A fresh response shouldn't be stale")
+}
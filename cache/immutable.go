@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ImmutableMaxAge is the max-age given to responses marked immutable.
+const ImmutableMaxAge = 365 * 24 * time.Hour
+
+// FingerprintRegexp matches the names of assets with a hash of their
+// content in them, like app.3f9a2c1d.js or main.3F9A2C1D0B.css, which
+// can be marked immutable since a new version gets a new name.  The
+// hash must be between dots, be at least MinFingerprintLength hex
+// digits long, and have both digits and letters, so that dates, like
+// photo-20180512.jpg, words, like facade.png, and short version
+// segments, like logo.1a.png, aren't mistaken for one.
+var FingerprintRegexp = regexp.MustCompile(fingerprintPattern())
+
+// MinFingerprintLength is the fewest hex digits FingerprintRegexp
+// takes to be a hash.
+const MinFingerprintLength = 8
+
+// fingerprintPattern returns the pattern of FingerprintRegexp.  Since
+// the hash has both digits and letters, a digit is next to a letter
+// somewhere in it, so it is matched by where that is, with enough hex
+// digits around it to make it MinFingerprintLength long.
+func fingerprintPattern() string {
+	const mixed = "(?:[0-9][a-f]|[a-f][0-9])"
+	around := MinFingerprintLength - 2
+	var alternatives []string
+	for before := 0; before < around; before++ {
+		alternatives = append(alternatives, fmt.Sprintf("[0-9a-f]{%d}%s[0-9a-f]{%d,}", before, mixed, around-before))
+	}
+	alternatives = append(alternatives, fmt.Sprintf("[0-9a-f]{%d,}%s[0-9a-f]*", around, mixed))
+	return `(?i)\.(?:` + strings.Join(alternatives, "|") + `)\.[a-z0-9]+$`
+}
+
+var immutableCacheControl = fmt.Sprintf("public, max-age=%d, immutable", int(ImmutableMaxAge/time.Second))
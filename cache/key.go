@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// KeyRules control how the url of a request is turned into
+// the primary part of its hash, so that urls which will get
+// the same response from the backend share a cache entry.
+type KeyRules struct {
+	// IncludeScheme adds the scheme (http or https) to the key
+	IncludeScheme bool
+	// IncludeHost adds the host to the key
+	IncludeHost bool
+	// SortQuery sorts the query parameters by name, so that
+	// ?a=1&b=2 and ?b=2&a=1 share a key
+	SortQuery bool
+	// IgnoreQuery lists query parameters which are dropped from
+	// the key.  A name ending in * matches any parameter with
+	// that prefix, e.g. utm_*
+	IgnoreQuery []string
+	// AllowQuery, if not empty, lists the only query parameters
+	// which are kept in the key.  It supports * the same way as
+	// IgnoreQuery.
+	AllowQuery []string
+	// IgnoreFragment drops the #fragment from the key
+	IgnoreFragment bool
+	// NormalizeEncoding decodes percent-encoded characters which
+	// did not need to be encoded, and upper-cases the rest, so
+	// that /%7euser and /~user share a key
+	NormalizeEncoding bool
+	// TrimTrailingSlash treats /path/ and /path as the same url.
+	// Don't use this if the backend redirects between the two.
+	TrimTrailingSlash bool
+}
+
+// DefaultKeyRules are the KeyRules used by the default cacher.
+// They keep the scheme and host, sort the query, and ignore
+// the fragment and common tracking parameters.
+func DefaultKeyRules() KeyRules {
+	return KeyRules{
+		IncludeScheme:     true,
+		IncludeHost:       true,
+		SortQuery:         true,
+		IgnoreQuery:       []string{"utm_*", "fbclid", "gclid"},
+		IgnoreFragment:    true,
+		NormalizeEncoding: true,
+	}
+}
+
+type keyRoute struct {
+	match    *regexp.Regexp
+	rules    KeyRules
+	template *KeyTemplate
+}
+
+// Key returns the url u as it should appear in the hash.
+func (k KeyRules) Key(u *url.URL) string {
+	var buffer bytes.Buffer
+	if k.IncludeScheme && u.Scheme != "" {
+		buffer.WriteString(u.Scheme)
+		buffer.WriteString(":")
+	}
+	if k.IncludeHost && u.Host != "" {
+		buffer.WriteString("//")
+		buffer.WriteString(strings.ToLower(u.Host))
+	}
+	path := u.EscapedPath()
+	if k.NormalizeEncoding {
+		path = normalizeEncoding(path)
+	}
+	if k.TrimTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	if path == "" {
+		path = "/"
+	}
+	buffer.WriteString(path)
+	if query := k.query(u.RawQuery); query != "" {
+		buffer.WriteString("?")
+		buffer.WriteString(query)
+	}
+	if !k.IgnoreFragment && u.Fragment != "" {
+		buffer.WriteString("#")
+		buffer.WriteString(u.EscapedFragment())
+	}
+	return buffer.String()
+}
+
+// query filters, sorts and normalizes a raw query string.
+func (k KeyRules) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	var params []string
+	for _, param := range strings.Split(raw, "&") {
+		if param == "" {
+			continue
+		}
+		if k.NormalizeEncoding {
+			param = normalizeEncoding(param)
+		}
+		name := param
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if matchesParam(k.IgnoreQuery, name) {
+			continue
+		}
+		if len(k.AllowQuery) > 0 && !matchesParam(k.AllowQuery, name) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if k.SortQuery {
+		// sort by name first, so that the order of values for
+		// the same name - which may be significant - is kept
+		sort.SliceStable(params, func(i, j int) bool {
+			return paramName(params[i]) < paramName(params[j])
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func paramName(param string) string {
+	if i := strings.Index(param, "="); i >= 0 {
+		return param[:i]
+	}
+	return param
+}
+
+// matchesParam returns true if name matches any of the patterns.
+func matchesParam(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEncoding applies the percent-encoding normalization from
+// https://tools.ietf.org/html/rfc3986#section-6.2.2.2 - unreserved
+// characters are decoded, and the hex digits of everything else are
+// upper-cased.
+func normalizeEncoding(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var buffer bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			buffer.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			buffer.WriteByte(c)
+		} else {
+			buffer.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return buffer.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func key(rules KeyRules, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		panic(err)
+	}
+	return rules.Key(u)
+}
+
+func TestKeyRulesSortQuery(t *testing.T) {
+	rules := DefaultKeyRules()
+	assert.Equal(t, key(rules, "https://www.insomniac.com/?a=1&b=2"), key(rules, "https://www.insomniac.com/?b=2&a=1"))
+	assert.Equal(t, "https://www.insomniac.com/?a=2&a=1&b=1", key(rules, "https://www.insomniac.com/?a=2&b=1&a=1"), "Values for the same parameter should keep their order")
+}
+
+func TestKeyRulesIgnoreTrackingParameters(t *testing.T) {
+	rules := DefaultKeyRules()
+	assert.Equal(t, "https://www.insomniac.com/events?page=2", key(rules, "https://www.insomniac.com/events?utm_source=x&page=2&utm_medium=y&fbclid=abc&gclid=def"))
+}
+
+func TestKeyRulesAllowQuery(t *testing.T) {
+	rules := DefaultKeyRules()
+	rules.AllowQuery = []string{"s", "page"}
+	assert.Equal(t, "https://www.insomniac.com/?page=2&s=edc", key(rules, "https://www.insomniac.com/?s=edc&ref=home&page=2"))
+}
+
+func TestKeyRulesIgnoreFragment(t *testing.T) {
+	rules := DefaultKeyRules()
+	assert.Equal(t, key(rules, "https://www.insomniac.com/lineup"), key(rules, "https://www.insomniac.com/lineup#day-1"))
+	rules.IgnoreFragment = false
+	assert.NotEqual(t, key(rules, "https://www.insomniac.com/lineup"), key(rules, "https://www.insomniac.com/lineup#day-1"))
+}
+
+func TestKeyRulesNormalizeEncoding(t *testing.T) {
+	rules := DefaultKeyRules()
+	assert.Equal(t, key(rules, "https://www.insomniac.com/~user?q=a%2fb"), key(rules, "https://www.insomniac.com/%7euser?q=a%2Fb"))
+	assert.NotEqual(t, key(rules, "https://www.insomniac.com/a/b"), key(rules, "https://www.insomniac.com/a%2Fb"), "Reserved characters should not be decoded")
+}
+
+func TestKeyRulesTrailingSlash(t *testing.T) {
+	rules := DefaultKeyRules()
+	assert.NotEqual(t, key(rules, "https://www.insomniac.com/about/"), key(rules, "https://www.insomniac.com/about"))
+	rules.TrimTrailingSlash = true
+	assert.Equal(t, key(rules, "https://www.insomniac.com/about/"), key(rules, "https://www.insomniac.com/about"))
+	assert.Equal(t, "https://www.insomniac.com/", key(rules, "https://www.insomniac.com/"))
+}
+
+func TestKeyRulesHostAndScheme(t *testing.T) {
+	rules := KeyRules{}
+	assert.Equal(t, "/about", key(rules, "https://www.insomniac.com/about"))
+	rules.IncludeHost = true
+	assert.Equal(t, "//www.insomniac.com/about", key(rules, "https://WWW.insomniac.com/about"))
+	rules.IncludeScheme = true
+	assert.Equal(t, "https://www.insomniac.com/about", key(rules, "https://www.insomniac.com/about"))
+}
+
+func TestDefaultCacheHashUsesKeyRoutes(t *testing.T) {
+	cache := NewDefaultCacher()
+	rules := DefaultKeyRules()
+	rules.AllowQuery = []string{"s"}
+	cache.AddKeyRoute(regexp.MustCompile("^/search"), rules)
+	assert.Equal(t, cache.Hash(newValidRequest("https://www.insomniac.com/search?s=edc&sort=date")), cache.Hash(newValidRequest("https://www.insomniac.com/search?s=edc")))
+	assert.NotEqual(t, cache.Hash(newValidRequest("https://www.insomniac.com/events?s=edc&sort=date")), cache.Hash(newValidRequest("https://www.insomniac.com/events?s=edc")))
+}
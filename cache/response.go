@@ -24,15 +24,23 @@ type Response interface {
 	Header() http.Header
 	Body() []byte
 	Validate(*http.Request) (bool, int)
+	// Fresh returns whether the response may be served for the
+	// request without going to the backend, and whether it is stale.
+	Fresh(*http.Request) (ok bool, stale bool)
 	Age() string
 	Cookie(name string) (*http.Cookie, error)
 	RequestHeaders() http.Header
 }
 
 type responseImpl struct {
-	response       *http.Response
+	status     string
+	statusCode int
+	// initialAge is the Age the response was received with
+	initialAge     time.Duration
 	cookies        map[string]*http.Cookie
 	body           []byte
+	encodings      map[string][]byte
+	compression    CompressionOptions
 	headers        http.Header
 	requestHeaders http.Header
 	once           sync.Once
@@ -53,12 +61,12 @@ func (r *responseImpl) Cookie(name string) (*http.Cookie, error) {
 
 // Status returns the Status of the response
 func (r *responseImpl) Status() string {
-	return r.response.Status
+	return r.status
 }
 
 // StatusCode returns the http Status Code of the response
 func (r *responseImpl) StatusCode() int {
-	return r.response.StatusCode
+	return r.statusCode
 }
 
 // Header returns a map[string][]string containing the
@@ -149,7 +157,7 @@ func (r *responseImpl) Validate(req *http.Request) (bool, int) {
 	return true, http.StatusNotModified
 }
 
-// Body returns the content of the response
+// Body returns the content of the response.
 func (r *responseImpl) Body() []byte {
 	return r.body
 }
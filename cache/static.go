@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjwilkins/honey/utilities"
+)
+
+// A StaticPolicy decides which responses are static files - assets
+// like stylesheets, scripts and images - and how they are cached.
+// Static files are cached for at least MaxAge, keeping the backend's
+// other Cache-Control directives, have their Set-Cookie headers
+// removed, even for allowed cookies, and don't vary on Cookie, since
+// they are the same for every visitor.
+type StaticPolicy struct {
+	// MaxAge is how long static files are cached for.  If it is 0,
+	// they aren't cached at all.
+	MaxAge time.Duration
+	// Extensions are the file extensions, with their leading dot,
+	// of the paths of static files.
+	Extensions []string
+	// ContentTypes are the media types of responses which are
+	// static files, whatever their path.  A type ending in /*,
+	// like image/*, matches any subtype.
+	ContentTypes []string
+}
+
+// DefaultStaticMaxAge is the MaxAge of the DefaultStaticPolicy.
+const DefaultStaticMaxAge = 30 * 24 * time.Hour
+
+// DefaultStaticPolicy returns a StaticPolicy which caches the files
+// with the extensions utilities.IsStaticFile assumes to be static for
+// DefaultStaticMaxAge, and doesn't look at their Content-Type.
+func DefaultStaticPolicy() StaticPolicy {
+	return StaticPolicy{
+		MaxAge:     DefaultStaticMaxAge,
+		Extensions: utilities.StaticFileExtensions(),
+	}
+}
+
+// SetStaticPolicy sets the StaticPolicy for static files.
+func (c *defaultCacher) SetStaticPolicy(policy StaticPolicy) {
+	c.static = policy
+	c.staticExtensions = make(map[string]bool, len(policy.Extensions))
+	for _, extension := range policy.Extensions {
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		c.staticExtensions[strings.ToLower(extension)] = true
+	}
+}
+
+// IsStaticPath returns whether path has one of the policy's Extensions.
+// Files which are only static because of their ContentTypes can't be
+// told by their path.
+func (p StaticPolicy) IsStaticPath(path string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return false
+	}
+	for _, extension := range p.Extensions {
+		if strings.EqualFold(strings.TrimPrefix(extension, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaticPath returns whether path has the extension of a static file.
+func (c *defaultCacher) isStaticPath(path string) bool {
+	if c.staticExtensions == nil {
+		return utilities.IsStaticFile(path)
+	}
+	return c.staticExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// isStatic returns whether r is a static file, because of the path it
+// was requested at, or its Content-Type.
+func (c *defaultCacher) isStatic(r *http.Response) bool {
+	if r.Request != nil && r.Request.URL != nil && c.isStaticPath(r.Request.URL.Path) {
+		return true
+	}
+	return MatchContentType(r.Header.Get("Content-Type"), c.static.ContentTypes)
+}
+
+// standardizeStatic applies the StaticPolicy to the static file r,
+// whose standardized headers are headers.  Responses the backend
+// says are private or mustn't be stored are left alone.
+func (c *defaultCacher) standardizeStatic(r *http.Response, headers http.Header) {
+	if cc := r.Header.Get("Cache-Control"); strings.Contains(cc, "private") || strings.Contains(cc, "no-store") {
+		return
+	}
+	cc := staticCacheControl(headers.Get("Cache-Control"), c.static.MaxAge)
+	for _, h := range []http.Header{r.Header, headers} {
+		h.Del("Set-Cookie")
+		if vary := without(h.Get("Vary"), "cookie"); vary != "" {
+			h.Set("Vary", vary)
+		} else {
+			h.Del("Vary")
+		}
+		h.Set("Cache-Control", cc)
+	}
+}
+
+// staticCacheControl returns the Cache-Control cc, made public, with its
+// max-age raised to maxAge.  Its other directives, like immutable or
+// must-revalidate, are kept, as are a max-age or s-maxage which are
+// already longer.
+func staticCacheControl(cc string, maxAge time.Duration) string {
+	seconds := int(maxAge / time.Second)
+	directives := []string{"public"}
+	raised := false
+	for _, part := range strings.Split(cc, ",") {
+		part = strings.TrimSpace(part)
+		name, value := strings.ToLower(part), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		switch name {
+		case "", "public":
+			continue
+		case "max-age", "s-maxage":
+			// A shorter one would be used instead of the raised max-age
+			if age, err := strconv.Atoi(value); err != nil || age < seconds {
+				continue
+			}
+			raised = raised || name == "max-age"
+		}
+		directives = append(directives, part)
+	}
+	if !raised {
+		directives = append(directives, fmt.Sprintf("max-age=%d", seconds))
+	}
+	return strings.Join(directives, ", ")
+}
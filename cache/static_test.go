@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newStaticResponse(uri, contentType string) *http.Response {
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": []string{"max-age=60"},
+			"Content-Type":  []string{contentType},
+			"Vary":          []string{"Accept-Encoding, Cookie"},
+			"Set-Cookie":    []string{"site_lang_id=1", "PHPSESSID=abc"},
+		},
+		Body:    ioutil.NopCloser(bytes.NewBuffer([]byte("body {}"))),
+		Request: newValidRequest(uri),
+	}
+	return response
+}
+
+func TestStaticPolicyAppliesByExtension(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.AddAllowedCookie("site_lang_id")
+	response := newStaticResponse("https://www.insomniac.com/style.css", "text/css")
+	r := cache.Standardize(response)
+	assert.Equal(t, "public, max-age=2592000", r.Header().Get("Cache-Control"), "Static files should be cached for the static max-age")
+	assert.Empty(t, r.Header()["Set-Cookie"], "Static files should not set cookies, even allowed ones")
+	assert.Empty(t, response.Header["Set-Cookie"])
+	assert.Equal(t, "Accept-Encoding", r.Header().Get("Vary"), "Static files should not vary on Cookie")
+	assert.Equal(t, "Accept-Encoding", response.Header.Get("Vary"))
+}
+
+func TestStaticPolicyAppliesByContentType(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.SetStaticPolicy(StaticPolicy{MaxAge: time.Hour, ContentTypes: []string{"image/*", "text/css"}})
+	r := cache.Standardize(newStaticResponse("https://www.insomniac.com/logo", "image/png"))
+	assert.Equal(t, "public, max-age=3600", r.Header().Get("Cache-Control"))
+	r = cache.Standardize(newStaticResponse("https://www.insomniac.com/theme", "text/css; charset=utf-8"))
+	assert.Equal(t, "public, max-age=3600", r.Header().Get("Cache-Control"))
+	r = cache.Standardize(newStaticResponse("https://www.insomniac.com/about", "text/html"))
+	assert.NotEqual(t, "public, max-age=3600", r.Header().Get("Cache-Control"), "Pages should not be treated as static files")
+	assert.Equal(t, "Accept-Encoding, Cookie", r.Header().Get("Vary"))
+}
+
+func TestStaticPolicyRespectsPrivate(t *testing.T) {
+	cache := NewDefaultCacher()
+	response := newStaticResponse("https://www.insomniac.com/invoice.pdf", "application/pdf")
+	response.Header.Set("Cache-Control", "private, max-age=60")
+	r := cache.Standardize(response)
+	assert.Equal(t, "private, max-age=60", r.Header().Get("Cache-Control"), "Private static files should be left alone")
+}
+
+func TestStaticPolicyImmutableWins(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.AddImmutable(FingerprintRegexp)
+	r := cache.Standardize(newStaticResponse("https://www.insomniac.com/app.3f9a2c1d.css", "text/css"))
+	assert.Equal(t, immutableCacheControl, r.Header().Get("Cache-Control"))
+}
+
+func TestStaticPolicyKeepsDirectives(t *testing.T) {
+	cache := NewDefaultCacher()
+	for cc, expected := range map[string]string{
+		"max-age=60, immutable":               "public, immutable, max-age=2592000",
+		"public, no-cache":                    "public, no-cache, max-age=2592000",
+		"max-age=60, must-revalidate":         "public, must-revalidate, max-age=2592000",
+		"public, max-age=31536000":            "public, max-age=31536000",
+		"s-maxage=60, max-age=31536000":       "public, max-age=31536000",
+		"s-maxage=31536000, proxy-revalidate": "public, s-maxage=31536000, proxy-revalidate, max-age=2592000",
+	} {
+		response := newStaticResponse("https://www.insomniac.com/style.css", "text/css")
+		response.Header.Set("Cache-Control", cc)
+		r := cache.Standardize(response)
+		assert.Equal(t, expected, r.Header().Get("Cache-Control"), "The origin's directives should be kept, with max-age raised: %s", cc)
+		assert.Equal(t, expected, response.Header.Get("Cache-Control"))
+	}
+}
+
+func TestStaticPolicyIsStaticPath(t *testing.T) {
+	policy := StaticPolicy{Extensions: []string{".css", "js"}}
+	assert.True(t, policy.IsStaticPath("/style.CSS"))
+	assert.True(t, policy.IsStaticPath("/app.js"))
+	assert.False(t, policy.IsStaticPath("/logo.png"))
+	assert.False(t, policy.IsStaticPath("/about"))
+}
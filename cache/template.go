@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A KeyTemplate describes how the hash of a request is built, e.g.
+//
+//	{method}{host}{path}{query_sorted}{cookie:site_lang_id}{header:X-Device}
+//
+// The url placeholders make up the primary part of the hash, and
+// the request placeholders select a variant of it, in the same
+// way as the headers listed in a response's Vary header do.
+//
+// Url placeholders:
+//
+//	{method}        the request method
+//	{scheme}        http or https
+//	{host}          the host, lower-cased
+//	{path}          the path, normalized by the route's KeyRules
+//	{query}         the query, filtered and normalized by the KeyRules
+//	{query_sorted}  the same, but always sorted
+//	{query:NAME}    the value of the query parameter NAME
+//	{url}           the whole url as given by the KeyRules
+//
+// Request placeholders:
+//
+//	{cookie:NAME}   the value of the cookie NAME
+//	{header:NAME}   the value of the request header NAME
+//	{geo}           the country of the client, see GeoAttribute
+//	{attr:NAME}     the value of the KeyAttribute added as NAME
+//
+// Any other text is copied into the hash as is.
+type KeyTemplate struct {
+	source string
+	parts  []templatePart
+}
+
+// A KeyAttribute returns a value, derived from the request, which
+// can be used to vary the hash via {attr:NAME} in a KeyTemplate.
+type KeyAttribute func(r *http.Request) string
+
+type templatePart struct {
+	kind string
+	name string
+}
+
+var urlPlaceholders = map[string]bool{
+	"method":       true,
+	"scheme":       true,
+	"host":         true,
+	"path":         true,
+	"query":        true,
+	"query_sorted": true,
+	"url":          true,
+}
+
+var requestPlaceholders = map[string]bool{
+	"cookie": true,
+	"header": true,
+	"geo":    true,
+	"attr":   true,
+}
+
+// ParseKeyTemplate parses a KeyTemplate.  It returns an error if a
+// placeholder is not closed, or is not one of the ones supported.
+func ParseKeyTemplate(template string) (*KeyTemplate, error) {
+	t := &KeyTemplate{source: template}
+	rest := template
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{name: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{name: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("key template %q: unclosed placeholder", template)
+		}
+		placeholder := rest[start+1 : start+end]
+		kind, name := placeholder, ""
+		if i := strings.Index(placeholder, ":"); i >= 0 {
+			kind, name = placeholder[:i], placeholder[i+1:]
+		}
+		if !urlPlaceholders[kind] && !requestPlaceholders[kind] {
+			return nil, fmt.Errorf("key template %q: unknown placeholder {%s}", template, placeholder)
+		}
+		needsName := kind == "cookie" || kind == "header" || kind == "attr"
+		if needsName && name == "" {
+			return nil, fmt.Errorf("key template %q: {%s} needs a name", template, kind)
+		}
+		if !needsName && name != "" && kind != "query" {
+			return nil, fmt.Errorf("key template %q: {%s} does not take a name", template, kind)
+		}
+		t.parts = append(t.parts, templatePart{kind: kind, name: name})
+		rest = rest[start+end+1:]
+	}
+	return t, nil
+}
+
+// MustParseKeyTemplate is like ParseKeyTemplate but panics if the
+// template cannot be parsed.
+func MustParseKeyTemplate(template string) *KeyTemplate {
+	t, err := ParseKeyTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the source of the template
+func (t *KeyTemplate) String() string {
+	return t.source
+}
+
+// Render returns the primary part of the hash for request r, and
+// the part which selects the variant of it.
+func (t *KeyTemplate) Render(r *http.Request, rules KeyRules, attributes map[string]KeyAttribute) (primary, variant string) {
+	var urlBuffer, requestBuffer bytes.Buffer
+	for _, part := range t.parts {
+		switch part.kind {
+		case "":
+			urlBuffer.WriteString(part.name)
+		case "method":
+			urlBuffer.WriteString(r.Method)
+		case "scheme":
+			urlBuffer.WriteString(r.URL.Scheme)
+		case "host":
+			urlBuffer.WriteString(strings.ToLower(r.URL.Host))
+		case "path":
+			urlBuffer.WriteString(rules.Key(&url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath}))
+		case "query":
+			if part.name == "" {
+				urlBuffer.WriteString(rules.query(r.URL.RawQuery))
+			} else {
+				urlBuffer.WriteString(url.QueryEscape(r.URL.Query().Get(part.name)))
+			}
+		case "query_sorted":
+			rules.SortQuery = true
+			urlBuffer.WriteString(rules.query(r.URL.RawQuery))
+		case "url":
+			urlBuffer.WriteString(rules.Key(r.URL))
+		default:
+			requestBuffer.WriteString(fmt.Sprintf(
+				" :: %s:%s=%s",
+				part.kind,
+				part.name,
+				strings.Replace(t.attribute(r, part, attributes), "::", "::::", -1),
+			))
+		}
+	}
+	return urlBuffer.String(), requestBuffer.String()
+}
+
+func (t *KeyTemplate) attribute(r *http.Request, part templatePart, attributes map[string]KeyAttribute) string {
+	switch part.kind {
+	case "cookie":
+		if cookie, err := r.Cookie(part.name); err == nil {
+			return cookie.Value
+		}
+	case "header":
+		return r.Header.Get(part.name)
+	case "geo":
+		if geo, ok := attributes["geo"]; ok {
+			return geo(r)
+		}
+		return GeoAttribute(r)
+	case "attr":
+		if attribute, ok := attributes[part.name]; ok {
+			return attribute(r)
+		}
+	}
+	return ""
+}
+
+// geoHeaders are request headers in which CDNs and load balancers
+// in front of honey commonly pass the country of the client.
+var geoHeaders = []string{
+	"CF-IPCountry",
+	"CloudFront-Viewer-Country",
+	"X-Country-Code",
+	"X-Geo-Country",
+}
+
+// GeoAttribute is the default KeyAttribute for {geo}.  It returns
+// the country code set by a CDN or load balancer in front of honey.
+// Replace it with AddKeyAttribute("geo", ...) to look the client's
+// address up in a GeoIP database instead.
+func GeoAttribute(r *http.Request) string {
+	for _, header := range geoHeaders {
+		if country := r.Header.Get(header); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+	return ""
+}
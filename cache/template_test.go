@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyTemplate(t *testing.T) {
+	_, err := ParseKeyTemplate("{method}{host}{path}{query_sorted}{cookie:site_lang_id}{header:X-Device}{geo}")
+	assert.NoError(t, err)
+	_, err = ParseKeyTemplate("{method}{host")
+	assert.Error(t, err, "An unclosed placeholder should be an error")
+	_, err = ParseKeyTemplate("{method}{fragment}")
+	assert.Error(t, err, "An unknown placeholder should be an error")
+	_, err = ParseKeyTemplate("{cookie}")
+	assert.Error(t, err, "A cookie placeholder without a name should be an error")
+	_, err = ParseKeyTemplate("{host:www}")
+	assert.Error(t, err, "A host placeholder with a name should be an error")
+}
+
+func TestKeyTemplateRender(t *testing.T) {
+	template := MustParseKeyTemplate("{method} {host}{path}?{query_sorted}{cookie:site_lang_id}{header:X-Device}{geo}")
+	request := newValidRequest("https://www.insomniac.com/events/?b=2&utm_source=x&a=1")
+	request.AddCookie(&http.Cookie{Name: "site_lang_id", Value: "1"})
+	request.Header.Set("X-Device", "mobile")
+	request.Header.Set("CF-IPCountry", "ca")
+	primary, variant := template.Render(request, DefaultKeyRules(), nil)
+	assert.Equal(t, "GET www.insomniac.com/events/?a=1&b=2", primary)
+	assert.Equal(t, " :: cookie:site_lang_id=1 :: header:X-Device=mobile :: geo:=CA", variant)
+}
+
+func TestKeyTemplateQueryParameter(t *testing.T) {
+	template := MustParseKeyTemplate("{path}:{query:page}")
+	primary, _ := template.Render(newValidRequest("https://www.insomniac.com/news?page=2&sort=date"), DefaultKeyRules(), nil)
+	assert.Equal(t, "/news:2", primary)
+	template = MustParseKeyTemplate("{path}:{query:sorted}")
+	primary, _ = template.Render(newValidRequest("https://www.insomniac.com/news?sorted=asc&page=2"), DefaultKeyRules(), nil)
+	assert.Equal(t, "/news:asc", primary, "A query parameter called sorted should be selectable")
+}
+
+func TestDefaultCacheHashUsesKeyTemplate(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.SetKeyTemplate(MustParseKeyTemplate("{method}{host}{path}{header:X-Device}"))
+	requestA := newValidRequest("https://www.insomniac.com/lineup")
+	requestB := newValidRequest("https://www.insomniac.com/lineup")
+	requestC := newValidRequest("https://www.insomniac.com/lineup")
+	requestA.Header.Set("X-Device", "mobile")
+	requestB.Header.Set("X-Device", "desktop")
+	requestC.Header.Set("X-Device", "mobile")
+	assert.NotEqual(t, cache.Hash(requestA), cache.Hash(requestB), "Requests with different template headers should hash differently")
+	assert.Equal(t, cache.Hash(requestA), cache.Hash(requestC), "Requests with the same template headers should hash the same")
+}
+
+func TestDefaultCacheStoresTemplateVariants(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.AddKeyTemplate(regexp.MustCompile("^/?$"), MustParseKeyTemplate("{method}{host}{path}{cookie:site_lang_id}"))
+	en, enResponse := newVariantResponse(cache, "", "en", "hello")
+	fr, frResponse := newVariantResponse(cache, "", "fr", "bonjour")
+	en.AddCookie(&http.Cookie{Name: "site_lang_id", Value: "1"})
+	fr.AddCookie(&http.Cookie{Name: "site_lang_id", Value: "2"})
+	cache.Cache(cache.Hash(en), enResponse)
+	cache.Cache(cache.Hash(fr), frResponse)
+	stored, ok := cache.Load(cache.Hash(en), en)
+	assert.True(t, ok)
+	assert.Equal(t, enResponse, stored)
+	stored, ok = cache.Load(cache.Hash(fr), fr)
+	assert.True(t, ok)
+	assert.Equal(t, frResponse, stored)
+}
+
+func TestDefaultCacheCustomKeyAttribute(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.SetKeyTemplate(MustParseKeyTemplate("{url}{attr:bot}"))
+	cache.AddKeyAttribute("bot", func(r *http.Request) string {
+		if regexp.MustCompile("(?i)bot").MatchString(r.UserAgent()) {
+			return "bot"
+		}
+		return "human"
+	})
+	requestA := validRequest()
+	requestB := validRequest()
+	requestA.Header.Set("User-Agent", "Googlebot/2.1")
+	requestB.Header.Set("User-Agent", "Mozilla/5.0")
+	assert.NotEqual(t, cache.Hash(requestA), cache.Hash(requestB))
+}
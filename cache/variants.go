@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// variantSeparator divides the primary part of a hash (the method
+// and url) from the secondary part which identifies one variant of
+// that url, as selected by the request placeholders of a KeyTemplate
+// and the response's Vary header.  It is a
+// control character, so it can never appear in an encoded url.
+const variantSeparator = "\x1f"
+
+// attributeSeparator divides the request placeholders of a
+// KeyTemplate from the values of the headers in Vary within
+// the secondary part of a hash.
+const attributeSeparator = "\x1e"
+
+// DefaultMaxVariants is the number of variants which will be kept
+// for a single url unless changed with SetMaxVariants.
+const DefaultMaxVariants = 32
+
+type variant struct {
+	key      string
+	vary     string
+	response Response
+}
+
+// variants is the secondary key index for a single url.  It lists
+// every stored variant, most recently used first, along with the
+// Vary spec of the most recently stored response.
+type variants struct {
+	sync.RWMutex
+	vary    string
+	entries []*variant
+}
+
+// currentVary returns the Vary header of the most recently
+// stored response for the url.
+func (v *variants) currentVary() string {
+	v.RLock()
+	defer v.RUnlock()
+	return v.vary
+}
+
+// load returns the variant stored under key, and marks it as the
+// most recently used.
+func (v *variants) load(key string) (Response, bool) {
+	v.Lock()
+	defer v.Unlock()
+	for i, entry := range v.entries {
+		if entry.key == key {
+			copy(v.entries[1:i+1], v.entries[:i])
+			v.entries[0] = entry
+			return entry.response, true
+		}
+	}
+	return nil, false
+}
+
+// store saves response under key.  If the Vary header has changed
+// since the last response was stored, any variant saved under the
+// old Vary spec can no longer be looked up, so it is dropped.  If
+// there are more than max variants, the least recently used are
+// dropped.
+func (v *variants) store(key, vary string, response Response, max int) {
+	vary = normalizeVary(vary)
+	v.Lock()
+	defer v.Unlock()
+	entries := make([]*variant, 0, len(v.entries)+1)
+	entries = append(entries, &variant{
+		key:      key,
+		vary:     vary,
+		response: response,
+	})
+	for _, entry := range v.entries {
+		if entry.key == key || entry.vary != vary {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if max > 0 && len(entries) > max {
+		entries = entries[:max]
+	}
+	v.vary = vary
+	v.entries = entries
+}
+
+// len returns the number of variants stored.
+func (v *variants) len() int {
+	v.RLock()
+	defer v.RUnlock()
+	return len(v.entries)
+}
+
+// normalizeVary returns the Vary header as a lower-cased, sorted,
+// comma separated list so that two equivalent Vary headers can be
+// compared.
+func normalizeVary(vary string) string {
+	var headers []string
+	for _, header := range strings.Split(vary, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" {
+			headers = append(headers, header)
+		}
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ",")
+}
+
+// joinHash builds a hash from its primary key and the key of
+// a variant.
+func joinHash(primary, key string) string {
+	if key == "" {
+		return primary
+	}
+	return primary + variantSeparator + key
+}
+
+// splitHash splits a hash into its primary key and the key of
+// a variant.
+func splitHash(hash string) (primary, key string) {
+	if i := strings.Index(hash, variantSeparator); i >= 0 {
+		return hash[:i], hash[i+len(variantSeparator):]
+	}
+	return hash, ""
+}
+
+// joinVariant builds the secondary part of a hash from the request
+// placeholders of a KeyTemplate and the values of the headers in Vary.
+func joinVariant(attributes, vary string) string {
+	if attributes == "" && vary == "" {
+		return ""
+	}
+	return attributes + attributeSeparator + vary
+}
+
+// splitVariant splits the secondary part of a hash into the request
+// placeholders of a KeyTemplate and the values of the headers in Vary.
+func splitVariant(key string) (attributes, vary string) {
+	if i := strings.Index(key, attributeSeparator); i >= 0 {
+		return key[:i], key[i+len(attributeSeparator):]
+	}
+	return "", key
+}
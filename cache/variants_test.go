@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newVariantResponse(cacher *defaultCacher, vary, language, body string) (*http.Request, Response) {
+	request := validRequest()
+	request.Header.Set("Accept-Language", language)
+	response := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    request,
+	}
+	response.Header.Set("Vary", vary)
+	return request, cacher.Standardize(&response)
+}
+
+func TestVariantsAreStoredSideBySide(t *testing.T) {
+	cache := NewDefaultCacher()
+	en, enResponse := newVariantResponse(cache, "Accept-Language", "en", "hello")
+	ru, ruResponse := newVariantResponse(cache, "Accept-Language", "ru", "privet")
+	cache.Cache(cache.Hash(en), enResponse)
+	cache.Cache(cache.Hash(ru), ruResponse)
+
+	stored, ok := cache.Load(cache.Hash(en), en)
+	assert.True(t, ok, "The first variant should still be in the cache")
+	assert.Equal(t, enResponse, stored)
+	stored, ok = cache.Load(cache.Hash(ru), ru)
+	assert.True(t, ok, "The second variant should be in the cache")
+	assert.Equal(t, ruResponse, stored)
+}
+
+func TestVariantsAreDroppedWhenVaryChanges(t *testing.T) {
+	cache := NewDefaultCacher()
+	en, enResponse := newVariantResponse(cache, "Accept-Language", "en", "hello")
+	cache.Cache(cache.Hash(en), enResponse)
+	ru, ruResponse := newVariantResponse(cache, "Accept-Language, Accept-Encoding", "ru", "privet")
+	cache.Cache(cache.Hash(ru), ruResponse)
+
+	primary, _ := splitHash(cache.Hash(ru))
+	v, _ := cache.entries.Load(primary)
+	assert.Equal(t, 1, v.(*variants).len(), "Variants stored under the old Vary should be removed")
+	assert.Equal(t, "accept-encoding,accept-language", v.(*variants).currentVary())
+	_, ok := cache.Load(cache.Hash(en), en)
+	assert.False(t, ok, "A variant stored under the old Vary should not be found")
+	_, ok = cache.Load(cache.Hash(ru), ru)
+	assert.True(t, ok, "A variant stored under the new Vary should be found")
+}
+
+func TestVariantsAreCapped(t *testing.T) {
+	cache := NewDefaultCacher()
+	cache.SetMaxVariants(2)
+	en, enResponse := newVariantResponse(cache, "Accept-Language", "en", "hello")
+	ru, ruResponse := newVariantResponse(cache, "Accept-Language", "ru", "privet")
+	fr, frResponse := newVariantResponse(cache, "Accept-Language", "fr", "bonjour")
+	cache.Cache(cache.Hash(en), enResponse)
+	cache.Cache(cache.Hash(ru), ruResponse)
+	// Using the first variant makes the second the least recently used
+	cache.Load(cache.Hash(en), en)
+	cache.Cache(cache.Hash(fr), frResponse)
+
+	_, ok := cache.Load(cache.Hash(en), en)
+	assert.True(t, ok, "A recently used variant should be kept")
+	_, ok = cache.Load(cache.Hash(fr), fr)
+	assert.True(t, ok, "The newest variant should be kept")
+	_, ok = cache.Load(cache.Hash(ru), ru)
+	assert.False(t, ok, "The least recently used variant should be removed")
+}
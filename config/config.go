@@ -0,0 +1,840 @@
+// Package config reads the TOML configuration files honey is
+// set up with, like wordpress.toml.
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/davidjwilkins/honey/balancer"
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/fetch"
+	"github.com/davidjwilkins/honey/transform"
+	toml "github.com/pelletier/go-toml"
+)
+
+// Config is a honey configuration file.
+type Config struct {
+	Default  Default  `toml:"default"`
+	Backends Backends `toml:"backends"`
+}
+
+// Default is the [default] section, with the settings for every host.
+type Default struct {
+	// MustRevalidate decides which clients may make honey go to the
+	// backend with Cache-Control or Pragma directives like no-cache.
+	// If it is missing, every client may.
+	MustRevalidate *Bypass `toml:"must-revalidate"`
+	// MaxWait is how long a request multiplexed onto another for
+	// the same url waits for it, before it does WaitTimeout - fetch,
+	// stale or error, see fetch.CoalesceFallback.  LeaderTimeout
+	// cancels the request the others wait for after that long, if
+	// it isn't 0s.
+	MaxWait       string `toml:"maxWait"`
+	WaitTimeout   string `toml:"waitTimeout"`
+	LeaderTimeout string `toml:"leaderTimeout"`
+}
+
+// Bypass is the [default.must-revalidate] section.  If Default is
+// false, only the clients which match one of Allow may bypass the cache.
+type Bypass struct {
+	Default bool          `toml:"default"`
+	Allow   []BypassAllow `toml:"allow"`
+}
+
+// BypassAllow is a [[default.must-revalidate.allow]] section, which
+// allows clients from any of IPs - addresses or CIDR ranges - or which
+// send Header with the secret Value, to bypass the cache.
+type BypassAllow struct {
+	IPs    []string `toml:"ips"`
+	Header string   `toml:"header"`
+	Value  string   `toml:"value"`
+}
+
+// Backends is the [backends] section, which sets which backend
+// each Host is sent to.  URI is the default backend, which any
+// host without its own is sent to, unless UnknownHosts is "reject".
+type Backends struct {
+	URI          string             `toml:"uri"`
+	UnknownHosts string             `toml:"unknownHosts"`
+	Hosts        map[string]Backend `toml:"hosts"`
+}
+
+// Backend is a [backends.hosts."www.example.com"] section, which
+// sets the backend and cache for a host, or for every subdomain
+// of a domain if it starts with *.
+type Backend struct {
+	URI string `toml:"uri"`
+	// Namespace is prefixed to the hash of every request for the
+	// host.  It defaults to the host.
+	Namespace      string   `toml:"namespace"`
+	AllowedCookies []string `toml:"allowedCookies"`
+	// Skip is a list of regular expressions for paths which
+	// will never be cached.
+	Skip []string `toml:"skip"`
+	// Immutable is a list of regular expressions for paths whose
+	// responses never change, so are never revalidated.  If
+	// Fingerprinted is true, asset names with a hash in them, like
+	// app.3f9a2c1d.js, are immutable too.
+	Immutable     []string `toml:"immutable"`
+	Fingerprinted bool     `toml:"fingerprinted"`
+	// Origins are the servers requests are actually sent to, with
+	// URI's host as the Host header.  If empty, they are sent to URI.
+	Origins []string `toml:"origins"`
+	// Balance is round-robin, least-connections or consistent-hash
+	Balance string `toml:"balance"`
+	// HealthCheck is a path requested from each origin every
+	// HealthInterval.  Origins which don't respond to it with a
+	// 2xx or 3xx within HealthTimeout aren't sent requests.
+	HealthCheck    string `toml:"healthCheck"`
+	HealthInterval string `toml:"healthInterval"`
+	HealthTimeout  string `toml:"healthTimeout"`
+	// MaxFails is how many requests in a row an origin can fail
+	// before it isn't sent requests for FailTimeout.  If it is 0,
+	// the default of 3 is used, and if it is negative, origins
+	// are never ejected.
+	MaxFails    int         `toml:"maxFails"`
+	FailTimeout string      `toml:"failTimeout"`
+	Breaker     Breaker     `toml:"breaker"`
+	Static      Static      `toml:"static"`
+	Compression Compression `toml:"compression"`
+	// Stale decides how stale-if-error and stale-while-revalidate are
+	// treated, unless a request matches one of StaleRoutes.
+	Stale       Stale   `toml:"stale"`
+	StaleRoutes []Stale `toml:"staleRoute"`
+	// RevalidateWorkers is how many stale responses can be refreshed
+	// in the background at once, and RevalidateQueue how many more
+	// can wait to be.
+	RevalidateWorkers int    `toml:"revalidateWorkers"`
+	RevalidateQueue   int    `toml:"revalidateQueue"`
+	RevalidateTimeout string `toml:"revalidateTimeout"`
+	// Minify lists what is minified before it is cached - html, css
+	// and js - unless a request matches one of MinifyRoutes.
+	Minify       []string      `toml:"minify"`
+	MinifyRoutes []MinifyRoute `toml:"minifyRoute"`
+	MixedContent MixedContent  `toml:"mixedContent"`
+	Cookieless   Cookieless    `toml:"cookieless"`
+	GoogleFonts  GoogleFonts   `toml:"googleFonts"`
+	Libraries    Libraries     `toml:"libraries"`
+	// Hints decides how the critical assets of cached pages are sent
+	// before them, unless a request matches one of HintsRoutes.
+	Hints       Hints   `toml:"hints"`
+	HintsRoutes []Hints `toml:"hintsRoute"`
+	// Hotlink stops other sites embedding the host's images and media.
+	// Rules are checked in order.
+	Hotlink []Hotlink `toml:"hotlink"`
+	// Key decides how the url of a request is turned into its cache
+	// key, unless it matches one of KeyRoutes.
+	Key       Key   `toml:"key"`
+	KeyRoutes []Key `toml:"keyRoute"`
+}
+
+// Key is a [backends.hosts."www.example.com".key] section, or a
+// keyRoute for the paths matching Match.  By default the key has the
+// scheme, host and path, and the query sorted and without the utm_*,
+// fbclid and gclid parameters - IgnoreQuery replaces those.  Template,
+// if set, is a cache.KeyTemplate, which a keyRoute uses with the rules
+// of the host rather than its own.  See cache.KeyRules.
+type Key struct {
+	Match             string   `toml:"match"`
+	Template          string   `toml:"template"`
+	IgnoreScheme      bool     `toml:"ignoreScheme"`
+	IgnoreHost        bool     `toml:"ignoreHost"`
+	KeepQueryOrder    bool     `toml:"keepQueryOrder"`
+	IgnoreQuery       []string `toml:"ignoreQuery"`
+	AllowQuery        []string `toml:"allowQuery"`
+	KeepFragment      bool     `toml:"keepFragment"`
+	KeepEncoding      bool     `toml:"keepEncoding"`
+	TrimTrailingSlash bool     `toml:"trimTrailingSlash"`
+}
+
+// Hotlink is a [[backends.hosts."www.example.com".hotlink]] section,
+// which only lets the host, and the Allow domains, embed the files
+// matching Match - images and media, if it is empty.  Other sites get
+// the image at the path Replacement, if it is set, or a 403 Forbidden.
+// See fetch.HotlinkRule.
+type Hotlink struct {
+	Match       string   `toml:"match"`
+	Allow       []string `toml:"allow"`
+	AllowEmpty  bool     `toml:"allowEmpty"`
+	Replacement string   `toml:"replacement"`
+}
+
+// Hints is a [backends.hosts."www.example.com".hints] section, or a
+// hintsRoute for the paths matching Match.  See fetch.HintOptions.
+type Hints struct {
+	Match      string `toml:"match"`
+	EarlyHints bool   `toml:"earlyHints"`
+	Push       bool   `toml:"push"`
+	MaxAssets  int    `toml:"maxAssets"`
+}
+
+// Libraries is a [backends.hosts."www.example.com".libraries] section,
+// which replaces the host's copies of popular javascript libraries with
+// hosted ones - on the paths matching Routes, if there are any, other
+// than those matching Skip.  Libraries are added to the ones honey comes
+// with.  See transform.CanonicalizeLibraries.
+type Libraries struct {
+	Canonicalize bool      `toml:"canonicalize"`
+	Routes       []string  `toml:"routes"`
+	Skip         []string  `toml:"skip"`
+	Libraries    []Library `toml:"library"`
+}
+
+// Library is a [[backends.hosts."www.example.com".libraries.library]]
+// section.  Hash is the sha256 subresource integrity of its content,
+// like sha256-ZosEbRLbNQzLpnKIkEdrPv7lOy9C27hHQ+Xp8a4MxAQ=, and URL is
+// where it is hosted.
+type Library struct {
+	Hash    string `toml:"hash"`
+	Name    string `toml:"name"`
+	Version string `toml:"version"`
+	URL     string `toml:"url"`
+}
+
+// GoogleFonts is a [backends.hosts."www.example.com".googleFonts]
+// section, which combines the Google Fonts stylesheet links in html
+// into one - on the paths matching Routes, if there are any, other
+// than those matching Skip.  See transform.CombineGoogleFonts.
+type GoogleFonts struct {
+	Combine bool     `toml:"combine"`
+	Routes  []string `toml:"routes"`
+	Skip    []string `toml:"skip"`
+}
+
+// Cookieless is a [backends.hosts."www.example.com".cookieless] section.
+// If Host is set, the urls of static files in html are rewritten to it,
+// and it serves them from the same backend, without cookies, cached for
+// MaxAge - a duration, which defaults to a year.
+type Cookieless struct {
+	Host   string `toml:"host"`
+	MaxAge string `toml:"maxAge"`
+}
+
+// MixedContent is a [backends.hosts."www.example.com".mixedContent]
+// section, which rewrites http references to the host, and to Hosts,
+// to https - on the paths matching Routes, if there are any, other
+// than those matching Skip.  See transform.MixedContentOptions.
+type MixedContent struct {
+	Enabled                 bool     `toml:"enabled"`
+	Hosts                   []string `toml:"hosts"`
+	ProtocolRelative        bool     `toml:"protocolRelative"`
+	UpgradeInsecureRequests bool     `toml:"upgradeInsecureRequests"`
+	Routes                  []string `toml:"routes"`
+	Skip                    []string `toml:"skip"`
+}
+
+// MinifyRoute is a minifyRoute, which sets what is minified for the
+// paths matching Match.
+type MinifyRoute struct {
+	Match  string   `toml:"match"`
+	Minify []string `toml:"minify"`
+}
+
+// Stale is a [backends.hosts."www.example.com".stale] section, or a
+// staleRoute for the paths matching Match.  IfError and WhileRevalidate
+// are respect, force, cap or ignore - see fetch.StaleMode - and the
+// windows are durations, or * for forever.
+type Stale struct {
+	Match                 string `toml:"match"`
+	IfError               string `toml:"ifError"`
+	IfErrorWindow         string `toml:"ifErrorWindow"`
+	WhileRevalidate       string `toml:"whileRevalidate"`
+	WhileRevalidateWindow string `toml:"whileRevalidateWindow"`
+}
+
+// Static is a [backends.hosts."www.example.com".static] section, which
+// decides which responses are static files, and how long they are
+// cached for.  MaxAge is a duration, and 0s stops static files being
+// cached.  Extensions default to those of utilities.IsStaticFile.
+// See cache.StaticPolicy.
+type Static struct {
+	MaxAge       string   `toml:"maxAge"`
+	Extensions   []string `toml:"extensions"`
+	ContentTypes []string `toml:"contentTypes"`
+}
+
+// Compression is a [backends.hosts."www.example.com".compression]
+// section, which decides which responses are stored compressed with
+// brotli and gzip.  A level of 0 uses the default, and a negative one
+// turns that encoding off.  See cache.CompressionOptions.
+type Compression struct {
+	Brotli       int      `toml:"brotli"`
+	Gzip         int      `toml:"gzip"`
+	ContentTypes []string `toml:"contentTypes"`
+	MinSize      int      `toml:"minSize"`
+}
+
+// Breaker is a [backends.hosts."www.example.com".breaker] section,
+// which sets up a circuit breaker for the host's backend.  It is only
+// used if ErrorRate is set.  See fetch.BreakerOptions.
+type Breaker struct {
+	ErrorRate   float64 `toml:"errorRate"`
+	MinRequests int     `toml:"minRequests"`
+	Window      string  `toml:"window"`
+	SlowRequest string  `toml:"slowRequest"`
+	OpenFor     string  `toml:"openFor"`
+	Probes      int     `toml:"probes"`
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses a configuration file.
+func Parse(data []byte) (*Config, error) {
+	var config Config
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	switch config.Backends.UnknownHosts {
+	case "", "default", "reject":
+	default:
+		return nil, fmt.Errorf("backends: unknownHosts must be default or reject, not %q", config.Backends.UnknownHosts)
+	}
+	return &config, nil
+}
+
+// Sites returns a fetch.Sites with a fetch.Proxy for each host in
+// the [backends] section, set up with the [default] section.  Close
+// it once it isn't served, to stop its background revalidations and
+// health checks.
+func (c *Config) Sites() (*fetch.Sites, error) {
+	var access *fetch.BypassAccess
+	if bypass := c.Default.MustRevalidate; bypass != nil {
+		access = fetch.NewBypassAccess(bypass.Default)
+		for _, allow := range bypass.Allow {
+			for _, ip := range allow.IPs {
+				if err := access.AllowIP(ip); err != nil {
+					return nil, fmt.Errorf("default.must-revalidate: %v", err)
+				}
+			}
+			if allow.Header != "" {
+				access.AllowHeader(allow.Header, allow.Value)
+			}
+		}
+	}
+	opts, err := c.Default.options()
+	if err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	return c.Backends.sites(access, opts)
+}
+
+// Sites returns a fetch.Sites with a fetch.Proxy for each host,
+// each with its own cache.  Close it once it isn't served.
+func (b Backends) Sites() (*fetch.Sites, error) {
+	return b.sites(nil, fetch.DefaultOptions())
+}
+
+func (d Default) options() (fetch.Options, error) {
+	opts := fetch.DefaultOptions()
+	var err error
+	if opts.MaxCoalesceWait, err = duration(d.MaxWait, opts.MaxCoalesceWait); err != nil {
+		return opts, err
+	}
+	if opts.CoalesceFallback, err = fetch.ParseCoalesceFallback(d.WaitTimeout); err != nil {
+		return opts, err
+	}
+	if opts.LeaderTimeout, err = duration(d.LeaderTimeout, opts.LeaderTimeout); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (b Backends) sites(access *fetch.BypassAccess, opts fetch.Options) (*fetch.Sites, error) {
+	sites := fetch.NewSites()
+	// Stops the health checks of every backend's origins
+	ctx, cancel := context.WithCancel(context.Background())
+	sites.OnClose(cancel)
+	if err := b.addSites(ctx, sites, access, opts); err != nil {
+		sites.Close()
+		return nil, err
+	}
+	return sites, nil
+}
+
+func (b Backends) addSites(ctx context.Context, sites *fetch.Sites, access *fetch.BypassAccess, opts fetch.Options) error {
+	for host, backend := range b.Hosts {
+		if backend.Namespace == "" {
+			backend.Namespace = host
+		}
+		proxy, err := backend.proxy(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("backends.hosts.%q: %v", host, err)
+		}
+		sites.OnClose(proxy.Close)
+		proxy.SetBypassAccess(access)
+		sites.Add(host, proxy)
+		if backend.Cookieless.Host != "" {
+			// It is the same backend, so it is sent requests the same way,
+			// and shares the breaker which decides if it is failing
+			assets, err := backend.cookieless(host).proxy(ctx, proxy.Options())
+			if err != nil {
+				return fmt.Errorf("backends.hosts.%q.cookieless: %v", host, err)
+			}
+			assets.SetBreaker(proxy.Breaker())
+			sites.OnClose(assets.Close)
+			assets.SetBypassAccess(access)
+			static, err := backend.Static.policy()
+			if err != nil {
+				return fmt.Errorf("backends.hosts.%q.static: %v", host, err)
+			}
+			sites.Add(backend.Cookieless.Host, fetch.Cookieless(assets, fetch.CookielessOptions{Static: static, Sites: []string{host}}))
+		}
+	}
+	if b.URI != "" && b.UnknownHosts != "reject" {
+		proxy, err := Backend{URI: b.URI}.proxy(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("backends: %v", err)
+		}
+		sites.OnClose(proxy.Close)
+		proxy.SetBypassAccess(access)
+		sites.SetDefault(proxy)
+	}
+	return nil
+}
+
+// proxy returns the fetch.Proxy for the backend, whose origins are
+// health checked until ctx is done.
+func (b Backend) proxy(ctx context.Context, opts fetch.Options) (*fetch.Proxy, error) {
+	backend, err := url.Parse(b.URI)
+	if err != nil {
+		return nil, err
+	}
+	if backend.Scheme == "" || backend.Host == "" {
+		return nil, fmt.Errorf("uri %q must be absolute", b.URI)
+	}
+	cacher := cache.NewDefaultCacher()
+	cacher.SetNamespace(b.Namespace)
+	for _, name := range b.AllowedCookies {
+		cacher.AddAllowedCookie(name)
+	}
+	for _, skip := range b.Skip {
+		regex, err := regexp.Compile(skip)
+		if err != nil {
+			return nil, err
+		}
+		cacher.AddSkipRegex(regex)
+	}
+	static, err := b.Static.policy()
+	if err != nil {
+		return nil, err
+	}
+	cacher.SetStaticPolicy(static)
+	cacher.SetCompression(b.Compression.options())
+	for _, immutable := range b.Immutable {
+		regex, err := regexp.Compile(immutable)
+		if err != nil {
+			return nil, err
+		}
+		cacher.AddImmutable(regex)
+	}
+	if b.Fingerprinted {
+		cacher.AddImmutable(cache.FingerprintRegexp)
+	}
+	// The host's rules are set first, since templates are added with them
+	cacher.SetKeyRules(b.Key.rules())
+	if b.Key.Template != "" {
+		template, err := cache.ParseKeyTemplate(b.Key.Template)
+		if err != nil {
+			return nil, err
+		}
+		cacher.SetKeyTemplate(template)
+	}
+	for _, route := range b.KeyRoutes {
+		match, err := regexp.Compile(route.Match)
+		if err != nil {
+			return nil, err
+		}
+		if route.Template == "" {
+			cacher.AddKeyRoute(match, route.rules())
+			continue
+		}
+		template, err := cache.ParseKeyTemplate(route.Template)
+		if err != nil {
+			return nil, err
+		}
+		cacher.AddKeyTemplate(match, template)
+	}
+	if len(b.Origins) > 0 {
+		lb, err := b.balancer(ctx, backend)
+		if err != nil {
+			return nil, err
+		}
+		opts.Transport = lb.RoundTripper(http.DefaultTransport, cacher.Hash)
+	}
+	if opts.Stale, err = b.Stale.policies(); err != nil {
+		return nil, err
+	}
+	if b.RevalidateWorkers > 0 {
+		opts.Revalidate.Workers = b.RevalidateWorkers
+	}
+	if b.RevalidateQueue > 0 {
+		opts.Revalidate.Queue = b.RevalidateQueue
+	}
+	if opts.Revalidate.Timeout, err = duration(b.RevalidateTimeout, opts.Revalidate.Timeout); err != nil {
+		return nil, err
+	}
+	if opts.Minify, err = minifyOptions(b.Minify); err != nil {
+		return nil, err
+	}
+	opts.Hints = b.Hints.options()
+	proxy := fetch.NewProxy(cacher, backend, opts)
+	for _, route := range b.StaleRoutes {
+		match, err := regexp.Compile(route.Match)
+		if err != nil {
+			return nil, err
+		}
+		policies, err := route.policies()
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddStaleRoute(match, policies)
+	}
+	for _, route := range b.MinifyRoutes {
+		match, err := regexp.Compile(route.Match)
+		if err != nil {
+			return nil, err
+		}
+		opts, err := minifyOptions(route.Minify)
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddMinifyRoute(match, opts)
+	}
+	if b.GoogleFonts.Combine {
+		stage := transform.GoogleFontsStage()
+		if err := routes(&stage, b.GoogleFonts.Routes, b.GoogleFonts.Skip); err != nil {
+			return nil, err
+		}
+		proxy.AddTransform(stage)
+	}
+	if b.Libraries.Canonicalize {
+		manifest, err := b.Libraries.manifest()
+		if err != nil {
+			return nil, err
+		}
+		stage := proxy.LibrariesStage(manifest)
+		if err := routes(&stage, b.Libraries.Routes, b.Libraries.Skip); err != nil {
+			return nil, err
+		}
+		proxy.AddTransform(stage)
+	}
+	if b.Cookieless.Host != "" {
+		proxy.AddTransform(transform.CookielessStage(b.Cookieless.Host, static))
+	}
+	for _, hotlink := range b.Hotlink {
+		rule, err := hotlink.rule()
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddHotlinkRule(rule)
+	}
+	for _, route := range b.HintsRoutes {
+		match, err := regexp.Compile(route.Match)
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddHintsRoute(match, route.options())
+	}
+	if b.MixedContent.Enabled {
+		stage, err := b.MixedContent.stage()
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddTransform(stage)
+	}
+	if b.Breaker.ErrorRate > 0 {
+		breaker, err := b.Breaker.breaker()
+		if err != nil {
+			return nil, err
+		}
+		proxy.SetBreaker(breaker)
+	}
+	return proxy, nil
+}
+
+func (k Key) rules() cache.KeyRules {
+	rules := cache.DefaultKeyRules()
+	rules.IncludeScheme = !k.IgnoreScheme
+	rules.IncludeHost = !k.IgnoreHost
+	rules.SortQuery = !k.KeepQueryOrder
+	if len(k.IgnoreQuery) > 0 {
+		rules.IgnoreQuery = k.IgnoreQuery
+	}
+	rules.AllowQuery = k.AllowQuery
+	rules.IgnoreFragment = !k.KeepFragment
+	rules.NormalizeEncoding = !k.KeepEncoding
+	rules.TrimTrailingSlash = k.TrimTrailingSlash
+	return rules
+}
+
+func (b Breaker) breaker() (*fetch.Breaker, error) {
+	opts := fetch.DefaultBreakerOptions()
+	opts.ErrorRate = b.ErrorRate
+	if b.MinRequests > 0 {
+		opts.MinRequests = b.MinRequests
+	}
+	if b.Probes > 0 {
+		opts.Probes = b.Probes
+	}
+	var err error
+	if opts.Window, err = duration(b.Window, opts.Window); err != nil {
+		return nil, err
+	}
+	if opts.SlowRequest, err = duration(b.SlowRequest, opts.SlowRequest); err != nil {
+		return nil, err
+	}
+	if opts.OpenFor, err = duration(b.OpenFor, opts.OpenFor); err != nil {
+		return nil, err
+	}
+	return fetch.NewBreaker(opts), nil
+}
+
+func (b Backend) balancer(ctx context.Context, backend *url.URL) (*balancer.Balancer, error) {
+	strategy, err := balancer.ParseStrategy(b.Balance)
+	if err != nil {
+		return nil, err
+	}
+	origins := make([]*url.URL, len(b.Origins))
+	for i, origin := range b.Origins {
+		if origins[i], err = url.Parse(origin); err != nil {
+			return nil, err
+		}
+		if origins[i].Scheme == "" || origins[i].Host == "" {
+			return nil, fmt.Errorf("origin %q must be absolute", origin)
+		}
+	}
+	lb := balancer.New(strategy, origins...)
+	failTimeout, err := duration(b.FailTimeout, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b.MaxFails > 0:
+		lb.SetPassiveEjection(b.MaxFails, failTimeout)
+	case b.MaxFails < 0:
+		lb.SetPassiveEjection(0, failTimeout)
+	default:
+		lb.SetPassiveEjection(3, failTimeout)
+	}
+	if b.HealthCheck != "" {
+		interval, err := duration(b.HealthInterval, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := duration(b.HealthTimeout, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		lb.StartHealthChecks(ctx, balancer.HealthCheck{
+			Path:     b.HealthCheck,
+			Host:     backend.Host,
+			Interval: interval,
+			Timeout:  timeout,
+		})
+	}
+	return lb, nil
+}
+
+func (s Static) policy() (cache.StaticPolicy, error) {
+	policy := cache.DefaultStaticPolicy()
+	var err error
+	if policy.MaxAge, err = duration(s.MaxAge, policy.MaxAge); err != nil {
+		return policy, err
+	}
+	if len(s.Extensions) > 0 {
+		policy.Extensions = s.Extensions
+	}
+	policy.ContentTypes = s.ContentTypes
+	return policy, nil
+}
+
+func minifyOptions(names []string) (fetch.MinifyOptions, error) {
+	var opts fetch.MinifyOptions
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "html":
+			opts.HTML = true
+		case "css":
+			opts.CSS = true
+		case "js", "javascript":
+			opts.JavaScript = true
+		default:
+			return opts, fmt.Errorf("cannot minify %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// cookieless returns the Backend for the cookieless host of b, the
+// Backend for host, which caches static files from the same backend
+// for everyone.  host may embed them, whatever its hotlink rules say.
+// It has no origins or breaker of its own - the proxy for it is given
+// those of host's - and none of the settings for html pages, which
+// static files never are.
+func (b Backend) cookieless(host string) Backend {
+	assets := b
+	assets.Hotlink = make([]Hotlink, len(b.Hotlink))
+	for i, hotlink := range b.Hotlink {
+		hotlink.Allow = append(append([]string(nil), hotlink.Allow...), host)
+		assets.Hotlink[i] = hotlink
+	}
+	assets.Namespace = b.Cookieless.Host
+	assets.AllowedCookies = nil
+	assets.Static.MaxAge = b.Cookieless.MaxAge
+	if assets.Static.MaxAge == "" {
+		assets.Static.MaxAge = cookielessMaxAge
+	}
+	assets.Cookieless = Cookieless{}
+	assets.Origins, assets.Balance, assets.HealthCheck = nil, "", ""
+	assets.Breaker = Breaker{}
+	assets.MixedContent = MixedContent{}
+	assets.GoogleFonts = GoogleFonts{}
+	assets.Libraries = Libraries{}
+	assets.Hints, assets.HintsRoutes = Hints{}, nil
+	return assets
+}
+
+// cookielessMaxAge is how long static files on a cookieless host are
+// cached for by default.
+const cookielessMaxAge = "8760h"
+
+func (m MixedContent) stage() (transform.Stage, error) {
+	stage := transform.MixedContentStage(transform.MixedContentOptions{
+		Hosts:                   m.Hosts,
+		ProtocolRelative:        m.ProtocolRelative,
+		UpgradeInsecureRequests: m.UpgradeInsecureRequests,
+	})
+	return stage, routes(&stage, m.Routes, m.Skip)
+}
+
+func (l Libraries) manifest() (transform.LibraryManifest, error) {
+	manifest := transform.DefaultLibraryManifest()
+	for _, library := range l.Libraries {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(library.Hash, "sha256-"))
+		if !strings.HasPrefix(library.Hash, "sha256-") || err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("library hash %q must be a sha256 subresource integrity", library.Hash)
+		}
+		if library.URL == "" {
+			return nil, fmt.Errorf("library %q must have a url", library.Hash)
+		}
+		manifest[library.Hash] = transform.Library{Name: library.Name, Version: library.Version, URL: library.URL}
+	}
+	return manifest, nil
+}
+
+// routes compiles the Routes and Skip of stage.
+func routes(stage *transform.Stage, routes, skip []string) error {
+	var err error
+	if stage.Routes, err = regexps(routes); err != nil {
+		return err
+	}
+	stage.Skip, err = regexps(skip)
+	return err
+}
+
+// regexps compiles each of patterns.
+func regexps(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, regex)
+	}
+	return compiled, nil
+}
+
+func (h Hotlink) rule() (fetch.HotlinkRule, error) {
+	rule := fetch.HotlinkRule{Allow: h.Allow, AllowEmpty: h.AllowEmpty}
+	if h.Match != "" {
+		match, err := regexp.Compile(h.Match)
+		if err != nil {
+			return rule, err
+		}
+		rule.Match = match
+	}
+	if h.Replacement != "" {
+		replacement, err := ioutil.ReadFile(h.Replacement)
+		if err != nil {
+			return rule, err
+		}
+		rule.Replacement = replacement
+		rule.ReplacementType = mime.TypeByExtension(filepath.Ext(h.Replacement))
+		if rule.ReplacementType == "" {
+			rule.ReplacementType = http.DetectContentType(replacement)
+		}
+	}
+	return rule, nil
+}
+
+func (h Hints) options() fetch.HintOptions {
+	return fetch.HintOptions{EarlyHints: h.EarlyHints, Push: h.Push, MaxAssets: h.MaxAssets}
+}
+
+func (c Compression) options() cache.CompressionOptions {
+	opts := cache.DefaultCompressionOptions()
+	if c.Brotli != 0 {
+		opts.BrotliLevel = c.Brotli
+	}
+	if c.Gzip != 0 {
+		opts.GzipLevel = c.Gzip
+	}
+	if len(c.ContentTypes) > 0 {
+		opts.ContentTypes = c.ContentTypes
+	}
+	if c.MinSize > 0 {
+		opts.MinSize = c.MinSize
+	}
+	return opts
+}
+
+func (s Stale) policies() (fetch.StalePolicies, error) {
+	var policies fetch.StalePolicies
+	var err error
+	if policies.IfError, err = stalePolicy(s.IfError, s.IfErrorWindow); err != nil {
+		return policies, err
+	}
+	policies.WhileRevalidate, err = stalePolicy(s.WhileRevalidate, s.WhileRevalidateWindow)
+	return policies, err
+}
+
+func stalePolicy(mode, window string) (fetch.StalePolicy, error) {
+	var policy fetch.StalePolicy
+	var err error
+	if policy.Mode, err = fetch.ParseStaleMode(mode); err != nil {
+		return policy, err
+	}
+	if window == "*" {
+		policy.Window = fetch.StaleForever
+		return policy, nil
+	}
+	policy.Window, err = duration(window, 0)
+	return policy, err
+}
+
+// duration parses value, or returns fallback if it is empty.
+func duration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
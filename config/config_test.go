@@ -0,0 +1,323 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/fetch"
+	"github.com/davidjwilkins/honey/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadWordpressConfig(t *testing.T) {
+	config, err := Load("wordpress.toml")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://www.insomniac.com", config.Backends.URI)
+	assert.Equal(t, "insomniac", config.Backends.Hosts["www.insomniac.com"].Namespace)
+	assert.Equal(t, []string{"site_lang_id"}, config.Backends.Hosts["www.insomniac.com"].AllowedCookies)
+	assert.Contains(t, config.Backends.Hosts, "*.insomniac.com")
+	assert.Equal(t, []string{"^/wp-includes/"}, config.Backends.Hosts["www.insomniac.com"].Immutable)
+	assert.True(t, config.Backends.Hosts["www.insomniac.com"].Fingerprinted)
+	assert.Equal(t, 0.5, config.Backends.Hosts["www.insomniac.com"].Breaker.ErrorRate)
+	assert.Equal(t, "30s", config.Backends.Hosts["www.insomniac.com"].Breaker.OpenFor)
+	assert.Equal(t, "force", config.Backends.Hosts["www.insomniac.com"].Stale.IfError)
+	assert.Equal(t, "720h", config.Backends.Hosts["www.insomniac.com"].Static.MaxAge)
+	assert.Contains(t, config.Backends.Hosts["www.insomniac.com"].Static.ContentTypes, "image/*")
+	assert.Equal(t, 9, config.Backends.Hosts["www.insomniac.com"].Compression.Brotli)
+	assert.Equal(t, []string{"html", "css", "js"}, config.Backends.Hosts["www.insomniac.com"].Minify)
+	assert.Len(t, config.Backends.Hosts["www.insomniac.com"].MinifyRoutes, 1)
+	assert.True(t, config.Backends.Hosts["www.insomniac.com"].MixedContent.Enabled)
+	assert.True(t, config.Backends.Hosts["www.insomniac.com"].GoogleFonts.Combine)
+	assert.True(t, config.Backends.Hosts["www.insomniac.com"].Libraries.Canonicalize)
+	assert.True(t, config.Backends.Hosts["www.insomniac.com"].Hints.EarlyHints)
+	assert.Len(t, config.Backends.Hosts["www.insomniac.com"].Hotlink, 2)
+	assert.Len(t, config.Backends.Hosts["www.insomniac.com"].HintsRoutes, 1)
+	assert.Empty(t, config.Backends.Hosts["www.insomniac.com"].Libraries.Libraries, "The sample library is commented out")
+	assert.Equal(t, []string{"^/wp-admin"}, config.Backends.Hosts["www.insomniac.com"].MixedContent.Skip)
+	if assert.Len(t, config.Backends.Hosts["www.insomniac.com"].StaleRoutes, 1) {
+		assert.Equal(t, "^/checkout", config.Backends.Hosts["www.insomniac.com"].StaleRoutes[0].Match)
+	}
+	assert.Equal(t, "10s", config.Default.MaxWait)
+	assert.Equal(t, "fetch", config.Default.WaitTimeout)
+	assert.Contains(t, config.Backends.Hosts["www.insomniac.com"].Key.IgnoreQuery, "_ga")
+	assert.Len(t, config.Backends.Hosts["www.insomniac.com"].KeyRoutes, 1)
+	if assert.NotNil(t, config.Default.MustRevalidate) {
+		assert.False(t, config.Default.MustRevalidate.Default)
+		assert.Len(t, config.Default.MustRevalidate.Allow, 2)
+	}
+	sites, err := config.Sites()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sites.Close()
+	_, found := sites.Handler("shop.insomniac.com")
+	assert.True(t, found, "Subdomains should use the wildcard backend")
+	assets, found := sites.Handler("static.insomniac.com")
+	if assert.True(t, found, "The cookieless host should be served") {
+		w := httptest.NewRecorder()
+		assets.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/about", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, "The cookieless host should only serve static files")
+	}
+}
+
+func TestParseRejectsUnknownHosts(t *testing.T) {
+	config, err := Parse([]byte(`
+[backends]
+uri = "https://www.insomniac.com"
+unknownHosts = "reject"
+    [backends.hosts."www.insomniac.com"]
+    uri = "https://www.insomniac.com"
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sites, err := config.Backends.Sites()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sites.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "www.example.com"
+	sites.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte("[backends]\nunknownHosts = \"maybe\"\n"))
+	assert.Error(t, err, "An unknown unknownHosts should be an error")
+	config, err := Parse([]byte("[default.must-revalidate]\n[[default.must-revalidate.allow]]\nips = [\"10.0.0.0/99\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Sites()
+		assert.Error(t, err, "An invalid CIDR range should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"/relative\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "A relative backend uri should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\nskip = [\"(\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid skip regex should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\nimmutable = [\"(\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid immutable regex should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\nminify = [\"php\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "Minifying something unknown should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[backends.hosts.\"www.insomniac.com\".static]\nmaxAge = \"forever\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid static max-age should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[backends.hosts.\"www.insomniac.com\".mixedContent]\nenabled = true\nskip = [\"(\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid mixed content skip regex should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[backends.hosts.\"www.insomniac.com\".googleFonts]\ncombine = true\nroutes = [\"[\"]\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid google fonts route regex should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\norigins = [\"http://10.0.0.1\"]\nbalance = \"random\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An unknown balance strategy should be an error")
+	}
+	config, err = Parse([]byte("[default]\nwaitTimeout = \"never\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Sites()
+		assert.Error(t, err, "An unknown waitTimeout should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[backends.hosts.\"www.insomniac.com\".key]\ntemplate = \"{nope}\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid key template should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[[backends.hosts.\"www.insomniac.com\".keyRoute]]\nmatch = \"(\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An invalid key route regex should be an error")
+	}
+	config, err = Parse([]byte("[backends.hosts.\"www.insomniac.com\"]\nuri = \"https://www.insomniac.com\"\n[backends.hosts.\"www.insomniac.com\".stale]\nifError = \"always\"\n"))
+	if assert.NoError(t, err) {
+		_, err = config.Backends.Sites()
+		assert.Error(t, err, "An unknown stale mode should be an error")
+	}
+}
+
+func TestSitesCloseStopsHealthChecks(t *testing.T) {
+	var checks int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	}))
+	defer origin.Close()
+	sites, err := Backends{Hosts: map[string]Backend{"www.insomniac.com": {
+		URI:            "https://www.insomniac.com",
+		Origins:        []string{origin.URL},
+		HealthCheck:    "/health",
+		HealthInterval: "10ms",
+	}}}.Sites()
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	sites.Close()
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&checks)
+	assert.True(t, stopped > 1, "The origins should be health checked")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&checks), "Closing the sites should stop the health checks")
+}
+
+func TestDefaultOptions(t *testing.T) {
+	opts, err := Default{}.options()
+	if assert.NoError(t, err) {
+		assert.Equal(t, fetch.DefaultOptions(), opts, "An empty section should use the defaults")
+	}
+	opts, err = Default{MaxWait: "2s", WaitTimeout: "stale", LeaderTimeout: "30s"}.options()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2*time.Second, opts.MaxCoalesceWait)
+		assert.Equal(t, fetch.CoalesceStale, opts.CoalesceFallback)
+		assert.Equal(t, 30*time.Second, opts.LeaderTimeout)
+	}
+	_, err = Default{MaxWait: "soon"}.options()
+	assert.Error(t, err)
+}
+
+func TestKeyRules(t *testing.T) {
+	assert.Equal(t, cache.DefaultKeyRules(), Key{}.rules(), "An empty section should use the defaults")
+	rules := Key{IgnoreHost: true, KeepQueryOrder: true, IgnoreQuery: []string{"ref"}, AllowQuery: []string{"p"}, TrimTrailingSlash: true}.rules()
+	assert.True(t, rules.IncludeScheme)
+	assert.False(t, rules.IncludeHost)
+	assert.False(t, rules.SortQuery)
+	assert.Equal(t, []string{"ref"}, rules.IgnoreQuery)
+	assert.Equal(t, []string{"p"}, rules.AllowQuery)
+	assert.True(t, rules.IgnoreFragment)
+	assert.True(t, rules.TrimTrailingSlash)
+}
+
+func TestCompressionOptions(t *testing.T) {
+	opts := Compression{}.options()
+	assert.Equal(t, cache.DefaultCompressionOptions(), opts, "An empty section should use the defaults")
+	opts = Compression{Brotli: -1, Gzip: 6, ContentTypes: []string{"text/html"}}.options()
+	assert.Equal(t, -1, opts.BrotliLevel)
+	assert.Equal(t, 6, opts.GzipLevel)
+	assert.Equal(t, []string{"text/html"}, opts.ContentTypes)
+}
+
+func TestMixedContentStage(t *testing.T) {
+	stage, err := MixedContent{Enabled: true, Routes: []string{"^/blog/"}, Skip: []string{"^/blog/raw"}}.stage()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "mixed-content", stage.Name)
+	assert.Len(t, stage.Routes, 1)
+	assert.Len(t, stage.Skip, 1)
+}
+
+func TestCookielessBackend(t *testing.T) {
+	backend := Backend{
+		Namespace:      "insomniac",
+		AllowedCookies: []string{"site_lang_id"},
+		Cookieless:     Cookieless{Host: "static.insomniac.com"},
+		Hotlink:        []Hotlink{{Allow: []string{"*.google.com"}}},
+		Origins:        []string{"http://10.0.0.1"},
+		HealthCheck:    "/health",
+		Breaker:        Breaker{ErrorRate: 0.5},
+		Minify:         []string{"css", "js"},
+		MixedContent:   MixedContent{Enabled: true},
+		Libraries:      Libraries{Canonicalize: true},
+		Hints:          Hints{EarlyHints: true},
+	}
+	assets := backend.cookieless("www.insomniac.com")
+	assert.Equal(t, []string{"*.google.com", "www.insomniac.com"}, assets.Hotlink[0].Allow, "The site should be able to embed its assets")
+	assert.Equal(t, []string{"*.google.com"}, backend.Hotlink[0].Allow, "The site's own rules shouldn't be changed")
+	assert.Equal(t, "static.insomniac.com", assets.Namespace)
+	assert.Empty(t, assets.AllowedCookies)
+	assert.Equal(t, "8760h", assets.Static.MaxAge)
+	assert.Empty(t, assets.Cookieless.Host, "The cookieless host shouldn't have its own")
+	assert.Empty(t, assets.Origins, "The cookieless host should use the site's transport")
+	assert.Zero(t, assets.Breaker.ErrorRate, "The cookieless host should use the site's breaker")
+	assert.Equal(t, []string{"css", "js"}, assets.Minify)
+	assert.False(t, assets.MixedContent.Enabled, "Static files aren't html")
+	assert.False(t, assets.Libraries.Canonicalize)
+	assert.False(t, assets.Hints.EarlyHints)
+}
+
+func TestCookielessHostSharesHealthChecks(t *testing.T) {
+	var checks int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	}))
+	defer origin.Close()
+	sites, err := Backends{Hosts: map[string]Backend{"www.insomniac.com": {
+		URI:            "https://www.insomniac.com",
+		Origins:        []string{origin.URL},
+		HealthCheck:    "/health",
+		HealthInterval: "1h",
+		Cookieless:     Cookieless{Host: "static.insomniac.com"},
+	}}}.Sites()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sites.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checks), "The origin should only be health checked once")
+}
+
+func TestLibrariesManifest(t *testing.T) {
+	hash := transform.Integrity256([]byte("window.library = {};"))
+	manifest, err := Libraries{Libraries: []Library{{Hash: hash, Name: "library", URL: "https://cdn.example.com/library.js"}}}.manifest()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://cdn.example.com/library.js", manifest[hash].URL)
+		assert.True(t, len(manifest) > 1, "Libraries should be added to the bundled ones")
+	}
+	_, err = Libraries{Libraries: []Library{{Hash: "md5-abc", URL: "https://cdn.example.com/library.js"}}}.manifest()
+	assert.Error(t, err, "Only sha256 hashes should be allowed")
+	_, err = Libraries{Libraries: []Library{{Hash: "sha256-<base64 sha256 of library.js>", URL: "https://cdn.example.com/library.js"}}}.manifest()
+	assert.Error(t, err, "A hash which isn't base64 should be an error")
+	_, err = Libraries{Libraries: []Library{{Hash: "sha256-YWJj", URL: "https://cdn.example.com/library.js"}}}.manifest()
+	assert.Error(t, err, "A hash which isn't 32 bytes should be an error")
+	_, err = Libraries{Libraries: []Library{{Hash: hash}}}.manifest()
+	assert.Error(t, err, "A library should need a url")
+}
+
+func TestHotlinkRule(t *testing.T) {
+	file, err := ioutil.TempFile("", "hotlink-*.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write([]byte("GIF89a"))
+	file.Close()
+	rule, err := Hotlink{Match: "^/press/", AllowEmpty: true, Replacement: file.Name()}.rule()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "^/press/", rule.Match.String())
+		assert.True(t, rule.AllowEmpty)
+		assert.Equal(t, []byte("GIF89a"), rule.Replacement)
+		assert.Equal(t, "image/gif", rule.ReplacementType)
+	}
+	rule, err = Hotlink{}.rule()
+	if assert.NoError(t, err) {
+		assert.Nil(t, rule.Match, "The proxy should use its default match")
+	}
+	_, err = Hotlink{Replacement: file.Name() + ".missing"}.rule()
+	assert.Error(t, err, "A missing replacement should be an error")
+	_, err = Hotlink{Match: "("}.rule()
+	assert.Error(t, err)
+}
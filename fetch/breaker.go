@@ -0,0 +1,180 @@
+package fetch
+
+import (
+	"sync"
+	"time"
+)
+
+// A BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed sends requests to the backend as usual
+	BreakerClosed BreakerState = iota
+	// BreakerOpen sends no requests to fill the cache to the
+	// backend - they are served stale responses instead
+	BreakerOpen
+	// BreakerHalfOpen lets a few requests through to the backend,
+	// to find out whether it has recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerOptions control when a Breaker opens and closes.
+type BreakerOptions struct {
+	// ErrorRate is the fraction of requests in Window which must
+	// fail for the Breaker to open.  A request fails if the backend
+	// can't be reached, responds with a 5xx, or takes longer than
+	// SlowRequest to respond.
+	ErrorRate float64
+	// MinRequests is how many requests must be sent in Window before
+	// the Breaker can open, so one error on a quiet site doesn't.
+	MinRequests int
+	Window      time.Duration
+	// SlowRequest is how long the backend can take to respond before
+	// the request counts as failed.  If it is 0, slow requests don't.
+	SlowRequest time.Duration
+	// OpenFor is how long the Breaker stays open before it lets
+	// Probes requests through to the backend.  If they all succeed
+	// the Breaker closes, and if any fails it opens again.
+	OpenFor time.Duration
+	Probes  int
+}
+
+// DefaultBreakerOptions returns BreakerOptions which open the
+// Breaker if half of at least 10 requests in 10 seconds fail, and
+// send a probe every 30 seconds.
+func DefaultBreakerOptions() BreakerOptions {
+	return BreakerOptions{
+		ErrorRate:   0.5,
+		MinRequests: 10,
+		Window:      10 * time.Second,
+		OpenFor:     30 * time.Second,
+		Probes:      1,
+	}
+}
+
+// A Breaker is a circuit breaker for a backend.  It tracks how many
+// requests to the backend fail, and if too many do, it opens, and the
+// Proxy stops sending requests to fill the cache to the backend, and
+// serves whatever stale responses it has instead.
+type Breaker struct {
+	mu      sync.Mutex
+	options BreakerOptions
+	clock   func() time.Time
+
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// NewBreaker returns a closed Breaker.
+func NewBreaker(opts BreakerOptions) *Breaker {
+	if opts.Probes < 1 {
+		opts.Probes = 1
+	}
+	return &Breaker{options: opts, clock: time.Now}
+}
+
+// SetClock replaces the function the Breaker uses to tell the time.
+func (b *Breaker) SetClock(clock func() time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clock = clock
+}
+
+// State returns the state of the Breaker.  An open Breaker which
+// has been open for OpenFor is reported as half-open.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(b.clock())
+	return b.state
+}
+
+// Allow returns whether a request to fill the cache may be sent to
+// the backend.  In the half-open state, it returns true for Probes
+// requests.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(b.clock())
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= b.options.Probes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Record records the result of a request to the backend, which took
+// latency to respond.  failed should be true if it couldn't be reached
+// or responded with a 5xx.
+func (b *Breaker) Record(failed bool, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock()
+	b.advance(now)
+	if b.options.SlowRequest > 0 && latency > b.options.SlowRequest {
+		failed = true
+	}
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.options.Probes {
+			b.state = BreakerClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) > b.options.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.options.MinRequests &&
+			float64(b.failures) >= b.options.ErrorRate*float64(b.requests) &&
+			b.failures > 0 {
+			b.open(now)
+		}
+	}
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+// advance moves an open Breaker which has been open for OpenFor
+// to half-open.  A half-open Breaker whose probes haven't all been
+// recorded after another OpenFor (e.g. because the clients went
+// away) lets new ones through.
+func (b *Breaker) advance(now time.Time) {
+	if b.state != BreakerClosed && now.Sub(b.openedAt) >= b.options.OpenFor {
+		b.state = BreakerHalfOpen
+		b.openedAt = now
+		b.probes, b.successes = 0, 0
+	}
+}
@@ -0,0 +1,226 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker(now *time.Time) *Breaker {
+	breaker := NewBreaker(BreakerOptions{
+		ErrorRate:   0.5,
+		MinRequests: 4,
+		Window:      time.Minute,
+		SlowRequest: time.Second,
+		OpenFor:     30 * time.Second,
+		Probes:      1,
+	})
+	breaker.SetClock(func() time.Time { return *now })
+	return breaker
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	now := time.Now()
+	breaker := newTestBreaker(&now)
+	breaker.Record(true, 0)
+	breaker.Record(true, 0)
+	breaker.Record(false, 0)
+	assert.Equal(t, BreakerClosed, breaker.State(), "The breaker should not open before MinRequests")
+	breaker.Record(false, 2*time.Second)
+	assert.Equal(t, BreakerOpen, breaker.State(), "Slow requests should count as failures")
+	assert.False(t, breaker.Allow())
+}
+
+func TestBreakerWindowResets(t *testing.T) {
+	now := time.Now()
+	breaker := newTestBreaker(&now)
+	breaker.Record(true, 0)
+	breaker.Record(true, 0)
+	breaker.Record(true, 0)
+	now = now.Add(2 * time.Minute)
+	breaker.Record(true, 0)
+	assert.Equal(t, BreakerClosed, breaker.State(), "Failures from an old window should not count")
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	now := time.Now()
+	breaker := newTestBreaker(&now)
+	for i := 0; i < 4; i++ {
+		breaker.Record(true, 0)
+	}
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	assert.True(t, breaker.Allow(), "A probe should be let through")
+	assert.False(t, breaker.Allow(), "Only Probes requests should be let through")
+	breaker.Record(true, 0)
+	assert.Equal(t, BreakerOpen, breaker.State(), "A failed probe should open the breaker again")
+	now = now.Add(30 * time.Second)
+	assert.True(t, breaker.Allow())
+	breaker.Record(false, 0)
+	assert.Equal(t, BreakerClosed, breaker.State(), "A successful probe should close the breaker")
+	assert.True(t, breaker.Allow())
+}
+
+func TestProxyServesStaleWhileBreakerIsOpen(t *testing.T) {
+	var failing int32
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	now := time.Now()
+	proxy.SetBreaker(NewBreaker(BreakerOptions{ErrorRate: 0.5, MinRequests: 1, Window: time.Minute, OpenFor: time.Minute}))
+	proxy.breaker.SetClock(func() time.Time { return now })
+	assert.Equal(t, "fresh", serve(proxy, "http://www.insomniac.com/page").Body.String())
+	waitForSingleflights(proxy)
+	atomic.StoreInt32(&failing, 1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "STALE", w.Header().Get("X-Honey-Cache"), "The breaker should serve stale content without stale-if-error")
+	assert.Equal(t, "fresh", w.Body.String())
+	assert.Equal(t, BreakerOpen, proxy.breaker.State())
+
+	waitForSingleflights(proxy)
+	sent := atomic.LoadInt32(&requests)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "STALE", w.Header().Get("X-Honey-Cache"))
+	assert.Contains(t, w.Header().Get("Warning"), "110")
+	assert.Equal(t, sent, atomic.LoadInt32(&requests), "An open breaker should not send requests to the backend")
+
+	w = serve(proxy, "http://www.insomniac.com/uncached")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestProxyBreakerOnlyRecordsAllowedRequests(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	cacher := cache.NewDefaultCacher()
+	cacher.AddSkipRegex(regexp.MustCompile("^/cart"))
+	proxy := NewProxy(cacher, backend, DefaultOptions())
+	defer proxy.Close()
+	now := time.Now()
+	proxy.SetBreaker(NewBreaker(BreakerOptions{ErrorRate: 0.5, MinRequests: 1, Window: time.Minute, OpenFor: time.Minute, Probes: 1}))
+	proxy.breaker.SetClock(func() time.Time { return now })
+
+	atomic.StoreInt32(&failing, 1)
+	assert.Equal(t, http.StatusInternalServerError, serve(proxy, "http://www.insomniac.com/cart").Code)
+	assert.Equal(t, BreakerClosed, proxy.breaker.State(), "Requests which aren't cached shouldn't open the breaker")
+	serve(proxy, "http://www.insomniac.com/page")
+	waitForSingleflights(proxy)
+	assert.Equal(t, BreakerOpen, proxy.breaker.State())
+
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&failing, 0)
+	assert.Equal(t, "fresh", serve(proxy, "http://www.insomniac.com/cart").Body.String())
+	assert.Equal(t, BreakerHalfOpen, proxy.breaker.State(), "Requests which aren't cached shouldn't be probes")
+	assert.Equal(t, "fresh", serve(proxy, "http://www.insomniac.com/page").Body.String())
+	waitForSingleflights(proxy)
+	assert.Equal(t, BreakerClosed, proxy.breaker.State(), "The probe should close the breaker")
+}
+
+func TestProxyHalfOpenBreakerOnlyProbesWithBackendRequests(t *testing.T) {
+	var failing int32
+	received, release := make(chan struct{}, 10), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- struct{}{}
+		<-release
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	now := time.Now()
+	proxy.SetBreaker(NewBreaker(BreakerOptions{ErrorRate: 0.5, MinRequests: 1, Window: time.Minute, OpenFor: time.Minute, Probes: 3}))
+	proxy.breaker.SetClock(func() time.Time { return now })
+	atomic.StoreInt32(&failing, 1)
+	serve(proxy, "http://www.insomniac.com/broken")
+	waitForSingleflights(proxy)
+	assert.Equal(t, BreakerOpen, proxy.breaker.State())
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&failing, 0)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	probe := func(i int) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+		r.Header.Set("Cache-Control", "no-cache")
+		proxy.ServeHTTP(w, r)
+		codes[i] = w.Code
+	}
+	wg.Add(1)
+	go probe(0)
+	<-received
+	for i := 1; i < len(codes); i++ {
+		wg.Add(1)
+		go probe(i)
+	}
+	// Give the others time to be multiplexed onto the first
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	waitForSingleflights(proxy)
+	for i, code := range codes {
+		assert.Equal(t, http.StatusOK, code, "Request %d was multiplexed onto the probe, so should get its response", i)
+	}
+	assert.Equal(t, BreakerHalfOpen, proxy.breaker.State(), "Only one probe should have been sent")
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		probe(i)
+		waitForSingleflights(proxy)
+	}
+	assert.Equal(t, BreakerClosed, proxy.breaker.State(), "Three probes should close the breaker")
+}
+
+// waitForSingleflights waits until the proxy has finished writing
+// responses to its in-flight requests, which it does in the background.
+func waitForSingleflights(p *Proxy) {
+	for i := 0; i < 100; i++ {
+		empty := true
+		p.singleflights.Range(func(key, value interface{}) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package fetch
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// BypassAccess decides which clients may make the Proxy go to the
+// backend rather than respond from the cache, by sending Cache-Control
+// no-cache, must-revalidate, proxy-revalidate, max-age or min-fresh,
+// or Pragma: no-cache.  Otherwise, anyone could send every request to
+// the backend.  Clients which aren't allowed to have those directives
+// removed, so they get the cached response, or are multiplexed onto
+// the request for it.
+type BypassAccess struct {
+	allowAll bool
+	networks []*net.IPNet
+	secrets  []bypassSecret
+}
+
+type bypassSecret struct {
+	header string
+	value  []byte
+}
+
+// NewBypassAccess returns a BypassAccess which allows every client
+// to bypass the cache if allowAll is true, and only the ones added
+// with AllowIP or AllowHeader otherwise.
+func NewBypassAccess(allowAll bool) *BypassAccess {
+	return &BypassAccess{allowAll: allowAll}
+}
+
+// AllowIP allows clients whose address is ip, or is in the CIDR
+// range, e.g. 10.0.0.0/8, to bypass the cache.
+func (b *BypassAccess) AllowIP(ip string) error {
+	if !strings.Contains(ip, "/") {
+		if strings.Contains(ip, ":") {
+			ip += "/128"
+		} else {
+			ip += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return err
+	}
+	b.networks = append(b.networks, network)
+	return nil
+}
+
+// AllowHeader allows clients which send header with the secret
+// value to bypass the cache.
+func (b *BypassAccess) AllowHeader(header, value string) {
+	b.secrets = append(b.secrets, bypassSecret{header: header, value: []byte(value)})
+}
+
+// Allowed returns whether the client which sent r may bypass the cache.
+func (b *BypassAccess) Allowed(r *http.Request) bool {
+	if b.allowAll {
+		return true
+	}
+	for _, secret := range b.secrets {
+		value := r.Header.Get(secret.header)
+		// Compared in constant time, so the secret can't be guessed
+		// from how long it takes to be rejected
+		if value != "" && subtle.ConstantTimeCompare([]byte(value), secret.value) == 1 {
+			return true
+		}
+	}
+	if len(b.networks) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSecrets removes the headers with the secrets added with
+// AllowHeader from r, once it has been checked, so that they aren't
+// sent to the backend.
+func (b *BypassAccess) removeSecrets(r *http.Request) {
+	for _, secret := range b.secrets {
+		r.Header.Del(secret.header)
+	}
+}
+
+// bypassDirectives are the request Cache-Control directives which
+// make the Proxy go to the backend.
+var bypassDirectives = []string{"no-cache", "must-revalidate", "proxy-revalidate", "max-age", "min-fresh"}
+
+// removeBypass removes the directives which would make the Proxy go
+// to the backend from r.
+func removeBypass(r *http.Request) {
+	if strings.Contains(r.Header.Get("Pragma"), "no-cache") {
+		r.Header.Del("Pragma")
+	}
+	cc := r.Header.Get("Cache-Control")
+	if cc == "" {
+		return
+	}
+	var kept []string
+	for _, part := range strings.Split(cc, ",") {
+		part = strings.TrimSpace(part)
+		name := strings.ToLower(part)
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		bypass := false
+		for _, directive := range bypassDirectives {
+			if name == directive {
+				bypass = true
+				break
+			}
+		}
+		if !bypass && part != "" {
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		r.Header.Del("Cache-Control")
+		return
+	}
+	r.Header.Set("Cache-Control", strings.Join(kept, ", "))
+}
+
+// SetBypassAccess sets which clients may bypass the cache.  If it is
+// nil, every client may.
+func (p *Proxy) SetBypassAccess(access *BypassAccess) {
+	p.bypass = access
+}
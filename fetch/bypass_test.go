@@ -0,0 +1,128 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func bypassRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("Cache-Control", "no-cache")
+	return r
+}
+
+func TestBypassAccessIPs(t *testing.T) {
+	access := NewBypassAccess(false)
+	assert.NoError(t, access.AllowIP("127.0.0.1"))
+	assert.NoError(t, access.AllowIP("10.0.0.0/8"))
+	assert.NoError(t, access.AllowIP("2001:db8::/32"))
+	assert.Error(t, access.AllowIP("10.0.0.0/99"))
+	assert.True(t, access.Allowed(bypassRequest("127.0.0.1:1234")))
+	assert.True(t, access.Allowed(bypassRequest("10.20.30.40:1234")))
+	assert.True(t, access.Allowed(bypassRequest("[2001:db8::1]:1234")))
+	assert.False(t, access.Allowed(bypassRequest("192.168.0.1:1234")))
+	assert.False(t, access.Allowed(bypassRequest("127.0.0.2:1234")))
+}
+
+func TestBypassAccessHeader(t *testing.T) {
+	access := NewBypassAccess(false)
+	access.AllowHeader("X-Honey-Cache", "s3cret")
+	r := bypassRequest("192.168.0.1:1234")
+	assert.False(t, access.Allowed(r))
+	r.Header.Set("X-Honey-Cache", "s3cre")
+	assert.False(t, access.Allowed(r), "A wrong secret should not be allowed")
+	r.Header.Set("X-Honey-Cache", "s3cret")
+	assert.True(t, access.Allowed(r))
+}
+
+func TestBypassAccessAllowAll(t *testing.T) {
+	assert.True(t, NewBypassAccess(true).Allowed(bypassRequest("192.168.0.1:1234")))
+}
+
+func TestRemoveBypass(t *testing.T) {
+	r := bypassRequest("192.168.0.1:1234")
+	r.Header.Set("Cache-Control", "no-cache, max-age=0, no-transform, Must-Revalidate, max-stale=60")
+	r.Header.Set("Pragma", "no-cache")
+	removeBypass(r)
+	assert.Equal(t, "no-transform, max-stale=60", r.Header.Get("Cache-Control"))
+	assert.Equal(t, "", r.Header.Get("Pragma"))
+	r.Header.Set("Cache-Control", "no-cache")
+	removeBypass(r)
+	_, found := r.Header["Cache-Control"]
+	assert.False(t, found)
+}
+
+func TestProxyRestrictsBypass(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("cached"))
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	access := NewBypassAccess(false)
+	access.AllowIP("127.0.0.1")
+	proxy.SetBypassAccess(access)
+	serve(proxy, "http://www.insomniac.com/page")
+	waitForSingleflights(proxy)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	r.RemoteAddr = "192.168.0.1:1234"
+	r.Header.Set("Cache-Control", "no-cache")
+	r.Header.Set("Pragma", "no-cache")
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "HIT", w.Header().Get("X-Honey-Cache"), "Clients which may not bypass the cache should get the cached response")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("Cache-Control", "no-cache")
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "MISS", w.Header().Get("X-Honey-Cache"), "Clients which may bypass the cache should go to the backend")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestProxyDoesNotSendBypassSecretToBackend(t *testing.T) {
+	var secrets []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		secrets = append(secrets, r.Header.Get("X-Honey-Cache"))
+		mu.Unlock()
+		w.Write([]byte("page"))
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	cacher := cache.NewDefaultCacher()
+	cacher.AddSkipRegex(regexp.MustCompile("^/cart"))
+	proxy := NewProxy(cacher, backend, DefaultOptions())
+	defer proxy.Close()
+	access := NewBypassAccess(false)
+	access.AllowHeader("X-Honey-Cache", "s3cret")
+	proxy.SetBypassAccess(access)
+	for _, path := range []string{"/page", "/cart"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com"+path, nil)
+		r.Header.Set("Cache-Control", "no-cache")
+		r.Header.Set("X-Honey-Cache", "s3cret")
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, "page", w.Body.String())
+	}
+	waitForSingleflights(proxy)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"", ""}, secrets, "The secret should not be sent to the backend")
+}
@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/davidjwilkins/honey/cache"
+)
+
+// CookielessOptions are the options of a Cookieless handler.
+type CookielessOptions struct {
+	// Static decides which files are static - by their extension -
+	// so are served.  It should be the site's, so that the files
+	// transform.RewriteAssets moves to the cookieless host are.
+	Static cache.StaticPolicy
+	// Sites are the hosts of the sites whose files are served, which
+	// may fetch them cross-origin, as fonts and module scripts always
+	// are.  One starting with *. matches any subdomain.
+	Sites []string
+}
+
+// Cookieless returns an http.Handler which serves the static files of
+// a site through handler, from a host the site's cookies aren't sent
+// to, like static.example.com.  Cookies are removed from requests, and
+// Set-Cookie from responses, so that every response can be cached for
+// everyone.  Anything which isn't a static file is a 404 Not Found, so
+// that the site isn't served twice.  Requests from the Sites are sent
+// Access-Control-Allow-Origin.
+func Cookieless(handler http.Handler, opts CookielessOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.Static.IsStaticPath(r.URL.Path) {
+			w.Header().Set("X-Honey-Cache", "NO-CACHE")
+			http.NotFound(w, r)
+			return
+		}
+		r.Header.Del("Cookie")
+		handler.ServeHTTP(&cookielessWriter{ResponseWriter: w, origin: opts.allowedOrigin(r)}, r)
+	})
+}
+
+// allowedOrigin returns the Origin of r, if it is one of the Sites.
+func (opts CookielessOptions) allowedOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	u, err := url.Parse(origin)
+	if origin == "" || err != nil || u.Host == "" {
+		return ""
+	}
+	host := normalizeHost(u.Host)
+	for _, site := range opts.Sites {
+		if matchDomain(host, normalizeHost(site)) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cookielessWriter removes Set-Cookie from the response before it
+// is written, and allows origin to read it, if it is set.
+type cookielessWriter struct {
+	http.ResponseWriter
+	origin      string
+	wroteHeader bool
+}
+
+func (w *cookielessWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Del("Set-Cookie")
+		// Whether it is allowed depends on the Origin
+		w.Header().Add("Vary", "Origin")
+		if w.origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", w.origin)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cookielessWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, if the http.ResponseWriter can.
+func (w *cookielessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,75 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookielessServesStaticFiles(t *testing.T) {
+	var cookie string
+	handler := Cookieless(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie = r.Header.Get("Cookie")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Write([]byte("png"))
+	}), CookielessOptions{Static: cache.DefaultStaticPolicy()})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/wp-content/logo.png", nil)
+	r.Header.Set("Cookie", "session=1")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "png", w.Body.String())
+	assert.Empty(t, cookie, "Cookies should not be sent to the backend")
+	assert.Empty(t, w.Header().Get("Set-Cookie"), "Cookies should not be set")
+}
+
+func TestCookielessRejectsPages(t *testing.T) {
+	called := false
+	handler := Cookieless(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), CookielessOptions{Static: cache.DefaultStaticPolicy()})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/about", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.False(t, called)
+}
+
+func TestCookielessUsesStaticPolicy(t *testing.T) {
+	handler := Cookieless(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file"))
+	}), CookielessOptions{Static: cache.StaticPolicy{Extensions: []string{".webp"}}})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/a.webp", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/logo.png", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "Only the backend's static files should be served")
+}
+
+func TestCookielessAllowsSites(t *testing.T) {
+	handler := Cookieless(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("font"))
+	}), CookielessOptions{Static: cache.DefaultStaticPolicy(), Sites: []string{"www.insomniac.com", "*.insomniac.net"}})
+	for origin, allowed := range map[string]bool{
+		"https://www.insomniac.com": true,
+		"http://shop.insomniac.net": true,
+		"https://www.example.com":   false,
+		"":                          false,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://static.insomniac.com/fonts/a.woff2", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, "Origin", w.Header().Get("Vary"))
+		if allowed {
+			assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"), "The site should be able to use its fonts")
+		} else {
+			assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "Other sites shouldn't be allowed: %q", origin)
+		}
+	}
+}
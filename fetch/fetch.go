@@ -2,68 +2,39 @@ package fetch
 
 import (
 	"net/http"
-	"net/http/httptest"
 	"net/url"
-	"strings"
 
 	"github.com/davidjwilkins/honey/cache"
-	"github.com/vulcand/oxy/forward"
 )
 
 // Fetch will fetch and save responses from the cache, if possible.
 // If not, it will attempt to do a single request from the backend,
-// and multiplex the response to all requesters.
+// and multiplex the response to all requesters.  All handlers
+// returned by Fetch share the same in-flight requests - use
+// NewProxy to create one which doesn't.
 func Fetch(c cache.Cacher, handler http.Handler, backend *url.URL) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		SwitchBackend(r, backend)
-		// CanCache tells us if this *Cache* is able to cache the request.
-		// I.e. There are no *custom* rules preventing it.  Even if it returns
-		// true, the request itself may still not be cacheable.
-		cacheable := c.CanCache(r)
-		if cacheable {
-			// ResponeFromCache will always return the hash, and responded will
-			// tell us if we were able to respond via the cache.  It will return
-			// false if the cache entry does not yet exist, or if the request
-			// is not eligible for cacheing (due to Cache-Control: No-Cache, for
-			// example).
-			hash, responded, revalidate := RespondFromCache(c, w, r)
-			if responded {
-				return
-			} else if revalidate {
-				w = httptest.NewRecorder()
-			} else {
-				// https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.9.4
-				// If we couldn't respond from the cache, and they only want it if
-				// it is cached, then exit with a 504 per the spec.
-				if strings.Contains(r.Header.Get("Cache-Control"), "only-if-cached") {
-					w.WriteHeader(http.StatusGatewayTimeout)
-					return
-				}
-			}
-			// RespondFromSingleflight will return true if there was an in-flight
-			// request with the same hash, and we were able to respond with it's
-			// response.  It will block until the in-flight request has completed.
-			responded = RespondFromSingleflight(hash, c, w, r, Fetch(c, handler, backend))
-			if responded {
-				return
-			}
-		} else {
-			w.Header().Set("X-Honey-Cache", "NO-CACHE")
-		}
-		handler.ServeHTTP(w, r)
-	}
+	return FetchWithOptions(c, handler, backend, DefaultOptions())
+}
+
+// FetchWithOptions is like Fetch, but opts control how long
+// multiplexed requests wait, and what they do when they have
+// waited too long.  Since nothing could stop them, responses
+// served because of stale-while-revalidate aren't refreshed in
+// the background, so they are only fetched again once it has
+// run out - use NewProxy, and Close it, to refresh them.
+func FetchWithOptions(c cache.Cacher, handler http.Handler, backend *url.URL, opts Options) http.HandlerFunc {
+	p := compatProxy(c, opts)
+	p.handler = handler
+	p.backend = backend
+	return p.ServeHTTP
 }
 
 // Forwarder returns a new forward.Forwarder which saves responses
 // into cache.Cacher c.  It panics if it cannot create the forwarder.
+// It is meant to be used with Fetch - use NewProxy instead, which
+// creates its own.
 func Forwarder(c cache.Cacher) http.Handler {
-	forwarder, err := forward.New(
-		forward.ResponseModifier(FlushSingleflight(c, nil)),
-	)
-	if err != nil {
-		panic(err)
-	}
-	return forwarder
+	return compatProxy(c, DefaultOptions()).forwarder()
 }
 
 // SwitchBackend changes the host and scheme of a request
@@ -72,13 +43,30 @@ func Forwarder(c cache.Cacher) http.Handler {
 // because otherwise we can't match the URL in the cache or
 // singleflight.  It sets the X-Forwarded-Proto header if not
 // already set to indicate the protocol (HTTP or HTTPS) that a
-// client used to connect, and sets the Host header to indicate
-// the actual hostname requested.
+// client used to connect, and sets the Host header, and the
+// X-Forwarded-Host header - since the forwarder sends the
+// backend's host as the Host - to indicate the actual hostname
+// requested.
 func SwitchBackend(req *http.Request, backend *url.URL) {
-	req.Host = req.URL.Host
+	// Requests received by a server only have a path in the url,
+	// and the hostname in the Host header.
+	if req.URL.Host != "" {
+		req.Host = req.URL.Host
+	}
+	// It is always replaced, since transforms use it as the host of
+	// the site, and clients mustn't be able to choose it
+	if req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
 	req.URL.Host = backend.Host
 	if req.Header.Get("X-Forwarded-Proto") == "" {
-		req.Header.Add("X-Forwarded-Proto", req.URL.Scheme)
+		scheme := req.URL.Scheme
+		if scheme == "" && req.TLS != nil {
+			scheme = "https"
+		} else if scheme == "" {
+			scheme = "http"
+		}
+		req.Header.Add("X-Forwarded-Proto", scheme)
 	}
 	req.URL.Scheme = backend.Scheme
 }
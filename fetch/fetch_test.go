@@ -65,6 +65,7 @@ func (suite *FetchTestSuite) TestFetchUncacheableViaCache() {
 
 func (suite *FetchTestSuite) TestFetchUncacheableViaHeader() {
 	suite.cacher.On("CanCache", suite.request).Return(true)
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, false)
 	suite.request.Header.Set("Cache-Control", "no-cache")
 	Fetch(suite.cacher, suite.handler, suite.backend)(suite.writer, suite.request)
 	suite.handler.AssertCalled(suite.T(), "ServeHTTP", suite.writer, suite.request)
@@ -72,6 +73,7 @@ func (suite *FetchTestSuite) TestFetchUncacheableViaHeader() {
 
 func (suite *FetchTestSuite) TestFetchUncacheableOnlyIfCached() {
 	suite.cacher.On("CanCache", suite.request).Return(true)
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, false)
 	suite.request.Header.Set("Cache-Control", "no-cache,only-if-cached")
 	Fetch(suite.cacher, suite.handler, suite.backend)(suite.writer, suite.request)
 	suite.handler.AssertNotCalled(suite.T(), "ServeHTTP", suite.writer, suite.request)
@@ -83,6 +85,7 @@ func (suite *FetchTestSuite) TestFetchUncacheableMultiplexed() {
 	singleflights.Load(suite.singleflight)
 	suite.singleflight.On("AddWriter", suite.writer, suite.request)
 	suite.singleflight.On("Wait")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, false)
 	suite.request.Header.Set("Cache-Control", "no-cache,only-if-cached")
 	Fetch(suite.cacher, suite.handler, suite.backend)(suite.writer, suite.request)
 	suite.handler.AssertNotCalled(suite.T(), "ServeHTTP", suite.writer, suite.request)
@@ -123,3 +126,27 @@ func TestSwitchBackendXForwarderProtoIsAdded(t *testing.T) {
 		t.Error("SwitchBackend should set X-Forwarded-Proto header")
 	}
 }
+
+func TestSwitchBackendKeepsHostOfServerRequests(t *testing.T) {
+	backend, _ := url.Parse("http://www.backend.com")
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Host = "www.insomniac.com"
+	SwitchBackend(r, backend)
+	if r.Host != "www.insomniac.com" {
+		t.Errorf("Expected host www.insomniac.com, got %s", r.Host)
+	}
+	if r.Header.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Expected X-Forwarded-Proto http, got %s", r.Header.Get("X-Forwarded-Proto"))
+	}
+}
+
+func TestSwitchBackendSetsXForwardedHost(t *testing.T) {
+	backend, _ := url.Parse("http://www.backend.com")
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Host = "www.insomniac.com"
+	r.Header.Set("X-Forwarded-Host", "www.example.com")
+	SwitchBackend(r, backend)
+	if r.Header.Get("X-Forwarded-Host") != "www.insomniac.com" {
+		t.Errorf("Expected X-Forwarded-Host www.insomniac.com, got %s", r.Header.Get("X-Forwarded-Host"))
+	}
+}
@@ -0,0 +1,131 @@
+package fetch
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/transform"
+)
+
+// HintOptions decide how the critical assets of cached pages - their
+// stylesheets, and what they preload, like fonts - are sent to clients
+// before the pages themselves.  The zero value sends nothing.
+type HintOptions struct {
+	// EarlyHints sends a 103 Early Hints response with the assets
+	// as Link: rel=preload headers.
+	// https://tools.ietf.org/html/rfc8297
+	EarlyHints bool
+	// Push pushes the assets on the host of the page, if the
+	// connection supports http/2 server push.
+	Push bool
+	// MaxAssets is how many assets are sent for each page.  If it
+	// is 0, DefaultMaxHintAssets are.
+	MaxAssets int
+}
+
+type hintsRoute struct {
+	match *regexp.Regexp
+	opts  HintOptions
+}
+
+// DefaultMaxHintAssets is how many assets are sent for each page, unless
+// HintOptions.MaxAssets says otherwise.
+const DefaultMaxHintAssets = 10
+
+// The metrics the Proxy records for hints
+const (
+	// MetricEarlyHints counts the 103 Early Hints responses sent
+	MetricEarlyHints = "hints.early_hints"
+	// MetricPushed counts the assets pushed
+	MetricPushed = "hints.pushed"
+)
+
+// SetHints sets the HintOptions for requests which don't match a route
+// added with AddHintsRoute.
+func (p *Proxy) SetHints(opts HintOptions) {
+	p.options.Hints = opts
+}
+
+// AddHintsRoute sets the HintOptions for requests whose path matches
+// match.  Routes are checked in the order they were added.
+func (p *Proxy) AddHintsRoute(match *regexp.Regexp, opts HintOptions) {
+	p.hintsRoutes = append(p.hintsRoutes, hintsRoute{match: match, opts: opts})
+}
+
+// hintOptions returns the HintOptions for request r.
+func (p *Proxy) hintOptions(r *http.Request) HintOptions {
+	for _, route := range p.hintsRoutes {
+		if route.match.MatchString(r.URL.Path) {
+			return route.opts
+		}
+	}
+	return p.options.Hints
+}
+
+func (h HintOptions) enabled() bool {
+	return h.EarlyHints || h.Push
+}
+
+// hintsStage returns the transform.Stage which finds the critical assets
+// of pages before they are cached, and adds them to their Link headers.
+func (p *Proxy) hintsStage() transform.Stage {
+	return transform.Stage{
+		Name: "hints",
+		Transformer: transform.TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+			max := p.hintOptions(r).MaxAssets
+			if max <= 0 {
+				max = DefaultMaxHintAssets
+			}
+			return transform.ExtractPreloads(max).Transform(r, header, body)
+		}),
+		Order:        transform.PreloadOrder,
+		ContentTypes: []string{"text/html"},
+		Enabled: func(r *http.Request) bool {
+			return p.hintOptions(r).enabled()
+		},
+	}
+}
+
+// hint sends the critical assets of resp, the cached response to r,
+// as 103 Early Hints, and pushes them, as the HintOptions for r say.
+// Clients which send If-None-Match have probably got the page, and its
+// assets, already, so aren't sent them.
+func (p *Proxy) hint(w http.ResponseWriter, r *http.Request, resp cache.Response) {
+	opts := p.hintOptions(r)
+	if !opts.enabled() || r.Header.Get("If-None-Match") != "" ||
+		resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return
+	}
+	links := transform.PreloadLinks(resp.Header())
+	if len(links) == 0 {
+		return
+	}
+	if pusher, ok := w.(http.Pusher); ok && opts.Push {
+		for _, link := range links {
+			// Only assets on the same host can be pushed
+			if !strings.HasPrefix(link.URL, "/") || strings.HasPrefix(link.URL, "//") {
+				continue
+			}
+			header := http.Header{}
+			if encoding := r.Header.Get("Accept-Encoding"); encoding != "" {
+				header.Set("Accept-Encoding", encoding)
+			}
+			if pusher.Push(link.URL, &http.PushOptions{Header: header}) == nil {
+				p.metrics.Add(MetricPushed, 1)
+			}
+		}
+	}
+	// HTTP/1.0 clients can't be sent informational responses
+	// https://tools.ietf.org/html/rfc7231#section-6.2
+	if opts.EarlyHints && r.ProtoAtLeast(1, 1) {
+		for _, link := range links {
+			w.Header().Add("Link", link.String())
+		}
+		w.WriteHeader(http.StatusEarlyHints)
+		// The Link headers are sent again with the page
+		w.Header().Del("Link")
+		p.metrics.Add(MetricEarlyHints, 1)
+	}
+}
@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hintsRecorder records the informational responses, and pushes, which
+// httptest.ResponseRecorder treats as the final response.
+type hintsRecorder struct {
+	*httptest.ResponseRecorder
+	informational []int
+	hints         []string
+	pushed        []string
+}
+
+func (w *hintsRecorder) WriteHeader(status int) {
+	if status >= 100 && status < 200 {
+		w.informational = append(w.informational, status)
+		w.hints = append(w.hints, w.Header()["Link"]...)
+		return
+	}
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *hintsRecorder) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+const hintsPage = `<head><link rel="stylesheet" href="/style.css"><link rel="preload" href="https://fonts.gstatic.com/a.woff2" as="font"></head>`
+
+func serveHints(proxy *Proxy, uri string, header http.Header) *hintsRecorder {
+	w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	proxy.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxySendsEarlyHints(t *testing.T) {
+	proxy, closer := newHTMLProxy(t, hintsPage)
+	defer closer()
+	proxy.SetHints(HintOptions{EarlyHints: true, Push: true})
+	miss := serveHints(proxy, "http://www.insomniac.com/", nil)
+	assert.Empty(t, miss.informational, "Hints should only be sent from the cache")
+	assert.Len(t, miss.Header()["Link"], 2, "The page should be cached with its preloads")
+
+	hit := serveHints(proxy, "http://www.insomniac.com/", nil)
+	assert.Equal(t, "HIT", hit.Header().Get("X-Honey-Cache"))
+	assert.Equal(t, []int{http.StatusEarlyHints}, hit.informational)
+	assert.Equal(t, []string{
+		"</style.css>; rel=preload; as=style",
+		"<https://fonts.gstatic.com/a.woff2>; rel=preload; as=font; crossorigin",
+	}, hit.hints)
+	assert.Equal(t, []string{"/style.css"}, hit.pushed, "Only assets on the same host should be pushed")
+	assert.Equal(t, http.StatusOK, hit.Code)
+	assert.Len(t, hit.Header()["Link"], 2, "The page should have its Link headers once")
+	assert.Equal(t, int64(1), proxy.Metrics().Get(MetricEarlyHints))
+	assert.Equal(t, int64(1), proxy.Metrics().Get(MetricPushed))
+
+	revalidated := serveHints(proxy, "http://www.insomniac.com/", http.Header{"If-None-Match": []string{hit.Header().Get("Etag")}})
+	assert.Empty(t, revalidated.informational, "Clients with the page shouldn't be sent hints")
+	assert.Empty(t, revalidated.pushed)
+}
+
+func TestProxyHintsRoutes(t *testing.T) {
+	proxy, closer := newHTMLProxy(t, hintsPage)
+	defer closer()
+	proxy.SetHints(HintOptions{EarlyHints: true})
+	proxy.AddHintsRoute(regexp.MustCompile("^/checkout"), HintOptions{})
+	serveHints(proxy, "http://www.insomniac.com/checkout", nil)
+	hit := serveHints(proxy, "http://www.insomniac.com/checkout", nil)
+	assert.Empty(t, hit.informational)
+	assert.Empty(t, hit.Header()["Link"], "Preloads shouldn't be found for routes without hints")
+}
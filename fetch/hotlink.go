@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultHotlinkMatch matches the paths of images and media, which
+// HotlinkRules without a Match protect.
+var DefaultHotlinkMatch = regexp.MustCompile(`(?i)\.(?:png|jpe?g|gif|webp|avif|svg|bmp|ico|tiff?|mp3|mp4|m4a|m4v|ogg|oga|ogv|opus|wav|flac|webm|mov|avi|mkv)$`)
+
+// A HotlinkRule stops other sites embedding the files whose paths match
+// Match, so that they don't use the site's bandwidth.  Requests are
+// allowed if their Origin - or Referer, if they don't have one - is the
+// site itself, or one of the Allow domains.
+type HotlinkRule struct {
+	// Match is the paths the rule applies to.  If it is nil,
+	// DefaultHotlinkMatch is used.
+	Match *regexp.Regexp
+	// Allow are the domains, other than the site's own, which may
+	// embed the files.  One starting with *. matches any subdomain,
+	// and * matches any domain.
+	Allow []string
+	// AllowEmpty allows requests without an Origin or Referer, like
+	// those of people who open the file directly, or whose browser
+	// doesn't send one.
+	AllowEmpty bool
+	// Replacement is sent instead of the file to requests which
+	// aren't allowed, with the Content-Type ReplacementType.  If it
+	// is nil, they get a 403 Forbidden.
+	Replacement     []byte
+	ReplacementType string
+}
+
+// The metrics the Proxy records for hotlink protection
+const (
+	// MetricHotlinkBlocked counts the requests which weren't allowed
+	MetricHotlinkBlocked = "hotlink.blocked"
+	// MetricHotlinkReplaced counts those which were sent the
+	// Replacement, rather than a 403 Forbidden
+	MetricHotlinkReplaced = "hotlink.replaced"
+)
+
+// AddHotlinkRule adds rule to the Proxy.  Rules are checked in the order
+// they were added, and only the first whose Match matches is applied.
+func (p *Proxy) AddHotlinkRule(rule HotlinkRule) {
+	if rule.Match == nil {
+		rule.Match = DefaultHotlinkMatch
+	}
+	p.hotlinkRules = append(p.hotlinkRules, rule)
+}
+
+// blockHotlink responds to r, and returns true, if it is for a file
+// another site isn't allowed to embed.  It is checked before the cache,
+// so blocked requests are never sent to the backend.
+func (p *Proxy) blockHotlink(w http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range p.hotlinkRules {
+		if !rule.Match.MatchString(r.URL.Path) {
+			continue
+		}
+		if rule.allowed(r) {
+			return false
+		}
+		p.metrics.Add(MetricHotlinkBlocked, 1)
+		// The response depends on the Referer, so it mustn't be
+		// cached in place of the file
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("X-Honey-Cache", "NO-CACHE")
+		if rule.Replacement == nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return true
+		}
+		p.metrics.Add(MetricHotlinkReplaced, 1)
+		if rule.ReplacementType != "" {
+			w.Header().Set("Content-Type", rule.ReplacementType)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(rule.Replacement)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(rule.Replacement)
+		}
+		return true
+	}
+	return false
+}
+
+// allowed returns whether the page which requested r may embed it.
+func (rule HotlinkRule) allowed(r *http.Request) bool {
+	referer := r.Header.Get("Origin")
+	if referer == "" || referer == "null" {
+		referer = r.Header.Get("Referer")
+	}
+	if referer == "" {
+		return rule.AllowEmpty
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := normalizeHost(u.Host)
+	if host == normalizeHost(r.Host) {
+		return true
+	}
+	for _, allowed := range rule.Allow {
+		if matchDomain(host, normalizeHost(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain returns whether host is domain, or a subdomain of it if
+// domain starts with *., or if domain is *.
+func matchDomain(host, domain string) bool {
+	if domain == "*" {
+		return true
+	}
+	if strings.HasPrefix(domain, "*.") {
+		return strings.HasSuffix(host, domain[1:])
+	}
+	return host == domain
+}
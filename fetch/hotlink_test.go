@@ -0,0 +1,58 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveReferer(p http.Handler, uri, header, referer string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	if referer != "" {
+		r.Header.Set(header, referer)
+	}
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyBlocksHotlinks(t *testing.T) {
+	proxy, backend, closer := newTestProxy(t, "image")
+	defer closer()
+	proxy.AddHotlinkRule(HotlinkRule{Allow: []string{"*.google.com"}})
+	uri := "http://www.insomniac.com/wp-content/photo.JPG"
+
+	blocked := serveReferer(proxy, uri, "Referer", "https://www.example.com/gallery")
+	assert.Equal(t, http.StatusForbidden, blocked.Code)
+	assert.Equal(t, "private, no-store", blocked.Header().Get("Cache-Control"))
+	assert.Equal(t, 0, backend.count, "Blocked requests should never reach the backend")
+
+	assert.Equal(t, http.StatusOK, serveReferer(proxy, uri, "Referer", "https://www.insomniac.com/gallery").Code,
+		"The site itself should be allowed")
+	assert.Equal(t, http.StatusOK, serveReferer(proxy, uri, "Referer", "https://images.google.com/").Code)
+	assert.Equal(t, http.StatusForbidden, serveReferer(proxy, uri, "Origin", "https://google.com.example.com").Code)
+	assert.Equal(t, http.StatusForbidden, serveReferer(proxy, uri, "", "").Code, "Empty referers should be blocked unless allowed")
+	assert.Equal(t, http.StatusOK, serveReferer(proxy, "http://www.insomniac.com/page", "Referer", "https://www.example.com/").Code,
+		"Pages should be left alone")
+	assert.Equal(t, int64(3), proxy.Metrics().Get(MetricHotlinkBlocked))
+}
+
+func TestProxyHotlinkRules(t *testing.T) {
+	proxy, _, closer := newTestProxy(t, "image")
+	defer closer()
+	proxy.AddHotlinkRule(HotlinkRule{Match: regexp.MustCompile("^/press/"), AllowEmpty: true})
+	proxy.AddHotlinkRule(HotlinkRule{AllowEmpty: true, Replacement: []byte("GIF89a"), ReplacementType: "image/gif"})
+
+	assert.Equal(t, http.StatusOK, serveReferer(proxy, "http://www.insomniac.com/photo.png", "", "").Code)
+	replaced := serveReferer(proxy, "http://www.insomniac.com/photo.png", "Referer", "https://www.example.com/")
+	assert.Equal(t, http.StatusOK, replaced.Code)
+	assert.Equal(t, "GIF89a", replaced.Body.String())
+	assert.Equal(t, "image/gif", replaced.Header().Get("Content-Type"))
+	assert.Equal(t, int64(1), proxy.Metrics().Get(MetricHotlinkReplaced))
+
+	press := serveReferer(proxy, "http://www.insomniac.com/press/photo.png", "Referer", "https://www.example.com/")
+	assert.Equal(t, http.StatusForbidden, press.Code, "Only the first matching rule should be applied")
+}
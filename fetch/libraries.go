@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/minify"
+	"github.com/davidjwilkins/honey/transform"
+)
+
+// errScriptNotFound is returned by fetchScript for a script which
+// couldn't be fetched.
+var errScriptNotFound = errors.New("fetch: script not found")
+
+// LibrariesStage returns a transform.Stage which replaces the site's
+// copies of the libraries in manifest with the hosted ones - see
+// transform.CanonicalizeLibraries.  The scripts are fetched through
+// the Proxy, so that they are cached, rather than fetched again for
+// every page.
+func (p *Proxy) LibrariesStage(manifest transform.LibraryManifest) transform.Stage {
+	if p.scripts == nil {
+		p.scripts = &sync.Map{}
+	}
+	return transform.Stage{
+		Name:         "libraries",
+		Transformer:  transform.CanonicalizeLibraries(manifest, p.fetchScript),
+		Order:        transform.LibrariesOrder,
+		ContentTypes: []string{"text/html"},
+	}
+}
+
+// fetchScript returns the integrity of the script at src, on the host
+// of r, the request for the page it is in, as the backend sent it - the
+// transforms, e.g. minification, would stop it matching its Library.
+func (p *Proxy) fetchScript(r *http.Request, src *url.URL) (transform.ScriptIntegrity, error) {
+	req, err := http.NewRequest(http.MethodGet, src.RequestURI(), nil)
+	if err != nil {
+		return transform.ScriptIntegrity{}, err
+	}
+	// r is the request sent to the backend, whose Host is the backend's
+	req.Host = transform.SiteHost(r)
+	req.RemoteAddr = r.RemoteAddr
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	req = req.WithContext(r.Context())
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return transform.ScriptIntegrity{}, errScriptNotFound
+	}
+	if original, found := p.scripts.Load(p.cacher.Hash(req)); found {
+		return original.(transform.ScriptIntegrity), nil
+	}
+	return transform.NewScriptIntegrity(w.Body.Bytes()), nil
+}
+
+// keepScript keeps the integrity of original, the body of the script
+// resp before it was transformed, for fetchScript, if the transforms
+// changed it.  Only the integrity is kept, so that scripts aren't held
+// in memory twice.
+func (p *Proxy) keepScript(hash string, resp cache.Response, original []byte) {
+	if p.scripts == nil {
+		return
+	}
+	if lang, _ := minify.LanguageOf(resp.Header().Get("Content-Type")); lang != minify.JavaScript || bytes.Equal(original, resp.Body()) {
+		p.scripts.Delete(hash)
+		return
+	}
+	p.scripts.Store(hash, transform.NewScriptIntegrity(original))
+}
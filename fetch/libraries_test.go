@@ -0,0 +1,83 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyCanonicalizesLibraries(t *testing.T) {
+	library := "/*! library v1.0 */ window.library = {};"
+	scripts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/js/library.js":
+			scripts++
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(library))
+		case "/js/custom.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte("window.custom = {};"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<script src="js/library.js"></script><script src="/js/custom.js"></script>`))
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(cache.NewDefaultCacher(), u, DefaultOptions())
+	defer proxy.Close()
+	manifest := transform.LibraryManifest{
+		transform.Integrity256([]byte(library)): {Name: "library", Version: "1.0", URL: "https://cdn.example.com/library/1.0/library.js"},
+	}
+	proxy.AddTransform(proxy.LibrariesStage(manifest))
+
+	page := serve(proxy, "http://www.insomniac.com/")
+	assert.Contains(t, page.Body.String(), `<script src="https://cdn.example.com/library/1.0/library.js" integrity="sha384-`)
+	assert.Contains(t, page.Body.String(), `crossorigin="anonymous"></script>`)
+	assert.Contains(t, page.Body.String(), `<script src="/js/custom.js"></script>`, "Scripts which aren't libraries should be left alone")
+	assert.Equal(t, "HIT", serve(proxy, "http://www.insomniac.com/js/library.js").Header().Get("X-Honey-Cache"),
+		"The script should be cached when it is fetched")
+	assert.Equal(t, 1, scripts)
+}
+
+func TestProxyCanonicalizesMinifiedLibraries(t *testing.T) {
+	library := "/*! library v1.0 */\nwindow.library = { version: 1 };\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/js/library.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(library))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<script src="http://www.insomniac.com/js/library.js"></script>`))
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(cache.NewDefaultCacher(), u, DefaultOptions())
+	defer proxy.Close()
+	proxy.SetMinify(MinifyOptions{JavaScript: true})
+	manifest := transform.LibraryManifest{
+		transform.Integrity256([]byte(library)): {Name: "library", Version: "1.0", URL: "https://cdn.example.com/library/1.0/library.js"},
+	}
+	proxy.AddTransform(proxy.LibrariesStage(manifest))
+
+	// The script is cached minified first
+	script := serve(proxy, "http://www.insomniac.com/js/library.js")
+	assert.NotEqual(t, library, script.Body.String())
+	page := serve(proxy, "http://www.insomniac.com/")
+	assert.Contains(t, page.Body.String(), `<script src="https://cdn.example.com/library/1.0/library.js" integrity="sha384-`,
+		"Scripts should be matched by the body the backend sent, not the minified one")
+}
@@ -0,0 +1,105 @@
+package fetch
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/davidjwilkins/honey/minify"
+	"github.com/davidjwilkins/honey/transform"
+)
+
+// MinifyOptions decide which responses are minified before they are
+// cached, by their Content-Type.  The zero value minifies nothing.
+type MinifyOptions struct {
+	HTML       bool
+	CSS        bool
+	JavaScript bool
+}
+
+type minifyRoute struct {
+	match *regexp.Regexp
+	opts  MinifyOptions
+}
+
+// The metrics the Proxy records for minification
+const (
+	// MetricMinified counts the responses which were minified
+	MetricMinified = "minify.responses"
+	// MetricMinifyBytesSaved counts how many bytes smaller they are
+	MetricMinifyBytesSaved = "minify.bytes_saved"
+	// MetricMinifyErrors counts the responses which couldn't be
+	// minified, and were cached as they were
+	MetricMinifyErrors = "minify.errors"
+)
+
+func (m MinifyOptions) enabled(lang minify.Language) bool {
+	switch lang {
+	case minify.HTML:
+		return m.HTML
+	case minify.CSS:
+		return m.CSS
+	case minify.JavaScript:
+		return m.JavaScript
+	}
+	return false
+}
+
+// SetMinify sets the MinifyOptions for requests which don't match a
+// route added with AddMinifyRoute.
+func (p *Proxy) SetMinify(opts MinifyOptions) {
+	p.options.Minify = opts
+}
+
+// AddMinifyRoute sets the MinifyOptions for requests whose path
+// matches match.  Routes are checked in the order they were added.
+func (p *Proxy) AddMinifyRoute(match *regexp.Regexp, opts MinifyOptions) {
+	p.minifyRoutes = append(p.minifyRoutes, minifyRoute{match: match, opts: opts})
+}
+
+// minifyOptions returns the MinifyOptions for request r.
+func (p *Proxy) minifyOptions(r *http.Request) MinifyOptions {
+	for _, route := range p.minifyRoutes {
+		if route.match.MatchString(r.URL.Path) {
+			return route.opts
+		}
+	}
+	return p.options.Minify
+}
+
+// MinifyOrder is the transform.Stage Order of minification, which is
+// late, so that what other Stages add is minified too.
+const MinifyOrder = 1000
+
+// minifyStage returns the transform.Stage which minifies responses
+// according to the Proxy's MinifyOptions.
+func (p *Proxy) minifyStage() transform.Stage {
+	return transform.Stage{
+		Name:        "minify",
+		Transformer: transform.TransformerFunc(p.minify),
+		Order:       MinifyOrder,
+		Enabled: func(r *http.Request) bool {
+			return p.minifyOptions(r) != (MinifyOptions{})
+		},
+	}
+}
+
+// minify returns body, the body of the response to r, minified, if
+// its Content-Type should be.  If it can't be minified, it is returned
+// as it is.
+func (p *Proxy) minify(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+	lang, ok := minify.LanguageOf(header.Get("Content-Type"))
+	if !ok || !p.minifyOptions(r).enabled(lang) {
+		return body, nil
+	}
+	minified, err := minify.Minify(lang, body)
+	if err != nil {
+		p.metrics.Add(MetricMinifyErrors, 1)
+		return body, nil
+	}
+	if len(minified) >= len(body) {
+		return body, nil
+	}
+	p.metrics.Add(MetricMinified, 1)
+	p.metrics.Add(MetricMinifyBytesSaved, int64(len(body)-len(minified)))
+	return minified, nil
+}
@@ -0,0 +1,43 @@
+package fetch
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyMinifiesBeforeCaching(t *testing.T) {
+	page := "<p>Hello,   world</p>\n  <!-- comment -->\n"
+	proxy, closer := newHTMLProxy(t, page)
+	defer closer()
+	proxy.SetMinify(MinifyOptions{HTML: true})
+	miss := serve(proxy, "http://www.insomniac.com/page")
+	hit := serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, "<p>Hello, world</p>", miss.Body.String())
+	assert.Equal(t, "HIT", hit.Header().Get("X-Honey-Cache"))
+	assert.Equal(t, "<p>Hello, world</p>", hit.Body.String())
+	assert.Equal(t, miss.Header().Get("Etag"), hit.Header().Get("Etag"))
+	assert.Equal(t, int64(1), proxy.Metrics().Get(MetricMinified))
+	assert.Equal(t, int64(len(page)-len("<p>Hello, world</p>")), proxy.Metrics().Get(MetricMinifyBytesSaved))
+}
+
+func TestProxyMinifyRoutes(t *testing.T) {
+	page := "<p>Hello,   world</p>"
+	proxy, closer := newHTMLProxy(t, page)
+	defer closer()
+	proxy.SetMinify(MinifyOptions{HTML: true})
+	proxy.AddMinifyRoute(regexp.MustCompile("^/raw"), MinifyOptions{})
+	assert.Equal(t, page, serve(proxy, "http://www.insomniac.com/raw").Body.String())
+	assert.Equal(t, "<p>Hello, world</p>", serve(proxy, "http://www.insomniac.com/page").Body.String())
+}
+
+func TestProxyMinifyFallsBackOnError(t *testing.T) {
+	page := "<p>Hello,   world <!-- unterminated"
+	proxy, closer := newHTMLProxy(t, page)
+	defer closer()
+	proxy.SetMinify(MinifyOptions{HTML: true})
+	assert.Equal(t, page, serve(proxy, "http://www.insomniac.com/page").Body.String())
+	assert.Equal(t, int64(1), proxy.Metrics().Get(MetricMinifyErrors))
+	assert.Equal(t, int64(0), proxy.Metrics().Get(MetricMinified))
+}
@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// A CoalesceFallback decides what a request which has been
+// multiplexed onto another request for the same hash does
+// if it has waited for longer than Options.MaxCoalesceWait.
+type CoalesceFallback int
+
+const (
+	// CoalesceFetch sends the request to the backend itself
+	CoalesceFetch CoalesceFallback = iota
+	// CoalesceStale serves the cached response, even if it is
+	// stale, or a 504 Gateway Timeout if there isn't one
+	CoalesceStale
+	// CoalesceError responds with a 504 Gateway Timeout
+	CoalesceError
+)
+
+// ParseCoalesceFallback returns the CoalesceFallback named fetch,
+// stale or error.
+func ParseCoalesceFallback(name string) (CoalesceFallback, error) {
+	switch name {
+	case "", "fetch":
+		return CoalesceFetch, nil
+	case "stale":
+		return CoalesceStale, nil
+	case "error":
+		return CoalesceError, nil
+	}
+	return CoalesceFetch, errors.New("fetch: unknown coalesce fallback " + name)
+}
+
+// Options control how Fetch multiplexes requests onto a
+// single request to the backend.
+type Options struct {
+	// MaxCoalesceWait is how long a multiplexed request waits
+	// for the request it is multiplexed onto before it falls
+	// back to CoalesceFallback.  If it is 0, it waits for as
+	// long as the client does.
+	MaxCoalesceWait time.Duration
+	// CoalesceFallback is what a multiplexed request does once
+	// it has waited for MaxCoalesceWait.
+	CoalesceFallback CoalesceFallback
+	// LeaderTimeout is added to the context of the request which
+	// is sent to the backend on behalf of all multiplexed requests,
+	// so that a request the backend never answers is canceled.  If
+	// it is 0, the request is only canceled if the client goes away.
+	LeaderTimeout time.Duration
+	// Transport sends requests to the backend, e.g. one which
+	// balances them across several origins.  If it is nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// Stale decides for how long stale responses may be served
+	// in place of errors, or while they are revalidated, whatever
+	// stale-if-error and stale-while-revalidate say.
+	Stale StalePolicies
+	// Revalidate controls the background requests which refresh
+	// stale responses served because of stale-while-revalidate.
+	Revalidate RevalidateOptions
+	// Minify decides which responses are minified before they are
+	// cached, unless a route added with AddMinifyRoute matches.
+	Minify MinifyOptions
+	// Hints decides how the critical assets of cached pages are sent
+	// before them, unless a route added with AddHintsRoute matches.
+	Hints HintOptions
+}
+
+// DefaultOptions returns the Options used by Fetch.  Multiplexed
+// requests will wait up to 10 seconds before going to the backend
+// themselves.
+func DefaultOptions() Options {
+	return Options{
+		MaxCoalesceWait:  10 * time.Second,
+		CoalesceFallback: CoalesceFetch,
+		Revalidate:       DefaultRevalidateOptions(),
+	}
+}
@@ -0,0 +1,341 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/metrics"
+	"github.com/davidjwilkins/honey/transform"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// A Proxy is an http.Handler which serves responses from its cache,
+// if possible.  If not, it will do a single request to the backend,
+// multiplex the response to all requesters, and save it in the cache.
+// Each Proxy keeps track of its own in-flight requests, so several
+// can be used in the same process without sharing any state.
+type Proxy struct {
+	cacher        cache.Cacher
+	handler       http.Handler
+	backend       *url.URL
+	options       Options
+	singleflights *sync.Map
+	clock         func() time.Time
+	breaker       *Breaker
+	staleRoutes   []staleRoute
+	revalidator   *Revalidator
+	bypass        *BypassAccess
+	minifyRoutes  []minifyRoute
+	hintsRoutes   []hintsRoute
+	hotlinkRules  []HotlinkRule
+	metrics       *metrics.Counters
+	transforms    *transform.Pipeline
+	// scripts are the transform.ScriptIntegrity of the bodies scripts
+	// had before the transforms changed them, by hash, which
+	// LibrariesStage matches
+	scripts *sync.Map
+}
+
+// NewProxy returns a Proxy which caches responses from backend
+// in cacher.  It panics if it cannot create the forwarder which
+// sends requests to the backend.
+func NewProxy(cacher cache.Cacher, backend *url.URL, opts Options) *Proxy {
+	p := &Proxy{
+		cacher:        cacher,
+		backend:       backend,
+		options:       opts,
+		singleflights: &sync.Map{},
+		clock:         time.Now,
+		metrics:       metrics.NewCounters(),
+	}
+	p.transforms = p.newPipeline()
+	p.handler = p.forwarder()
+	p.revalidator = NewRevalidator(opts.Revalidate)
+	return p
+}
+
+// compatProxy returns a Proxy for the package level functions, which
+// all share the package level list of in-flight requests.
+func compatProxy(c cache.Cacher, opts Options) *Proxy {
+	p := &Proxy{
+		cacher:        c,
+		options:       opts,
+		singleflights: &singleflights,
+		clock:         time.Now,
+		metrics:       metrics.NewCounters(),
+	}
+	p.transforms = p.newPipeline()
+	return p
+}
+
+// newPipeline returns the transform.Pipeline responses go through before
+// they are cached, with the Proxy's built in Stages.
+func (p *Proxy) newPipeline() *transform.Pipeline {
+	pipeline := transform.NewPipeline(p.metrics)
+	pipeline.Add(p.hintsStage())
+	pipeline.Add(p.minifyStage())
+	return pipeline
+}
+
+// AddTransform adds stage to the transform.Pipeline responses go through
+// after they are standardized, and before they are cached.
+func (p *Proxy) AddTransform(stage transform.Stage) {
+	p.transforms.Add(stage)
+}
+
+// SetClock replaces the function the Proxy uses to tell the time.
+func (p *Proxy) SetClock(clock func() time.Time) {
+	p.clock = clock
+}
+
+// SetBreaker sets the circuit breaker for the backend.  While it is
+// open, requests which can't be responded to from the cache are
+// responded to with a stale response, if there is one, or a 503
+// Service Unavailable, rather than being sent to the backend.  If
+// it is nil, requests are always sent to the backend.
+func (p *Proxy) SetBreaker(breaker *Breaker) {
+	p.breaker = breaker
+}
+
+// Breaker returns the circuit breaker set with SetBreaker, if there
+// is one, e.g. so that another Proxy for the same backend can share it.
+func (p *Proxy) Breaker() *Breaker {
+	return p.breaker
+}
+
+// Options returns the Options the Proxy was created with.
+func (p *Proxy) Options() Options {
+	return p.options
+}
+
+// Metrics returns the Counters the Proxy records what it does in,
+// e.g. to publish them with expvar.
+func (p *Proxy) Metrics() *metrics.Counters {
+	return p.metrics
+}
+
+// Cacher returns the cache.Cacher the Proxy saves responses in.
+func (p *Proxy) Cacher() cache.Cacher {
+	return p.cacher
+}
+
+// ServeHTTP responds to r from the cache, from an in-flight request
+// for the same hash, or by sending it to the backend.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, opts := p.cacher, p.options
+	SwitchBackend(r, p.backend)
+	if p.blockHotlink(w, r) {
+		return
+	}
+	// The cache directives of clients which may not bypass the cache
+	// are removed, and the secrets which let them are kept from the
+	// backend
+	if p.bypass != nil {
+		if !p.bypass.Allowed(r) {
+			removeBypass(r)
+		}
+		p.bypass.removeSecrets(r)
+	}
+	// CanCache tells us if this *Cache* is able to cache the request.
+	// I.e. There are no *custom* rules preventing it.  Even if it returns
+	// true, the request itself may still not be cacheable.
+	cacheable := c.CanCache(r)
+	if cacheable {
+		// ResponeFromCache will always return the hash, and responded will
+		// tell us if we were able to respond via the cache.  It will return
+		// false if the cache entry does not yet exist, or if the request
+		// is not eligible for cacheing (due to Cache-Control: No-Cache, for
+		// example).
+		hash, responded, revalidate := p.respondFromCache(w, r)
+		if revalidate {
+			// A stale response has already been sent, so refresh it
+			// in the background.
+			p.revalidate(hash, r)
+			return
+		} else if responded {
+			return
+		}
+		// https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.9.4
+		// If we couldn't respond from the cache, and they only want it if
+		// it is cached, then exit with a 504 per the spec.
+		if strings.Contains(r.Header.Get("Cache-Control"), "only-if-cached") {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		// coalesce will return true if there was an in-flight request with
+		// the same hash, and we were able to respond with it's response.  It
+		// will block until the in-flight request has completed, or for
+		// opts.MaxCoalesceWait.
+		responded, leader := p.coalesce(hash, w, r, p.ServeHTTP)
+		if responded {
+			return
+		}
+		// Only the request which goes to the backend asks the breaker, so
+		// requests multiplexed onto a probe don't use up the others
+		allowed, ok := p.allow(r)
+		if !ok {
+			if leader {
+				p.fail(hash, errBreakerOpen)
+			}
+			p.respondBreakerOpen(hash, w, r)
+			return
+		}
+		r = allowed
+		// Every request multiplexed onto this one is waiting on the backend,
+		// so don't let it hang forever.  The backend request is sent with
+		// this request's context, so it will be canceled with it.
+		if opts.LeaderTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), opts.LeaderTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+	} else {
+		w.Header().Set("X-Honey-Cache", "NO-CACHE")
+	}
+	p.handler.ServeHTTP(w, r)
+}
+
+// revalidateDropHeaders are the request headers which aren't sent
+// with background revalidations.
+var revalidateDropHeaders = []string{
+	"Cache-Control", "Pragma", "If-None-Match", "If-Match",
+	"If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range",
+}
+
+// revalidate queues a request to the backend for r, with its own
+// context, to refresh the stale response with hash in the cache.
+// If one is already queued or running for hash, it does nothing.
+func (p *Proxy) revalidate(hash string, r *http.Request) {
+	if p.revalidator == nil {
+		return
+	}
+	req := new(http.Request)
+	*req = *r
+	u := *r.URL
+	req.URL = &u
+	req.Header = make(http.Header, len(r.Header))
+	for key, values := range r.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	// The refresh is for the cache, not the client, so it mustn't be
+	// conditional on what the client has, or bypass the cache
+	for _, key := range revalidateDropHeaders {
+		req.Header.Del(key)
+	}
+	p.revalidator.Revalidate(hash, func(ctx context.Context) {
+		w, req := httptest.NewRecorder(), req.WithContext(ctx)
+		responded, leader := p.coalesce(hash, w, req, p.ServeHTTP)
+		if responded {
+			return
+		}
+		// The backend is failing, so leave the stale response be
+		req, ok := p.allow(req)
+		if !ok {
+			if leader {
+				p.fail(hash, errBreakerOpen)
+			}
+			return
+		}
+		p.handler.ServeHTTP(w, req)
+	})
+}
+
+// Close stops the Proxy's background revalidations.
+func (p *Proxy) Close() {
+	if p.revalidator != nil {
+		p.revalidator.Close()
+	}
+}
+
+// forwarder returns a new forward.Forwarder which saves responses
+// into the Proxy's cache.  It panics if it cannot create the forwarder.
+func (p *Proxy) forwarder() http.Handler {
+	transport := p.options.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	forwarder, err := forward.New(
+		forward.RoundTripper(&singleflightTransport{
+			proxy:        p,
+			RoundTripper: transport,
+		}),
+		forward.ResponseModifier(p.flushSingleflight(nil)),
+		forward.ErrorHandler(utils.ErrorHandlerFunc(p.failSingleflight)),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return forwarder
+}
+
+// singleflightTransport fails the singleflight for any request which
+// the backend could not be reached for.  The ReverseProxy used by
+// forward writes its own 502 Bad Gateway for these, rather than
+// calling the ErrorHandler, so failSingleflight would not be called.
+type singleflightTransport struct {
+	proxy *Proxy
+	http.RoundTripper
+}
+
+func (t *singleflightTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := t.proxy.clock()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	// Requests the cache can't be filled from go to the backend
+	// whatever the breaker says, so only the others count
+	if t.proxy.breaker != nil && r.Context().Value(breakerAllowedKey{}) != nil {
+		t.proxy.breaker.Record(err != nil || resp.StatusCode >= http.StatusInternalServerError, t.proxy.clock().Sub(start))
+	}
+	if err != nil {
+		t.proxy.fail(t.proxy.cacher.Hash(r), err)
+	}
+	return resp, err
+}
+
+// errBreakerOpen fails the singleflight of a request the breaker
+// didn't let through, so the requests multiplexed onto it are
+// responded to as if they had asked it themselves.
+var errBreakerOpen = errors.New("fetch: breaker is open")
+
+// breakerAllowedKey is the context key of requests the breaker let
+// through, whose results it records.
+type breakerAllowedKey struct{}
+
+// allow returns whether a request to fill the cache may be sent
+// to the backend, and r marked so that the breaker records how
+// it went.
+func (p *Proxy) allow(r *http.Request) (*http.Request, bool) {
+	if p.breaker == nil {
+		return r, true
+	}
+	if !p.breaker.Allow() {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), breakerAllowedKey{}, true)), true
+}
+
+// breakerOpen returns whether the backend is failing, so stale
+// responses should be served in place of its errors.
+func (p *Proxy) breakerOpen() bool {
+	return p.breaker != nil && p.breaker.State() != BreakerClosed
+}
+
+// respondBreakerOpen responds to a request which the breaker won't
+// let through to the backend with the cached response, however stale,
+// or a 503 Service Unavailable if there isn't one.
+func (p *Proxy) respondBreakerOpen(hash string, w http.ResponseWriter, r *http.Request) {
+	if resp, found := p.cacher.Load(hash, r); found {
+		p.respondStale(w, r, resp, "Backend is failing")
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(p.breaker.options.OpenFor.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
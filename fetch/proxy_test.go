@@ -0,0 +1,173 @@
+package fetch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingBackend struct {
+	sync.Mutex
+	name  string
+	count int
+}
+
+func (b *countingBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	b.count++
+	count := b.count
+	b.Unlock()
+	fmt.Fprintf(w, "%s: %d", b.name, count)
+}
+
+func newTestProxy(t *testing.T, name string) (*Proxy, *countingBackend, func()) {
+	backend := &countingBackend{name: name}
+	server := httptest.NewServer(backend)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxy(cache.NewDefaultCacher(), u, DefaultOptions()), backend, server.Close
+}
+
+// newHTMLProxy returns a proxy to a backend which responds to every
+// request with the HTML body.
+func newHTMLProxy(t *testing.T, body string) (*Proxy, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(cache.NewDefaultCacher(), u, DefaultOptions())
+	return proxy, func() {
+		proxy.Close()
+		server.Close()
+	}
+}
+
+func serve(p http.Handler, uri string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, uri, nil))
+	return w
+}
+
+func TestProxyCachesResponses(t *testing.T) {
+	proxy, backend, closer := newTestProxy(t, "a")
+	defer closer()
+	first := serve(proxy, "http://www.insomniac.com/page")
+	second := serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, "MISS", first.Header().Get("X-Honey-Cache"))
+	assert.Equal(t, "HIT", second.Header().Get("X-Honey-Cache"))
+	assert.Equal(t, "a: 1", second.Body.String())
+	assert.Equal(t, 1, backend.count, "The backend should only be asked once")
+}
+
+func TestProxiesDoNotShareState(t *testing.T) {
+	proxyA, _, closeA := newTestProxy(t, "a")
+	defer closeA()
+	proxyB, _, closeB := newTestProxy(t, "b")
+	defer closeB()
+	// If the proxies shared a cache, the second would respond with "a: 1"
+	assert.Equal(t, "a: 1", serve(proxyA, "http://www.insomniac.com/page").Body.String())
+	assert.Equal(t, "b: 1", serve(proxyB, "http://www.insomniac.com/page").Body.String())
+	proxyA.singleflights.Store("shared-hash", true)
+	_, found := proxyB.singleflights.Load("shared-hash")
+	assert.False(t, found, "Proxies should not share in-flight requests")
+	_, found = singleflights.Load("shared-hash")
+	assert.False(t, found, "Proxies should not use the package level in-flight requests")
+}
+
+func TestProxyUsesClock(t *testing.T) {
+	proxy, _, closer := newTestProxy(t, "a")
+	defer closer()
+	now := time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+	proxy.SetClock(func() time.Time { return now })
+	recorder := httptest.NewRecorder()
+	recorder.WriteString("stale")
+	result := recorder.Result()
+	result.Request = httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	resp := proxy.Cacher().Standardize(result)
+	w := httptest.NewRecorder()
+	proxy.respondStale(w, result.Request, resp, "testing")
+	assert.Contains(t, w.Header().Get("Warning"), now.Format(time.RFC1123))
+}
+
+func TestProxyNegotiatesCompression(t *testing.T) {
+	page := strings.Repeat("<p>Hello, world</p>", 50)
+	proxy, closer := newHTMLProxy(t, page)
+	defer closer()
+
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		proxy.ServeHTTP(w, r)
+		return w
+	}
+	miss := request("gzip, br")
+	assert.Equal(t, "br", miss.Header().Get("Content-Encoding"), "The requester should get its preferred encoding")
+	decoded, err := ioutil.ReadAll(brotli.NewReader(miss.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, page, string(decoded))
+
+	hit := request("gzip")
+	assert.Equal(t, "HIT", hit.Header().Get("X-Honey-Cache"), "Every encoding should be served from the one cached response")
+	assert.Equal(t, "gzip", hit.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", hit.Header().Get("Vary"))
+
+	identity := request("")
+	assert.Equal(t, "HIT", identity.Header().Get("X-Honey-Cache"))
+	assert.Empty(t, identity.Header().Get("Content-Encoding"))
+	assert.Equal(t, page, identity.Body.String())
+}
+
+func TestProxySendsTransformedHeadersToTheFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "PHP")
+		fmt.Fprint(w, "page")
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	proxy.AddTransform(transform.Stage{Name: "header", Transformer: transform.HeaderFunc(func(r *http.Request, header http.Header) error {
+		header.Set("X-Transformed", "yes")
+		header.Del("X-Powered-By")
+		return nil
+	})})
+	for _, cached := range []string{"MISS", "HIT"} {
+		w := serve(proxy, "http://www.insomniac.com/page")
+		assert.Equal(t, cached, w.Header().Get("X-Honey-Cache"))
+		assert.Equal(t, "yes", w.Header().Get("X-Transformed"))
+		assert.Empty(t, w.Header().Get("X-Powered-By"))
+		assert.Equal(t, "page", w.Body.String())
+	}
+}
+
+func TestProxyTransformsForTheSiteHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<img src="http://www.insomniac.com/logo.png">`)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	proxy.AddTransform(transform.MixedContentStage(transform.MixedContentOptions{}))
+	w := serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, `<img src="https://www.insomniac.com/logo.png">`, w.Body.String(), "The site's host is the one the client asked for, not the backend's")
+}
@@ -2,6 +2,7 @@ package fetch
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -14,8 +15,11 @@ import (
 	"github.com/davidjwilkins/honey/cache"
 	"github.com/davidjwilkins/honey/singleflight"
 	"github.com/davidjwilkins/honey/utilities"
+	"github.com/vulcand/oxy/utils"
 )
 
+// singleflights holds the in-flight requests for the Proxy used by
+// Fetch and the package level functions, which predate Proxy.
 var singleflights sync.Map
 
 var staleWhileRevaldateFinder = regexp.MustCompile(`stale-while-revalidate=(?:\")?(\d+)(?:\")?(?:,|$)`)
@@ -28,57 +32,69 @@ var staleWhileRevaldateFinder = regexp.MustCompile(`stale-while-revalidate=(?:\"
 // has the same value as the response's Etag, and if so, will return a  301: Not Modified.
 // Otherwise, we will return the cached response, with an "X-Honey-Cache: HIT" header
 func RespondFromCache(c cache.Cacher, w http.ResponseWriter, r *http.Request) (hash string, responded bool, revalidate bool) {
+	return compatProxy(c, Options{}).respondFromCache(w, r)
+}
+
+// respondFromCache is RespondFromCache, but with stale-while-revalidate
+// windows decided by the Proxy's StalePolicies.
+func (p *Proxy) respondFromCache(w http.ResponseWriter, r *http.Request) (hash string, responded bool, revalidate bool) {
+	c := p.cacher
 	hash = c.Hash(r)
 	cc := r.Header.Get("Cache-Control")
-	if strings.Contains(cc, "no-cache") ||
-		r.Header.Get("Pragma") == "no-cache" {
+	noCache := strings.Contains(cc, "no-cache") ||
+		r.Header.Get("Pragma") == "no-cache"
+	resp, found := c.Load(hash, r)
+	// An immutable response won't change while it is fresh, so there is
+	// no point asking the backend for it again, even if the client does.
+	// https://tools.ietf.org/html/rfc8246
+	if !found || (noCache && !cache.HasDirective(resp.Header().Get("Cache-Control"), "immutable")) {
 		return hash, false, false
 	}
-	resp, found := c.Load(hash, r)
 	var statusCode int
-	if found && (strings.Contains(cc, "must-revalidate") ||
+	if noCache {
+		responded = true
+		statusCode = http.StatusNotModified
+	} else if strings.Contains(cc, "must-revalidate") ||
 		strings.Contains(cc, "proxy-revalidate") ||
-		strings.Contains(cc, "max-age")) {
+		strings.Contains(cc, "max-age") {
 		responded, statusCode = resp.Validate(r)
-		// https://tools.ietf.org/html/rfc5861#page-2
-		// If the response is not valid, but it has a "stale-while-revalidate"
-		// and we are within the timeframe specified, serve the stale content,
-		// and revalidate in background
-		if (!responded) && strings.Contains(cc, "stale-while-revalidate") {
-			age, err := strconv.Atoi(resp.Age())
-			maxAge, found := utilities.GetMaxAge(cc)
-			if !found {
-				maxAge = 0
-			}
-			if err == nil {
-				var staleOffset int
-				tmp := staleWhileRevaldateFinder.FindStringSubmatch(cc)
-				if len(tmp) == 2 {
-					staleOffset, err = strconv.Atoi(tmp[1])
-					if err == nil && maxAge+staleOffset > age {
-						revalidate = true
-						responded = true
-					}
-				}
-			}
-		}
 	} else {
-		responded = found
+		responded = true
 		statusCode = http.StatusNotModified
 	}
+	// The cached response's own freshness lifetime decides whether it
+	// can be served, not only the request's Cache-Control.  It may be
+	// stale if the request has max-stale.
+	var stale bool
 	if responded {
+		responded, stale = resp.Fresh(r)
+	}
+	// https://tools.ietf.org/html/rfc5861#page-2
+	// If the response is not valid, but it has a "stale-while-revalidate"
+	// and we are within the timeframe specified, serve the stale content,
+	// and revalidate in background
+	if !responded && !noCache && p.canServeWhileRevalidating(r, resp) {
+		revalidate = true
+		responded = true
+		// It isn't served because the client accepts stale responses
+		stale = false
+	}
+	if responded {
+		p.hint(w, r, resp)
 		for key, values := range resp.Header() {
-			for _, value := range values {
-				w.Header().Set(key, value)
-			}
+			w.Header()[key] = append([]string(nil), values...)
 		}
 		w.Header().Set("X-Honey-Cache", "HIT")
+		if stale {
+			setStaleHeaders(w.Header(), resp, "Client accepts stale responses", p.clock())
+		}
+		body := cache.Encode(w.Header(), resp, r.Header.Get("Accept-Encoding"))
 		if isNotModified(r, resp) {
 			w.WriteHeader(statusCode)
 			return
 		}
 		w.WriteHeader(resp.StatusCode())
-		w.Write(resp.Body())
+		w.Write(body)
 	}
 	return
 }
@@ -90,6 +106,11 @@ func RespondFromCache(c cache.Cacher, w http.ResponseWriter, r *http.Request) (h
 // It then writes the response to the singleflight, and deletes the key from the
 // singleflight list (because responses can now be handled from the cache).
 func FlushSingleflight(c cache.Cacher, done chan bool) func(*http.Response) error {
+	return compatProxy(c, DefaultOptions()).flushSingleflight(done)
+}
+
+func (p *Proxy) flushSingleflight(done chan bool) func(*http.Response) error {
+	c := p.cacher
 	// Any modifications made to the response headers should be made to r.Header
 	// and not to response.Header as the headers from r will be copied to response,
 	// but if they don't get set on r then they won't appear on the initial request
@@ -98,13 +119,19 @@ func FlushSingleflight(c cache.Cacher, done chan bool) func(*http.Response) erro
 			return nil
 		}
 		hash := c.Hash(r.Request)
-		m, found := singleflights.Load(hash)
+		m, found := p.singleflights.Load(hash)
 		if !found {
 			// TODO: handle this as it would be a serious error
 			return nil
 		}
 		multi := m.(singleflight.Singleflight)
 		response := c.Standardize(r)
+		standardized, original := cloneHeader(response.Header()), response.Body()
+		p.transforms.Apply(r.Request, response)
+		p.keepScript(hash, response, original)
+		// The requester which made the backend request gets r, so it
+		// needs what the transforms changed too
+		updateHeader(r.Header, standardized, response.Header())
 		cc := response.Header().Get("Cache-Control")
 		// no-store: https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.9.2
 		// and don't cache server errors
@@ -113,49 +140,43 @@ func FlushSingleflight(c cache.Cacher, done chan bool) func(*http.Response) erro
 		}
 		// if there was a server error, let's try and fetch a good response from the
 		// cache and set a warning header to indicate that we have served stale content,
-		// if there is a stale-if-error cache control
+		// if there is a stale-if-error cache control, or the breaker has opened
 		// https://tools.ietf.org/html/rfc5861#page-3
 		var serveStale bool
-		if response.StatusCode() >= 500 && strings.Contains(cc, "stale-if-error") {
-			var staleAge string
+		policy := p.stalePolicies(r.Request).IfError
+		if response.StatusCode() >= 500 && (policy.applies(cc, "stale-if-error") || p.breakerOpen()) {
 			prevResponse, found := c.Load(c.Hash(r.Request), r.Request)
-			if found {
-				tmp := staleIfErrorFinder.FindStringSubmatch(cc)
-				if len(tmp) == 2 {
-					staleAge = tmp[1]
-				}
-				// This isn't in the spec, but we're going to support a * as meaning to
-				// indefinitely serve from the cache if the backend response is invalid
-				serveStale = staleAge == "*"
-				if !serveStale && staleAge != "" {
-					maxage, exists := utilities.GetMaxAge(cc)
-					if exists {
-						age, err := strconv.Atoi(prevResponse.Age())
-						if err == nil {
-							staleMax, err := strconv.Atoi(staleAge)
-							if err == nil {
-								serveStale = (age - maxage) < staleMax
-							}
-						}
-					}
-				}
-				if serveStale {
-					errorCode := response.StatusCode()
-					response = prevResponse
-					// http://www.iana.org/assignments/http-warn-codes/http-warn-codes.xhtml
-					// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Warning
-					r.Header.Set("Warning", fmt.Sprintf(`110 Honey "Response is Stale" "%s"`, time.Now().Format(time.RFC1123)))
-					r.Header.Set("X-Honey-Cache", "STALE")
-					r.Header.Set("X-Honey-Stale", fmt.Sprintf("Backend gave HTTP Status %d", errorCode))
+			if found && (canServeStaleIfError(cc, prevResponse, policy) || p.breakerOpen()) {
+				serveStale = true
+				errorCode := response.StatusCode()
+				response = prevResponse
+				// the requester which made the backend request gets r, so it
+				// needs to become the stale response too
+				r.StatusCode = response.StatusCode()
+				r.Status = response.Status()
+				r.Header = http.Header{}
+				for key, values := range response.Header() {
+					r.Header[key] = append([]string(nil), values...)
 				}
+				// http://www.iana.org/assignments/http-warn-codes/http-warn-codes.xhtml
+				// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Warning
+				r.Header.Set("Warning", fmt.Sprintf(`110 Honey "Response is Stale" "%s"`, p.clock().Format(time.RFC1123)))
+				r.Header.Set("X-Honey-Cache", "STALE")
+				r.Header.Set("X-Honey-Stale", fmt.Sprintf("Backend gave HTTP Status %d", errorCode))
 			}
 		}
 		if !serveStale {
 			r.Header.Set("X-Honey-Cache", "MISS")
 		}
+		body := cache.Encode(r.Header, response, r.Request.Header.Get("Accept-Encoding"))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		if r.Header.Get("Content-Length") != "" {
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
 		go func() {
 			multi.Write(response)
-			singleflights.Delete(hash)
+			p.singleflights.Delete(hash)
 			if done != nil {
 				done <- true
 			}
@@ -173,26 +194,237 @@ func FlushSingleflight(c cache.Cacher, done chan bool) func(*http.Response) erro
 	}
 }
 
+// updateHeader makes the changes from before to after in dst.  Only
+// what has changed is copied, since dst may have headers which aren't
+// cached, like Set-Cookie.
+func updateHeader(dst, before, after http.Header) {
+	for key := range before {
+		if _, found := after[key]; !found {
+			dst.Del(key)
+		}
+	}
+	for key, values := range after {
+		if !equalValues(before[key], values) {
+			dst[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
 // RespondFromSingleflight will see if there is already a singleflight for the supplied hash.
 // If so, it will add ResponseWriter w to the singleflight, wait for the singleflight to response,
 // and then return true.  Otherwise, it will create a new singleflight for the hash, and return
-// false.
-func RespondFromSingleflight(hash string, c cache.Cacher, w http.ResponseWriter, r *http.Request, handler func(w http.ResponseWriter, r *http.Request)) (responded bool) {
+// false.  If the singleflight hasn't responded within opts.MaxCoalesceWait, it will fall back
+// to opts.CoalesceFallback - returning false if the request should be sent to the backend.
+func RespondFromSingleflight(hash string, c cache.Cacher, w http.ResponseWriter, r *http.Request, handler func(w http.ResponseWriter, r *http.Request), opts Options) (responded bool) {
+	return compatProxy(c, opts).respondFromSingleflight(hash, w, r, handler)
+}
+
+func (p *Proxy) respondFromSingleflight(hash string, w http.ResponseWriter, r *http.Request, handler func(w http.ResponseWriter, r *http.Request)) (responded bool) {
+	responded, _ = p.coalesce(hash, w, r, handler)
+	return responded
+}
+
+// coalesce is respondFromSingleflight, but it also returns whether r
+// is the leader - the request the new singleflight for hash is waiting
+// on - rather than one which gave up waiting on another.
+func (p *Proxy) coalesce(hash string, w http.ResponseWriter, r *http.Request, handler func(w http.ResponseWriter, r *http.Request)) (responded bool, leader bool) {
+	c, opts := p.cacher, p.options
 	multi := singleflight.NewSingleflight(c, r, handler)
-	m, fetching := singleflights.LoadOrStore(hash, multi)
-	if fetching {
-		multi = m.(singleflight.Singleflight)
-		multi.AddWriter(w, r)
-		multi.Wait()
-		singleflights.Delete(hash)
+	m, fetching := p.singleflights.LoadOrStore(hash, multi)
+	if !fetching {
+		return false, true
+	}
+	multi = m.(singleflight.Singleflight)
+	multi.AddWriter(w, r)
+	ctx := r.Context()
+	if opts.MaxCoalesceWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.MaxCoalesceWait)
+		defer cancel()
+	}
+	err := multi.WaitWriter(ctx, w)
+	switch {
+	case err == nil:
+		p.singleflights.Delete(hash)
+		return true, false
+	case err == singleflight.ErrUncacheable:
+		return false, false
+	case r.Context().Err() != nil:
+		// the client has gone away, so there is no one to respond to
+		return true, false
+	case err == errBreakerOpen:
+		// the breaker didn't let the request being waited on through
+		p.respondBreakerOpen(hash, w, r)
+		return true, false
+	case ctx.Err() == nil:
+		// the backend request failed, so there is no response to wait for
+		if resp, found := c.Load(hash, r); found && p.canServeStale(r, resp) {
+			p.respondStale(w, r, resp, "Backend request failed")
+			return true, false
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return true, false
+	}
+	switch opts.CoalesceFallback {
+	case CoalesceStale:
+		if resp, found := c.Load(hash, r); found {
+			p.respondStale(w, r, resp, "Timed out waiting for the backend")
+			return true, false
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return true, false
+	case CoalesceError:
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return true, false
+	}
+	return false, false
+}
+
+// FailSingleflight is a forward ErrorHandler - it is called instead of FlushSingleflight
+// when no response could be had from the backend at all (e.g. the connection was refused).
+// It fails the singleflight for the request, so that the requests multiplexed onto it
+// aren't left waiting for a response which will never come, and deletes it from the
+// singleflight list.  It responds with the cached response if stale-if-error allows
+// it, or an error otherwise.
+func FailSingleflight(c cache.Cacher) func(w http.ResponseWriter, r *http.Request, err error) {
+	return compatProxy(c, DefaultOptions()).failSingleflight
+}
+
+func (p *Proxy) failSingleflight(w http.ResponseWriter, r *http.Request, err error) {
+	hash := p.cacher.Hash(r)
+	p.fail(hash, err)
+	if resp, found := p.cacher.Load(hash, r); found && p.canServeStale(r, resp) {
+		p.respondStale(w, r, resp, "Backend request failed")
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, r, err)
+}
+
+// fail fails and deletes the singleflight for hash, if there is one.
+func (p *Proxy) fail(hash string, err error) {
+	if m, found := p.singleflights.Load(hash); found {
+		p.singleflights.Delete(hash)
+		m.(singleflight.Singleflight).Fail(err)
+	}
+}
+
+// canServeStale returns true if the cached response resp may be served
+// in place of an error from the backend for request r - because either
+// has stale-if-error (or the StalePolicy for r forces it), or because the
+// breaker is open.
+func (p *Proxy) canServeStale(r *http.Request, resp cache.Response) bool {
+	policy := p.stalePolicies(r).IfError
+	return p.breakerOpen() ||
+		canServeStaleIfError(resp.Header().Get("Cache-Control"), resp, policy) ||
+		canServeStaleIfError(r.Header.Get("Cache-Control"), resp, policy)
+}
+
+// canServeWhileRevalidating returns true if the cached response resp may
+// be served for request r while it is refreshed in the background -
+// because its stale-while-revalidate, or the request's, allows it (or the
+// StalePolicy for r forces it).
+func (p *Proxy) canServeWhileRevalidating(r *http.Request, resp cache.Response) bool {
+	policy := p.stalePolicies(r).WhileRevalidate
+	cc := resp.Header().Get("Cache-Control")
+	if policy.applies(cc, "stale-while-revalidate") {
+		if window, ok := policy.window(cc, staleWhileRevaldateFinder); ok &&
+			(window == StaleForever || cache.Staleness(resp) < window) {
+			return true
+		}
+	}
+	// The request's window is from the max-age it sent, rather than the
+	// response's own lifetime
+	cc = r.Header.Get("Cache-Control")
+	if !policy.applies(cc, "stale-while-revalidate") {
+		return false
+	}
+	window, ok := policy.window(cc, staleWhileRevaldateFinder)
+	if !ok {
+		return false
+	}
+	if window == StaleForever {
+		return true
+	}
+	maxAge, found := utilities.GetMaxAge(cc)
+	if !found {
+		maxAge = 0
+	}
+	age, err := strconv.Atoi(resp.Age())
+	return err == nil && maxAge+int(window/time.Second) > age
+}
+
+// canServeStaleIfError returns true if the stale-if-error directive in cc, as
+// adjusted by policy, allows the cached response to be served in place of an
+// error from the backend.
+// https://tools.ietf.org/html/rfc5861#page-3
+func canServeStaleIfError(cc string, resp cache.Response, policy StalePolicy) bool {
+	if !policy.applies(cc, "stale-if-error") {
+		return false
+	}
+	window, ok := policy.window(cc, staleIfErrorFinder)
+	if !ok {
+		return false
+	}
+	if window == StaleForever {
 		return true
 	}
-	return false
+	maxage, exists := utilities.GetMaxAge(cc)
+	if !exists {
+		maxage = 0
+	}
+	age, err := strconv.Atoi(resp.Age())
+	if err != nil {
+		return false
+	}
+	return (age - maxage) < int(window/time.Second)
+}
+
+// respondStale writes a cached response which is known to be stale,
+// with a Warning header to indicate it, and the reason in X-Honey-Stale.
+func (p *Proxy) respondStale(w http.ResponseWriter, r *http.Request, resp cache.Response, reason string) {
+	for key, values := range resp.Header() {
+		for _, value := range values {
+			w.Header().Set(key, value)
+		}
+	}
+	setStaleHeaders(w.Header(), resp, reason, p.clock())
+	body := cache.Encode(w.Header(), resp, r.Header.Get("Accept-Encoding"))
+	w.WriteHeader(resp.StatusCode())
+	w.Write(body)
+}
+
+// setStaleHeaders sets the headers which mark a response as stale
+// in h - a Warning, its Age, and the reason in X-Honey-Stale.
+func setStaleHeaders(h http.Header, resp cache.Response, reason string, now time.Time) {
+	// http://www.iana.org/assignments/http-warn-codes/http-warn-codes.xhtml
+	h.Set("Warning", fmt.Sprintf(`110 Honey "Response is Stale" "%s"`, now.Format(time.RFC1123)))
+	h.Set("X-Honey-Cache", "STALE")
+	h.Set("X-Honey-Stale", reason)
+	h.Set("Age", resp.Age())
 }
 
 func isNotModified(r *http.Request, resp cache.Response) bool {
-	return r.Header.Get("If-None-Match") != "" &&
-		r.Header.Get("If-None-Match") == resp.Header().Get("Etag")
+	return cache.MatchEtag(r.Header.Get("If-None-Match"), resp.Header().Get("Etag"))
 }
 
 func canRespondWithoutBody(req *http.Request) bool {
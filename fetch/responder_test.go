@@ -2,12 +2,16 @@ package fetch
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/singleflight"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
@@ -26,6 +30,11 @@ func (t *testCacher) Hash(r *http.Request) string {
 	return args.String(0)
 }
 
+func (t *testCacher) Variant(r *http.Request, vary string) string {
+	args := t.Called(r, vary)
+	return args.String(0)
+}
+
 func (t *testCacher) Standardize(r *http.Response) cache.Response {
 	args := t.Called(r)
 	return args.Get(0).(cache.Response)
@@ -77,6 +86,11 @@ func (t *testResponse) Validate(r *http.Request) (bool, int) {
 	return args.Bool(0), args.Int(1)
 }
 
+func (t *testResponse) Fresh(r *http.Request) (bool, bool) {
+	args := t.Called(r)
+	return args.Bool(0), args.Bool(1)
+}
+
 func (t *testResponse) Age() string {
 	args := t.Called()
 	return args.String(0)
@@ -108,6 +122,15 @@ func (t *testSingleflight) Wait() {
 	t.Called()
 }
 
+func (t *testSingleflight) Fail(err error) {
+	t.Called(err)
+}
+
+func (t *testSingleflight) WaitWriter(ctx context.Context, w http.ResponseWriter) error {
+	args := t.Called(ctx, w)
+	return args.Error(0)
+}
+
 type ResponderTestSuite struct {
 	suite.Suite
 	cacher       *testCacher
@@ -150,6 +173,7 @@ func (suite *ResponderTestSuite) SetupTest() {
 	suite.singleflight.On("Done")
 	suite.singleflight.On("Wait")
 	suite.response.On("Header").Return(suite.writer.Header())
+	suite.response.On("Fresh", suite.request).Return(true, false)
 	suite.httpResponse = newResponse()
 }
 
@@ -174,6 +198,55 @@ func (suite *ResponderTestSuite) TestRespondFromPopulatedCache() {
 	suite.Assert().True(responded, "RespondFromCache should return true when responded")
 }
 
+func (suite *ResponderTestSuite) TestRespondFromCacheExpiredResponse() {
+	expired := &testResponse{}
+	expired.On("Fresh", suite.request).Return(false, true)
+	expired.On("Header").Return(http.Header{"Cache-Control": []string{"public, max-age=60"}})
+	expired.On("Age").Return("90")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(expired, true)
+	_, responded, _ := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().False(responded, "RespondFromCache should not respond with a response past its freshness lifetime")
+	suite.Assert().Equal("", suite.writer.Header().Get("X-Honey-Cache"))
+}
+
+func (suite *ResponderTestSuite) TestRespondFromCacheMaxStale() {
+	stale := &testResponse{}
+	stale.On("Fresh", suite.request).Return(true, true)
+	stale.On("Header").Return(http.Header{"Cache-Control": []string{"public, max-age=60"}})
+	stale.On("Age").Return("90")
+	stale.On("StatusCode").Return(http.StatusOK)
+	stale.On("Body").Return([]byte("Test Response"))
+	suite.cacher.On("Load", "test-hash", suite.request).Return(stale, true)
+	suite.request.Header.Set("Cache-Control", "max-stale")
+	_, responded, _ := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().True(responded, "RespondFromCache should respond with a stale response the client accepts")
+	suite.Assert().Equal("STALE", suite.writer.Header().Get("X-Honey-Cache"))
+	suite.Assert().Contains(suite.writer.Header().Get("Warning"), "110")
+	suite.Assert().Equal("90", suite.writer.Header().Get("Age"))
+}
+
+func (suite *ResponderTestSuite) TestRespondFromCacheNoCache() {
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, true)
+	suite.request.Header.Set("Cache-Control", "no-cache")
+	_, responded, _ := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().False(responded, "RespondFromCache should not respond to a no-cache request")
+}
+
+func (suite *ResponderTestSuite) TestRespondFromCacheNoCacheImmutable() {
+	immutable := &testResponse{}
+	immutable.On("Fresh", suite.request).Return(true, false)
+	immutable.On("Header").Return(http.Header{"Cache-Control": []string{"public, max-age=31536000, immutable"}})
+	immutable.On("StatusCode").Return(http.StatusOK)
+	immutable.On("Body").Return([]byte("Test Response"))
+	suite.cacher.On("Load", "test-hash", suite.request).Return(immutable, true)
+	suite.request.Header.Set("Cache-Control", "no-cache")
+	suite.request.Header.Set("Pragma", "no-cache")
+	_, responded, _ := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().True(responded, "RespondFromCache should respond to a no-cache request with a fresh immutable response")
+	suite.Assert().Equal("HIT", suite.writer.Header().Get("X-Honey-Cache"))
+	suite.Assert().Equal("Test Response", suite.writer.Body.String())
+}
+
 func (suite *ResponderTestSuite) TestRespondFromCacheMustRevalidateValid() {
 	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, true)
 	suite.request.Header.Set("Cache-Control", "must-revalidate")
@@ -206,6 +279,31 @@ func (suite *ResponderTestSuite) TestRespondFromCacheMustRevalidateInvalidStaleW
 	suite.Assert().True(revalidate, "RespondFromCache should return revalidate:true when cache doesn't validate but should serve stale")
 }
 
+func (suite *ResponderTestSuite) TestRespondFromCacheResponseStaleWhileRevalidate() {
+	stale := &testResponse{}
+	stale.On("Fresh", suite.request).Return(false, true)
+	stale.On("Header").Return(http.Header{"Cache-Control": []string{"max-age=1, stale-while-revalidate=600"}})
+	stale.On("Age").Return("80")
+	stale.On("StatusCode").Return(http.StatusOK)
+	stale.On("Body").Return([]byte("Test Response"))
+	suite.cacher.On("Load", "test-hash", suite.request).Return(stale, true)
+	_, responded, revalidate := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().True(responded, "RespondFromCache should serve a response whose own stale-while-revalidate allows it")
+	suite.Assert().True(revalidate)
+	suite.Assert().Equal("Test Response", suite.writer.Body.String())
+}
+
+func (suite *ResponderTestSuite) TestRespondFromCacheResponseStaleWhileRevalidateExpired() {
+	stale := &testResponse{}
+	stale.On("Fresh", suite.request).Return(false, true)
+	stale.On("Header").Return(http.Header{"Cache-Control": []string{"max-age=1, stale-while-revalidate=60"}})
+	stale.On("Age").Return("80")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(stale, true)
+	_, responded, revalidate := RespondFromCache(suite.cacher, suite.writer, suite.request)
+	suite.Assert().False(responded, "RespondFromCache should not serve a response stale for longer than its stale-while-revalidate")
+	suite.Assert().False(revalidate)
+}
+
 func (suite *ResponderTestSuite) TestRespondFromCacheProxyRevalidateValid() {
 	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, true)
 	suite.request.Header.Set("Cache-Control", "proxy-revalidate")
@@ -321,14 +419,111 @@ func noopHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (suite *ResponderTestSuite) TestRespondFromSingleflightInitialRequest() {
-	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler)
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, DefaultOptions())
 	suite.Assert().False(found, "Respond from singleflight should return false on first request")
 }
 
 func (suite *ResponderTestSuite) TestRespondFromSingleflightMultiplexedRequests() {
 	suite.singleflight.On("AddWriter", suite.writer, suite.request)
-	suite.singleflight.On("Wait")
+	suite.singleflight.On("WaitWriter", mock.Anything, suite.writer).Return(nil)
 	singleflights.Store("test-hash", suite.singleflight)
-	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler)
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, DefaultOptions())
 	suite.Assert().True(found, "Respond from singleflight should return true on second request")
 }
+
+func (suite *ResponderTestSuite) TestRespondFromSingleflightTimeoutFetches() {
+	singleflights.Store("test-hash", singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler))
+	defer singleflights.Delete("test-hash")
+	opts := Options{MaxCoalesceWait: time.Millisecond, CoalesceFallback: CoalesceFetch}
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, opts)
+	suite.Assert().False(found, "Respond from singleflight should return false so the request is sent to the backend after timing out")
+}
+
+func (suite *ResponderTestSuite) TestRespondFromSingleflightTimeoutError() {
+	singleflights.Store("test-hash", singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler))
+	defer singleflights.Delete("test-hash")
+	opts := Options{MaxCoalesceWait: time.Millisecond, CoalesceFallback: CoalesceError}
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, opts)
+	suite.Assert().True(found)
+	suite.Assert().Equal(http.StatusGatewayTimeout, suite.writer.Code, "A multiplexed request should get a 504 after timing out")
+}
+
+func (suite *ResponderTestSuite) TestRespondFromSingleflightTimeoutStale() {
+	singleflights.Store("test-hash", singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler))
+	defer singleflights.Delete("test-hash")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, true)
+	suite.response.On("StatusCode").Return(http.StatusOK)
+	suite.response.On("Age").Return("500")
+	opts := Options{MaxCoalesceWait: time.Millisecond, CoalesceFallback: CoalesceStale}
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, opts)
+	suite.Assert().True(found)
+	suite.Assert().Equal("STALE", suite.writer.Header().Get("X-Honey-Cache"), "A multiplexed request should get stale content after timing out")
+	suite.Assert().Equal("Test Response", suite.writer.Body.String())
+}
+
+func (suite *ResponderTestSuite) TestRespondFromSingleflightTimeoutStaleNotCached() {
+	singleflights.Store("test-hash", singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler))
+	defer singleflights.Delete("test-hash")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, false)
+	opts := Options{MaxCoalesceWait: time.Millisecond, CoalesceFallback: CoalesceStale}
+	found := RespondFromSingleflight("test-hash", suite.cacher, suite.writer, suite.request, noopHandler, opts)
+	suite.Assert().True(found)
+	suite.Assert().Equal(http.StatusGatewayTimeout, suite.writer.Code, "A multiplexed request should get a 504 after timing out if there is nothing cached")
+}
+
+func (suite *ResponderTestSuite) TestFailSingleflightReleasesMultiplexedRequests() {
+	multi := singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler)
+	singleflights.Store("test-hash", multi)
+	defer singleflights.Delete("test-hash")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, false)
+	waiter := httptest.NewRecorder()
+	failed := make(chan bool)
+	go func() {
+		// give the request time to be multiplexed before failing
+		time.Sleep(10 * time.Millisecond)
+		FailSingleflight(suite.cacher)(suite.writer, suite.request, errors.New("connection refused"))
+		failed <- true
+	}()
+	responded := RespondFromSingleflight("test-hash", suite.cacher, waiter, suite.request, noopHandler, Options{})
+	<-failed
+	suite.Assert().True(responded, "A multiplexed request should be responded to when the backend request fails")
+	suite.Assert().Equal(http.StatusBadGateway, waiter.Code, "A multiplexed request should get a 502 when the backend request fails")
+	suite.Assert().Equal(http.StatusInternalServerError, suite.writer.Code, "The request sent to the backend should get an error when it fails")
+	_, found := singleflights.Load("test-hash")
+	suite.Assert().False(found, "The singleflight should be deleted when the backend request fails")
+}
+
+func (suite *ResponderTestSuite) TestFailSingleflightServesStaleIfError() {
+	singleflights.Store("test-hash", singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler))
+	defer singleflights.Delete("test-hash")
+	suite.cacher.On("Load", "test-hash", suite.request).Return(suite.response, true)
+	suite.response.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+	suite.response.On("Age").Return("120")
+	suite.response.On("StatusCode").Return(http.StatusOK)
+	FailSingleflight(suite.cacher)(suite.writer, suite.request, errors.New("connection refused"))
+	suite.Assert().Equal(http.StatusOK, suite.writer.Code)
+	suite.Assert().Equal("STALE", suite.writer.Header().Get("X-Honey-Cache"), "The cached response should be served if stale-if-error allows it")
+}
+
+func (suite *ResponderTestSuite) TestSingleflightTransportFailsSingleflight() {
+	multi := singleflight.NewSingleflight(suite.cacher, newTestValidRequest(), noopHandler)
+	singleflights.Store("test-hash", multi)
+	defer singleflights.Delete("test-hash")
+	transport := &singleflightTransport{
+		proxy: compatProxy(suite.cacher, DefaultOptions()),
+		RoundTripper: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}),
+	}
+	_, err := transport.RoundTrip(suite.request)
+	suite.Assert().Error(err)
+	_, found := singleflights.Load("test-hash")
+	suite.Assert().False(found, "The singleflight should be deleted when the backend can't be reached")
+	suite.Assert().Error(multi.WaitWriter(context.Background(), suite.writer), "The singleflight should be failed when the backend can't be reached")
+}
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,122 @@
+package fetch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RevalidateOptions control the background revalidation of stale
+// responses served because of stale-while-revalidate.
+type RevalidateOptions struct {
+	// Workers is how many revalidations may run at once
+	Workers int
+	// Queue is how many revalidations may wait for a worker.  Any
+	// more are dropped, and tried again the next time the stale
+	// response is served.
+	Queue int
+	// Timeout is how long a revalidation may take.  If it is 0,
+	// there is no limit.
+	Timeout time.Duration
+}
+
+// DefaultRevalidateOptions returns RevalidateOptions with 4 workers,
+// a queue of 256, and a timeout of 30 seconds.
+func DefaultRevalidateOptions() RevalidateOptions {
+	return RevalidateOptions{
+		Workers: 4,
+		Queue:   256,
+		Timeout: 30 * time.Second,
+	}
+}
+
+type revalidation struct {
+	key string
+	fn  func(ctx context.Context)
+}
+
+// A Revalidator runs revalidations in the background, with its own
+// context rather than that of the request which found the response
+// stale, so that the client gets the stale response immediately.
+// Only one revalidation for a key is queued or run at a time.
+type Revalidator struct {
+	options RevalidateOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+	queue   chan revalidation
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// NewRevalidator returns a Revalidator, and starts its workers.
+func NewRevalidator(opts RevalidateOptions) *Revalidator {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rv := &Revalidator{
+		options: opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		queue:   make(chan revalidation, opts.Queue),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		rv.wg.Add(1)
+		go rv.work()
+	}
+	return rv
+}
+
+// Revalidate queues fn to be run for key, unless a revalidation for
+// key is already queued or running, or the queue is full.  It returns
+// whether fn was queued.
+func (rv *Revalidator) Revalidate(key string, fn func(ctx context.Context)) bool {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.pending[key] || rv.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case rv.queue <- revalidation{key: key, fn: fn}:
+		rv.pending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Close cancels any running revalidations, and stops the workers.
+func (rv *Revalidator) Close() {
+	rv.cancel()
+	rv.wg.Wait()
+}
+
+func (rv *Revalidator) work() {
+	defer rv.wg.Done()
+	for {
+		select {
+		case <-rv.ctx.Done():
+			return
+		case job := <-rv.queue:
+			rv.run(job)
+		}
+	}
+}
+
+func (rv *Revalidator) run(job revalidation) {
+	defer func() {
+		rv.mu.Lock()
+		delete(rv.pending, job.key)
+		rv.mu.Unlock()
+	}()
+	ctx := rv.ctx
+	if rv.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rv.options.Timeout)
+		defer cancel()
+	}
+	job.fn(ctx)
+}
@@ -0,0 +1,185 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidatorDeduplicatesKeys(t *testing.T) {
+	rv := NewRevalidator(RevalidateOptions{Workers: 1, Queue: 4})
+	defer rv.Close()
+	release := make(chan struct{})
+	var runs int32
+	fn := func(ctx context.Context) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+	}
+	assert.True(t, rv.Revalidate("a", fn))
+	assert.False(t, rv.Revalidate("a", fn), "A key which is already queued should not be queued again")
+	assert.True(t, rv.Revalidate("b", fn))
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt32(&runs) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+}
+
+func TestRevalidatorDropsWhenQueueIsFull(t *testing.T) {
+	rv := NewRevalidator(RevalidateOptions{Workers: 1, Queue: 1})
+	defer rv.Close()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	assert.True(t, rv.Revalidate("a", func(ctx context.Context) {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.True(t, rv.Revalidate("b", func(ctx context.Context) {}))
+	assert.False(t, rv.Revalidate("c", func(ctx context.Context) {}), "Revalidations should be dropped when the queue is full")
+}
+
+func TestRevalidatorContext(t *testing.T) {
+	rv := NewRevalidator(RevalidateOptions{Workers: 1, Queue: 1, Timeout: 10 * time.Millisecond})
+	done := make(chan error)
+	rv.Revalidate("a", func(ctx context.Context) {
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	assert.Equal(t, context.DeadlineExceeded, <-done, "Revalidations should time out")
+	rv.Close()
+	assert.False(t, rv.Revalidate("b", func(ctx context.Context) {}), "A closed Revalidator should not queue revalidations")
+}
+
+func TestProxyRevalidatesInBackground(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if n > 1 {
+			<-release
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	assert.Equal(t, "1", serve(proxy, "http://www.insomniac.com/page").Body.String())
+	waitForSingleflights(proxy)
+
+	stale := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+		r.Header.Set("Cache-Control", "must-revalidate, max-age=0, stale-while-revalidate=60")
+		proxy.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		// The backend is blocked, so these would hang if the refresh
+		// were done in the request
+		w := stale()
+		assert.Equal(t, "1", w.Body.String())
+		assert.Equal(t, "HIT", w.Header().Get("X-Honey-Cache"))
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&requests) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "Only one refresh per key should run at a time")
+	close(release)
+	for i := 0; i < 100 && stale().Body.String() == "1"; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "2", serve(proxy, "http://www.insomniac.com/page").Body.String(), "The stale response should have been refreshed")
+}
+
+func TestProxyRevalidationIsNotConditional(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if n > 1 {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprint(w, "page")
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	first := serve(proxy, "http://www.insomniac.com/page")
+	waitForSingleflights(proxy)
+
+	// A client which has the page triggers the refresh
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/page", nil)
+	r.Header.Set("Cache-Control", "must-revalidate, max-age=0, stale-while-revalidate=60")
+	r.Header.Set("If-None-Match", first.Header().Get("Etag"))
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	for i := 0; i < 100 && atomic.LoadInt32(&requests) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	waitForSingleflights(proxy)
+
+	w = serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, http.StatusOK, w.Code, "The cached response shouldn't be the 304 of the client which triggered the refresh")
+	assert.Equal(t, "page", w.Body.String())
+}
+
+func TestProxyRevalidatesWithResponseStaleWhileRevalidate(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		// The Age makes it stale already
+		w.Header().Set("Age", "30")
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=600")
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	assert.Equal(t, "1", serve(proxy, "http://www.insomniac.com/page").Body.String())
+	waitForSingleflights(proxy)
+
+	w := serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, "1", w.Body.String(), "The origin's stale-while-revalidate should serve the stale response")
+	assert.Equal(t, "HIT", w.Header().Get("X-Honey-Cache"))
+	for i := 0; i < 100 && atomic.LoadInt32(&requests) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "The stale response should be refreshed in the background")
+}
+
+func TestProxyDoesNotRevalidatePastResponseStaleWhileRevalidate(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Age", "30")
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer server.Close()
+	backend, _ := url.Parse(server.URL)
+	proxy := NewProxy(cache.NewDefaultCacher(), backend, DefaultOptions())
+	defer proxy.Close()
+	assert.Equal(t, "1", serve(proxy, "http://www.insomniac.com/page").Body.String())
+	waitForSingleflights(proxy)
+
+	w := serve(proxy, "http://www.insomniac.com/page")
+	assert.Equal(t, "2", w.Body.String(), "A response stale for longer than its stale-while-revalidate should be fetched again")
+	assert.Equal(t, "MISS", w.Header().Get("X-Honey-Cache"))
+}
@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sites is an http.Handler which sends each request to the handler
+// for its Host, so several sites can be served - each with their own
+// backend and cache - from one process.  Hosts may be exact, like
+// www.example.com, or wildcards like *.example.com, which match any
+// subdomain of example.com (but not example.com itself).  Requests
+// for a host which doesn't match any site are sent to the default
+// handler, or rejected with a 421 Misdirected Request if there
+// isn't one.
+type Sites struct {
+	mu        sync.RWMutex
+	hosts     map[string]http.Handler
+	wildcards map[string]http.Handler
+	fallback  http.Handler
+	closers   []func()
+}
+
+// NewSites returns a Sites with no hosts, which rejects every request.
+func NewSites() *Sites {
+	return &Sites{
+		hosts:     make(map[string]http.Handler),
+		wildcards: make(map[string]http.Handler),
+	}
+}
+
+// Add sends requests for host to handler.  If host starts with *.
+// it matches any subdomain of the rest of it.  The most specific
+// match wins, so www.example.com beats *.example.com, which beats *.com.
+func (s *Sites) Add(host string, handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host = normalizeHost(host)
+	if strings.HasPrefix(host, "*.") {
+		s.wildcards[host[1:]] = handler
+	} else {
+		s.hosts[host] = handler
+	}
+}
+
+// SetDefault sends requests for hosts which don't match any site
+// to handler.  If it is nil, they are rejected.
+func (s *Sites) SetDefault(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = handler
+}
+
+// Handler returns the handler requests for host are sent to, and
+// whether one was found.  It does not return the default handler.
+func (s *Sites) Handler(host string) (http.Handler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	host = normalizeHost(host)
+	if handler, found := s.hosts[host]; found {
+		return handler, true
+	}
+	// Check .b.example.com, then .example.com, then .com
+	for i := strings.Index(host, "."); i >= 0; {
+		if handler, found := s.wildcards[host[i:]]; found {
+			return handler, true
+		}
+		next := strings.Index(host[i+1:], ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, false
+}
+
+// OnClose adds f to the functions called by Close, e.g. to stop
+// what the handlers run in the background.
+func (s *Sites) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, f)
+}
+
+// Close calls the functions added with OnClose, once each.
+func (s *Sites) Close() {
+	s.mu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+	for _, f := range closers {
+		f()
+	}
+}
+
+// ServeHTTP sends r to the handler for its Host.
+func (s *Sites) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	handler, found := s.Handler(host)
+	if !found {
+		s.mu.RLock()
+		handler = s.fallback
+		s.mu.RUnlock()
+	}
+	if handler == nil {
+		w.Header().Set("X-Honey-Cache", "NO-CACHE")
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// normalizeHost lower-cases host, and removes the port and any
+// trailing dot from it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,68 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func siteHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	})
+}
+
+func serveHost(s *Sites, host string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = host
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestSitesRoutesByHost(t *testing.T) {
+	sites := NewSites()
+	sites.Add("www.insomniac.com", siteHandler("insomniac"))
+	sites.Add("www.nightowls.com", siteHandler("nightowls"))
+	assert.Equal(t, "insomniac", serveHost(sites, "www.insomniac.com").Body.String())
+	assert.Equal(t, "nightowls", serveHost(sites, "WWW.NightOwls.com:8080").Body.String())
+}
+
+func TestSitesRoutesWildcardSubdomains(t *testing.T) {
+	sites := NewSites()
+	sites.Add("*.insomniac.com", siteHandler("wildcard"))
+	sites.Add("*.edc.insomniac.com", siteHandler("edc"))
+	sites.Add("www.insomniac.com", siteHandler("www"))
+	assert.Equal(t, "www", serveHost(sites, "www.insomniac.com").Body.String())
+	assert.Equal(t, "wildcard", serveHost(sites, "shop.insomniac.com").Body.String())
+	assert.Equal(t, "edc", serveHost(sites, "lv.edc.insomniac.com").Body.String())
+	assert.Equal(t, "wildcard", serveHost(sites, "edc.insomniac.com").Body.String())
+	_, found := sites.Handler("insomniac.com")
+	assert.False(t, found, "A wildcard should not match the domain itself")
+}
+
+func TestSitesRejectsUnknownHosts(t *testing.T) {
+	sites := NewSites()
+	sites.Add("www.insomniac.com", siteHandler("insomniac"))
+	w := serveHost(sites, "www.example.com")
+	assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+}
+
+func TestSitesSendsUnknownHostsToDefault(t *testing.T) {
+	sites := NewSites()
+	sites.Add("www.insomniac.com", siteHandler("insomniac"))
+	sites.SetDefault(siteHandler("default"))
+	assert.Equal(t, "default", serveHost(sites, "www.example.com").Body.String())
+}
+
+func TestSitesCloseCallsOnCloseOnce(t *testing.T) {
+	sites := NewSites()
+	closed := 0
+	sites.OnClose(func() { closed++ })
+	sites.OnClose(func() { closed++ })
+	sites.Close()
+	sites.Close()
+	assert.Equal(t, 2, closed)
+}
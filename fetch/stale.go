@@ -0,0 +1,130 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaleForever is a window in which a stale response may always be
+// served.  It is what stale-if-error=* means.
+const StaleForever time.Duration = -1
+
+// A StaleMode decides how a StalePolicy treats the stale-if-error
+// or stale-while-revalidate directive from Cache-Control.
+type StaleMode int
+
+const (
+	// StaleRespect uses the directive if it is present
+	StaleRespect StaleMode = iota
+	// StaleForce acts as if the directive were present with the
+	// policy's Window, if it isn't
+	StaleForce
+	// StaleCap uses the directive if it is present, but no
+	// longer than the policy's Window
+	StaleCap
+	// StaleIgnore acts as if the directive weren't present
+	StaleIgnore
+)
+
+// ParseStaleMode returns the StaleMode named respect, force,
+// cap or ignore.
+func ParseStaleMode(name string) (StaleMode, error) {
+	switch name {
+	case "", "respect":
+		return StaleRespect, nil
+	case "force":
+		return StaleForce, nil
+	case "cap":
+		return StaleCap, nil
+	case "ignore":
+		return StaleIgnore, nil
+	}
+	return StaleRespect, errors.New("fetch: unknown stale mode " + name)
+}
+
+// A StalePolicy decides for how long after it has expired a response
+// may be served stale.  A Window of StaleForever has no limit.
+type StalePolicy struct {
+	Mode   StaleMode
+	Window time.Duration
+}
+
+// StalePolicies are the StalePolicy for stale-if-error, and the one
+// for stale-while-revalidate.  The zero value respects both.
+type StalePolicies struct {
+	IfError         StalePolicy
+	WhileRevalidate StalePolicy
+}
+
+type staleRoute struct {
+	match    *regexp.Regexp
+	policies StalePolicies
+}
+
+// applies returns whether the policy might allow a stale response to
+// be served, given the Cache-Control cc, which may have the directive.
+func (s StalePolicy) applies(cc, directive string) bool {
+	switch s.Mode {
+	case StaleIgnore:
+		return false
+	case StaleForce:
+		return true
+	}
+	return strings.Contains(cc, directive)
+}
+
+// window returns how long after it has expired a response may be
+// served stale, given the Cache-Control cc, and whether it may be
+// at all.  finder matches the directive's value in cc.
+func (s StalePolicy) window(cc string, finder *regexp.Regexp) (time.Duration, bool) {
+	var window time.Duration
+	var found bool
+	if tmp := finder.FindStringSubmatch(cc); len(tmp) == 2 {
+		// This isn't in the spec, but we're going to support a * as meaning to
+		// indefinitely serve from the cache
+		if strings.HasPrefix(tmp[1], "*") {
+			window, found = StaleForever, true
+		} else if seconds, err := strconv.Atoi(tmp[1]); err == nil {
+			window, found = time.Duration(seconds)*time.Second, true
+		}
+	}
+	switch s.Mode {
+	case StaleIgnore:
+		return 0, false
+	case StaleForce:
+		if !found {
+			return s.Window, true
+		}
+	case StaleCap:
+		if found && s.Window != StaleForever && (window == StaleForever || window > s.Window) {
+			return s.Window, true
+		}
+	}
+	return window, found
+}
+
+// SetStalePolicies sets the StalePolicies for requests which don't
+// match a route added with AddStaleRoute.
+func (p *Proxy) SetStalePolicies(policies StalePolicies) {
+	p.options.Stale = policies
+}
+
+// AddStaleRoute sets the StalePolicies for requests whose path
+// matches match.  Routes are checked in the order they were added.
+func (p *Proxy) AddStaleRoute(match *regexp.Regexp, policies StalePolicies) {
+	p.staleRoutes = append(p.staleRoutes, staleRoute{match: match, policies: policies})
+}
+
+// stalePolicies returns the StalePolicies for request r.
+func (p *Proxy) stalePolicies(r *http.Request) StalePolicies {
+	for _, route := range p.staleRoutes {
+		if route.match.MatchString(r.URL.Path) {
+			return route.policies
+		}
+	}
+	return p.options.Stale
+}
@@ -0,0 +1,88 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStalePolicyWindow(t *testing.T) {
+	tests := []struct {
+		policy StalePolicy
+		cc     string
+		window time.Duration
+		ok     bool
+	}{
+		{StalePolicy{}, "max-age=60, stale-if-error=600", 600 * time.Second, true},
+		{StalePolicy{}, "max-age=60", 0, false},
+		{StalePolicy{}, "max-age=60, stale-if-error=*", StaleForever, true},
+		{StalePolicy{Mode: StaleForce, Window: time.Minute}, "max-age=60", time.Minute, true},
+		{StalePolicy{Mode: StaleForce, Window: time.Minute}, "stale-if-error=600", 600 * time.Second, true},
+		{StalePolicy{Mode: StaleCap, Window: time.Minute}, "stale-if-error=600", time.Minute, true},
+		{StalePolicy{Mode: StaleCap, Window: time.Minute}, "stale-if-error=*", time.Minute, true},
+		{StalePolicy{Mode: StaleCap, Window: time.Minute}, "stale-if-error=30", 30 * time.Second, true},
+		{StalePolicy{Mode: StaleCap, Window: time.Minute}, "max-age=60", 0, false},
+		{StalePolicy{Mode: StaleIgnore}, "stale-if-error=600", 0, false},
+	}
+	for _, test := range tests {
+		window, ok := test.policy.window(test.cc, staleIfErrorFinder)
+		assert.Equal(t, test.window, window, "%+v with %q", test.policy, test.cc)
+		assert.Equal(t, test.ok, ok, "%+v with %q", test.policy, test.cc)
+	}
+}
+
+func TestParseStaleMode(t *testing.T) {
+	for name, mode := range map[string]StaleMode{"": StaleRespect, "respect": StaleRespect, "force": StaleForce, "cap": StaleCap, "ignore": StaleIgnore} {
+		parsed, err := ParseStaleMode(name)
+		assert.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseStaleMode("always")
+	assert.Error(t, err)
+}
+
+func TestCanServeStaleIfErrorPolicy(t *testing.T) {
+	resp := &testResponse{}
+	resp.On("Age").Return("120")
+	assert.True(t, canServeStaleIfError("max-age=60, stale-if-error=600", resp, StalePolicy{}))
+	assert.False(t, canServeStaleIfError("max-age=60", resp, StalePolicy{}))
+	assert.True(t, canServeStaleIfError("max-age=60", resp, StalePolicy{Mode: StaleForce, Window: 10 * time.Minute}), "A forced stale-if-error should be used without the directive")
+	assert.False(t, canServeStaleIfError("max-age=60, stale-if-error=600", resp, StalePolicy{Mode: StaleCap, Window: 30 * time.Second}), "A capped stale-if-error should not be used after the cap")
+	assert.False(t, canServeStaleIfError("max-age=60, stale-if-error=600", resp, StalePolicy{Mode: StaleIgnore}), "An ignored stale-if-error should not be used")
+}
+
+func TestRespondFromCacheForcedStaleWhileRevalidate(t *testing.T) {
+	c := &testCacher{}
+	resp := &testResponse{}
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	r.Header.Set("Cache-Control", "max-age=60")
+	c.On("Hash", r).Return("test-hash")
+	c.On("Load", "test-hash", r).Return(resp, true)
+	resp.On("Validate", r).Return(false, 0)
+	resp.On("Age").Return("80")
+	resp.On("Header").Return(http.Header{})
+	resp.On("StatusCode").Return(http.StatusOK)
+	resp.On("Body").Return([]byte("stale"))
+	_, responded, revalidate := compatProxy(c, Options{}).respondFromCache(httptest.NewRecorder(), r)
+	assert.False(t, responded, "Without stale-while-revalidate the stale response should not be served")
+	assert.False(t, revalidate)
+	policies := StalePolicies{WhileRevalidate: StalePolicy{Mode: StaleForce, Window: time.Minute}}
+	_, responded, revalidate = compatProxy(c, Options{Stale: policies}).respondFromCache(httptest.NewRecorder(), r)
+	assert.True(t, responded, "A forced stale-while-revalidate should serve the stale response")
+	assert.True(t, revalidate)
+	r.Header.Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+	policies = StalePolicies{WhileRevalidate: StalePolicy{Mode: StaleIgnore}}
+	_, responded, _ = compatProxy(c, Options{Stale: policies}).respondFromCache(httptest.NewRecorder(), r)
+	assert.False(t, responded, "An ignored stale-while-revalidate should not serve the stale response")
+}
+
+func TestProxyStaleRoutes(t *testing.T) {
+	proxy := compatProxy(nil, Options{Stale: StalePolicies{IfError: StalePolicy{Mode: StaleIgnore}}})
+	proxy.AddStaleRoute(regexp.MustCompile("^/events"), StalePolicies{IfError: StalePolicy{Mode: StaleForce, Window: StaleForever}})
+	assert.Equal(t, StaleForce, proxy.stalePolicies(httptest.NewRequest(http.MethodGet, "/events/edc", nil)).IfError.Mode)
+	assert.Equal(t, StaleIgnore, proxy.stalePolicies(httptest.NewRequest(http.MethodGet, "/news", nil)).IfError.Mode)
+}
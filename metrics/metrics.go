@@ -0,0 +1,71 @@
+// Package metrics counts things which happen in the proxy, like how
+// many bytes minification has saved, so that they can be published,
+// e.g. with expvar.
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters are named counters which are safe to use from many
+// goroutines.  The zero value is ready to use.  It is an expvar.Var,
+// so can be published with expvar.Publish.
+type Counters struct {
+	counters sync.Map
+}
+
+// NewCounters returns empty Counters.
+func NewCounters() *Counters {
+	return &Counters{}
+}
+
+// Add adds delta to the counter named name.
+func (c *Counters) Add(name string, delta int64) {
+	v, found := c.counters.Load(name)
+	if !found {
+		v, _ = c.counters.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+// Get returns the value of the counter named name, or 0 if nothing
+// has been added to it.
+func (c *Counters) Get(name string) int64 {
+	if v, found := c.counters.Load(name); found {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+// Snapshot returns the value of every counter.
+func (c *Counters) Snapshot() map[string]int64 {
+	snapshot := make(map[string]int64)
+	c.counters.Range(func(name, v interface{}) bool {
+		snapshot[name.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return snapshot
+}
+
+// Names returns the names of the counters, sorted.
+func (c *Counters) Names() []string {
+	var names []string
+	c.counters.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// String returns the counters as a JSON object, as expvar.Var requires.
+func (c *Counters) String() string {
+	data, err := json.Marshal(c.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountersAdd(t *testing.T) {
+	counters := NewCounters()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counters.Add("requests", 1)
+			counters.Add("bytes", 10)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(100), counters.Get("requests"))
+	assert.Equal(t, int64(1000), counters.Get("bytes"))
+	assert.Equal(t, int64(0), counters.Get("missing"))
+	assert.Equal(t, []string{"bytes", "requests"}, counters.Names())
+}
+
+func TestCountersAreAnExpvar(t *testing.T) {
+	var counters Counters
+	counters.Add("saved", 42)
+	var v expvar.Var = &counters
+	assert.Equal(t, `{"saved":42}`, v.String())
+}
@@ -0,0 +1,73 @@
+package minify
+
+import "bytes"
+
+// cssTight are the characters whitespace around which can be removed
+// from css.  Combinators like + and - aren't, since calc() needs the
+// whitespace around them, and neither is :, since a space before it
+// in a selector matters.
+const cssTight = "{};,>"
+
+// minifyCSS removes comments - other than /*! ones, which are usually
+// licenses - and whitespace which isn't needed, and the last semicolon
+// in each block.
+func minifyCSS(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	space := false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end, err := skipBlockComment(src, i)
+			if err != nil {
+				return nil, err
+			}
+			if i+2 < len(src) && src[i+2] == '!' {
+				writeCSSSpace(&out, space, src[i])
+				out.Write(src[i:end])
+				space = false
+			}
+			i = end
+			continue
+		case isSpace(c):
+			space = true
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end, err := skipString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			writeCSSSpace(&out, space, c)
+			out.Write(src[i:end])
+			space = false
+			i = end
+			continue
+		case c == '}':
+			// the last declaration in a block doesn't need its semicolon
+			if b := out.Bytes(); len(b) > 0 && b[len(b)-1] == ';' {
+				out.Truncate(len(b) - 1)
+			}
+		}
+		writeCSSSpace(&out, space, c)
+		out.WriteByte(c)
+		space = false
+		i++
+	}
+	return out.Bytes(), nil
+}
+
+// writeCSSSpace writes a single space for whitespace which came before
+// next, unless it isn't needed.
+func writeCSSSpace(out *bytes.Buffer, space bool, next byte) {
+	if !space || out.Len() == 0 {
+		return
+	}
+	prev := out.Bytes()[out.Len()-1]
+	if bytes.IndexByte([]byte(cssTight), prev) >= 0 || prev == ':' ||
+		bytes.IndexByte([]byte(cssTight), next) >= 0 {
+		return
+	}
+	out.WriteByte(' ')
+}
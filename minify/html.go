@@ -0,0 +1,126 @@
+package minify
+
+import (
+	"bytes"
+	"strings"
+)
+
+// htmlRawElements are the elements whose content is copied as it is,
+// since whitespace matters in it, or it isn't html.
+var htmlRawElements = []string{"pre", "textarea", "script", "style"}
+
+// minifyHTML removes comments - other than conditional comments, which
+// old versions of Internet Explorer use - and collapses whitespace in
+// text to a single space, or a single line break if it had one.  The
+// content of pre, textarea, script and style elements is left alone,
+// as are tags.
+func minifyHTML(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '<' && bytes.HasPrefix(src[i:], []byte("<!--")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				return nil, ErrUnterminated
+			}
+			end = i + 4 + end + 3
+			if bytes.HasPrefix(src[i:], []byte("<!--[if")) || bytes.HasPrefix(src[i:], []byte("<!--<![endif]")) {
+				out.Write(src[i:end])
+			}
+			i = end
+		case c == '<' && i+1 < len(src) && (isLetter(src[i+1]) || src[i+1] == '/' || src[i+1] == '!' || src[i+1] == '?'):
+			end, err := skipTag(src, i)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(src[i:end])
+			if name := rawElement(src[i:end]); name != "" {
+				close := indexFold(src[end:], "</"+name)
+				if close < 0 {
+					return nil, ErrUnterminated
+				}
+				out.Write(src[end : end+close])
+				end += close
+			}
+			i = end
+		case isSpace(c):
+			end := i
+			newline := false
+			for end < len(src) && isSpace(src[end]) {
+				newline = newline || src[end] == '\n'
+				end++
+			}
+			// Whitespace at the very start or end of the document
+			// is never rendered
+			if i > 0 && end < len(src) {
+				if b := out.Bytes(); len(b) > 0 && isSpace(b[len(b)-1]) {
+					// left over from around a comment which was removed
+					if newline {
+						b[len(b)-1] = '\n'
+					}
+				} else if newline {
+					out.WriteByte('\n')
+				} else {
+					out.WriteByte(' ')
+				}
+			}
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return bytes.TrimRight(out.Bytes(), " \t\n\r\f"), nil
+}
+
+// skipTag returns the index after the end of the tag starting at src[i],
+// which may have > in its quoted attribute values.
+func skipTag(src []byte, i int) (int, error) {
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '"', '\'':
+			end := bytes.IndexByte(src[j+1:], src[j])
+			if end < 0 {
+				return 0, ErrUnterminated
+			}
+			j += end + 1
+		case '>':
+			return j + 1, nil
+		}
+	}
+	return 0, ErrUnterminated
+}
+
+// rawElement returns the name of the element tag opens, if its content
+// should be left alone.
+func rawElement(tag []byte) string {
+	if bytes.HasSuffix(tag, []byte("/>")) {
+		return ""
+	}
+	for _, name := range htmlRawElements {
+		if len(tag) > len(name)+1 && strings.EqualFold(string(tag[1:len(name)+1]), name) {
+			if next := tag[len(name)+1]; isSpace(next) || next == '>' {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// indexFold returns the index of the first instance of the lower case
+// s in src, ignoring ASCII case, or -1 if there isn't one.
+func indexFold(src []byte, s string) int {
+	needle := []byte(s)
+	for i := 0; i+len(needle) <= len(src); i++ {
+		if bytes.EqualFold(src[i:i+len(needle)], needle) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
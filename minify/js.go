@@ -0,0 +1,220 @@
+package minify
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTemplate is returned for a template literal with another one
+// inside a ${} substitution, which minifyJS doesn't follow.
+var ErrTemplate = errors.New("minify: nested template literal")
+
+// ErrAmbiguousSlash is returned for a / after a ) without a matching
+// (, which could be a division or start a regular expression.
+var ErrAmbiguousSlash = errors.New("minify: ambiguous / after )")
+
+// jsTight are the characters whitespace around which can be removed
+// from javascript.  + and - aren't, since a + +b isn't a++b, and
+// neither are <, > and !, since a < !--b isn't a<!--b, which starts
+// an html comment.
+const jsTight = "{}()[];,:=?&|*%^~"
+
+// jsRegexKeywords are the keywords after which a / starts a regular
+// expression rather than being a division.
+var jsRegexKeywords = map[string]bool{
+	"return": true, "typeof": true, "case": true, "do": true, "else": true,
+	"in": true, "instanceof": true, "new": true, "delete": true, "void": true,
+	"throw": true, "yield": true, "await": true,
+}
+
+// jsConditionKeywords are the keywords whose parenthesized condition
+// is followed by a statement, so a / after its ) starts a regular
+// expression, as in if (ok) /a/.test(s).
+var jsConditionKeywords = map[string]bool{
+	"if": true, "while": true, "for": true, "with": true,
+}
+
+// minifyJS removes comments - other than /*! ones, which are usually
+// licenses - and whitespace which isn't needed.  Line breaks are kept,
+// other than after { ; , and ( or before } and ), so that automatic
+// semicolon insertion still works.
+func minifyJS(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	// space is 0, ' ' or '\n' for the whitespace since the last token
+	var space byte
+	// regexAllowed is whether a / would start a regular expression
+	regexAllowed := true
+	// parens is, for each ( which hasn't been closed, whether it is
+	// the condition of one of jsConditionKeywords, and condition is
+	// whether the last token was one of them
+	var parens []bool
+	condition, unmatched := false, false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end, err := skipBlockComment(src, i)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.IndexByte(src[i:end], '\n') >= 0 {
+				space = '\n'
+			} else if space == 0 {
+				space = ' '
+			}
+			if i+2 < len(src) && src[i+2] == '!' {
+				writeJSSpace(&out, space, '/')
+				out.Write(src[i:end])
+				space = '\n'
+			}
+			i = end
+			continue
+		case isSpace(c):
+			if c == '\n' || c == '\r' {
+				space = '\n'
+			} else if space == 0 {
+				space = ' '
+			}
+			i++
+			continue
+		}
+		writeJSSpace(&out, space, c)
+		space = 0
+		var end int
+		var err error
+		// what condition and unmatched will be after this token
+		isCondition, isUnmatched := false, false
+		switch {
+		case c == '"' || c == '\'':
+			end, err = skipString(src, i)
+			regexAllowed = false
+		case c == '`':
+			end, err = skipTemplate(src, i)
+			regexAllowed = false
+		case c == '/' && unmatched:
+			return nil, ErrAmbiguousSlash
+		case c == '/' && regexAllowed:
+			end, err = skipRegex(src, i)
+			regexAllowed = false
+		case isIdentifier(c):
+			end = i
+			for end < len(src) && isIdentifier(src[end]) {
+				end++
+			}
+			word := string(src[i:end])
+			regexAllowed = jsRegexKeywords[word]
+			isCondition = jsConditionKeywords[word]
+		case c == '(':
+			end = i + 1
+			parens = append(parens, condition)
+			regexAllowed = true
+		case c == ')' && len(parens) == 0:
+			end = i + 1
+			regexAllowed, isUnmatched = false, true
+		case c == ')':
+			end = i + 1
+			regexAllowed = parens[len(parens)-1]
+			parens = parens[:len(parens)-1]
+		default:
+			end = i + 1
+			regexAllowed = c != ']'
+		}
+		condition, unmatched = isCondition, isUnmatched
+		if err != nil {
+			return nil, err
+		}
+		out.Write(src[i:end])
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// writeJSSpace writes the whitespace space which came before next,
+// unless it isn't needed.
+func writeJSSpace(out *bytes.Buffer, space byte, next byte) {
+	if space == 0 || out.Len() == 0 {
+		return
+	}
+	prev := out.Bytes()[out.Len()-1]
+	if space == '\n' {
+		if bytes.IndexByte([]byte("{;,("), prev) >= 0 || next == '}' || next == ')' {
+			return
+		}
+		out.WriteByte('\n')
+		return
+	}
+	if bytes.IndexByte([]byte(jsTight), prev) >= 0 || bytes.IndexByte([]byte(jsTight), next) >= 0 {
+		return
+	}
+	out.WriteByte(' ')
+}
+
+func isIdentifier(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '$' || c == '.' || c >= 0x80
+}
+
+// skipTemplate returns the index after the end of the template literal
+// starting at src[i].
+func skipTemplate(src []byte, i int) (int, error) {
+	depth := 0
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '$':
+			if depth == 0 && j+1 < len(src) && src[j+1] == '{' {
+				depth = 1
+				j++
+			}
+		case '{':
+			if depth > 0 {
+				depth++
+			}
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '`':
+			if depth > 0 {
+				return 0, ErrTemplate
+			}
+			return j + 1, nil
+		}
+	}
+	return 0, ErrUnterminated
+}
+
+// skipRegex returns the index after the end of the regular expression
+// literal, and its flags, starting at src[i].
+func skipRegex(src []byte, i int) (int, error) {
+	class := false
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '\n':
+			return 0, ErrUnterminated
+		case '/':
+			if class {
+				continue
+			}
+			j++
+			for j < len(src) && isIdentifier(src[j]) {
+				j++
+			}
+			return j, nil
+		}
+	}
+	return 0, ErrUnterminated
+}
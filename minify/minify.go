@@ -0,0 +1,93 @@
+// Package minify removes what browsers don't need - comments and most
+// whitespace - from html, css and javascript.  The minifiers are
+// conservative: they only remove what is certainly safe to, and return
+// an error for anything they don't understand, so that the original
+// can be used instead.
+package minify
+
+import (
+	"errors"
+	"mime"
+	"strings"
+)
+
+// A Language is something which can be minified.
+type Language string
+
+const (
+	// HTML is text/html
+	HTML Language = "html"
+	// CSS is text/css
+	CSS Language = "css"
+	// JavaScript is application/javascript or text/javascript
+	JavaScript Language = "js"
+)
+
+// ErrUnterminated is returned for a comment, string, tag or regular
+// expression which doesn't end.
+var ErrUnterminated = errors.New("minify: unterminated comment, string or tag")
+
+// ErrUnknownLanguage is returned by Minify for a Language it can't minify.
+var ErrUnknownLanguage = errors.New("minify: unknown language")
+
+// LanguageOf returns the Language of responses with the Content-Type
+// contentType, and whether they can be minified at all.
+func LanguageOf(contentType string) (Language, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "text/html":
+		return HTML, true
+	case "text/css":
+		return CSS, true
+	case "application/javascript", "application/x-javascript", "text/javascript", "application/ecmascript":
+		return JavaScript, true
+	}
+	return "", false
+}
+
+// Minify returns src, which is in lang, minified.
+func Minify(lang Language, src []byte) ([]byte, error) {
+	switch lang {
+	case HTML:
+		return minifyHTML(src)
+	case CSS:
+		return minifyCSS(src)
+	case JavaScript:
+		return minifyJS(src)
+	}
+	return nil, ErrUnknownLanguage
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// skipString returns the index after the end of the string starting
+// with the quote at src[i], or an error if it doesn't end.
+func skipString(src []byte, i int) (int, error) {
+	quote := src[i]
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1, nil
+		case '\n':
+			return 0, ErrUnterminated
+		}
+	}
+	return 0, ErrUnterminated
+}
+
+// skipBlockComment returns the index after the end of the /* comment
+// starting at src[i], or an error if it doesn't end.
+func skipBlockComment(src []byte, i int) (int, error) {
+	end := strings.Index(string(src[i+2:]), "*/")
+	if end < 0 {
+		return 0, ErrUnterminated
+	}
+	return i + 2 + end + 2, nil
+}
@@ -0,0 +1,78 @@
+package minify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func minified(t *testing.T, lang Language, src string) string {
+	out, err := Minify(lang, []byte(src))
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	return string(out)
+}
+
+func TestLanguageOf(t *testing.T) {
+	lang, ok := LanguageOf("text/html; charset=UTF-8")
+	assert.True(t, ok)
+	assert.Equal(t, HTML, lang)
+	lang, _ = LanguageOf("application/javascript")
+	assert.Equal(t, JavaScript, lang)
+	lang, _ = LanguageOf("text/css")
+	assert.Equal(t, CSS, lang)
+	_, ok = LanguageOf("image/png")
+	assert.False(t, ok)
+}
+
+func TestMinifyHTML(t *testing.T) {
+	assert.Equal(t,
+		"<p>Hello <b>world</b>\n<a href=\"/a > b\">link</a></p>",
+		minified(t, HTML, "\n  <p>Hello   <b>world</b>\n   <!-- a comment -->\n<a href=\"/a > b\">link</a></p>\n"),
+	)
+	assert.Equal(t,
+		"<pre>  keep\n   this  </pre>\n<script>var a  =  1;</script>",
+		minified(t, HTML, "<pre>  keep\n   this  </pre>\n\n<script>var a  =  1;</script>"),
+	)
+	assert.Equal(t,
+		"<!--[if IE]><p>IE</p><![endif]-->",
+		minified(t, HTML, "<!--[if IE]><p>IE</p><![endif]-->"),
+		"Conditional comments should be kept",
+	)
+	_, err := Minify(HTML, []byte("<p>unterminated <!-- comment"))
+	assert.Equal(t, ErrUnterminated, err)
+	_, err = Minify(HTML, []byte("<script>never closed"))
+	assert.Equal(t, ErrUnterminated, err)
+}
+
+func TestMinifyCSS(t *testing.T) {
+	assert.Equal(t,
+		"/*! license */ a>b,c{color:red;width:calc(100% - 10px)}a :hover{content:\"a  ;  }\"}",
+		minified(t, CSS, "/*! license */\na > b, c {\n  color: red; /* comment */\n  width: calc(100% - 10px);\n}\na :hover { content: \"a  ;  }\"; }\n"),
+	)
+	_, err := Minify(CSS, []byte("a { content: \"unterminated }"))
+	assert.Equal(t, ErrUnterminated, err)
+}
+
+func TestMinifyJS(t *testing.T) {
+	assert.Equal(t,
+		"function add(a,b){return a + +b;}\nvar re=/[/*]\\//g\nvar s='a  // b'",
+		minified(t, JavaScript, "// comment\nfunction add(a, b) {\n  /* block */\n  return a + +b;\n}\nvar re = /[/*]\\//g\nvar s = 'a  // b'\n"),
+	)
+	assert.Equal(t,
+		"var a=b\n/c/d\nvar t=`x  ${y}  z`",
+		minified(t, JavaScript, "var a = b\n/c/d\nvar t = `x  ${y}  z`"),
+	)
+	assert.Equal(t,
+		"if(ok)/a  b/.test(s)\nx=(a + b)/ 2 / c\ny=a[0]/ 2",
+		minified(t, JavaScript, "if (ok) /a  b/.test(s)\nx = (a + b) / 2 / c\ny = a[0] / 2"),
+		"A / after the condition of an if should start a regular expression",
+	)
+	_, err := Minify(JavaScript, []byte("a) /b  c/.test(s)"))
+	assert.Equal(t, ErrAmbiguousSlash, err, "A / after an unmatched ) should be an error")
+	_, err = Minify(JavaScript, []byte("var s = 'unterminated"))
+	assert.Equal(t, ErrUnterminated, err)
+	_, err = Minify(JavaScript, []byte("var t = `a ${`b`}`"))
+	assert.Equal(t, ErrTemplate, err)
+}
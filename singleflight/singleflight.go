@@ -1,20 +1,24 @@
 package singleflight
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 
 	"github.com/davidjwilkins/honey/cache"
-	"github.com/davidjwilkins/honey/utilities"
 )
 
 type singleflight struct {
 	cacher    cache.Cacher
-	requests  []request
+	request   *http.Request
+	requests  []*request
+	writers   map[http.ResponseWriter]*request
 	response  cache.Response
 	done      bool
+	err       error
 	cacheable bool
 	handler   func(w http.ResponseWriter, r *http.Request)
 	sync.WaitGroup
@@ -24,8 +28,16 @@ type singleflight struct {
 type request struct {
 	writer  http.ResponseWriter
 	request *http.Request
+	done    chan struct{}
+	err     error
+	started bool
 }
 
+// ErrUncacheable is returned by WaitWriter when the response could not
+// be shared with other requests (e.g. it was private), so the request
+// must be sent to the backend itself.
+var ErrUncacheable = errors.New("singleflight: response cannot be shared")
+
 // A Singleflight is used to prevent flooding the remote
 // server with requests when the cache is empty (e.g.
 // after the cache has been cleared, or right after a
@@ -40,19 +52,34 @@ type request struct {
 // response did not contain the Private cache-control directive)
 //
 // Wait should block until Write has been called and completed.
+//
+// WaitWriter should block until the response has been written to
+// ResponseWriter w, or until ctx is done, in which case w should
+// be removed so that it is not written to.
+//
+// Fail should release all writers without writing to them, because
+// there will be no response to write.  WaitWriter should return err.
 type Singleflight interface {
 	AddWriter(w http.ResponseWriter, r *http.Request)
 	Write(r cache.Response) bool
 	Cacheable() (bool, error)
 	Wait()
+	WaitWriter(ctx context.Context, w http.ResponseWriter) error
+	Fail(err error)
 }
 
 // NewSingleflight will create a new default singleflight to be used for
-// all requests for which cacher provides the same hash.
+// all requests for which cacher provides the same hash.  r is the request
+// which will be sent to the backend.
 func NewSingleflight(cacher cache.Cacher, r *http.Request, handler func(w http.ResponseWriter, r *http.Request)) Singleflight {
+	if r == nil {
+		r = &http.Request{URL: &url.URL{}, Header: http.Header{}}
+	}
 	return &singleflight{
 		cacher:    cacher,
-		requests:  []request{},
+		request:   r,
+		requests:  []*request{},
+		writers:   make(map[http.ResponseWriter]*request),
 		done:      false,
 		cacheable: true,
 		handler:   handler,
@@ -60,10 +87,21 @@ func NewSingleflight(cacher cache.Cacher, r *http.Request, handler func(w http.R
 }
 
 // AddWriter add a ResponseWriter to be written to when Write is called.
-// If Write has already been called, it will call it again.
+// If Write has already been called, it will call it again.  If Fail has
+// been called, the writer is released straight away.
 func (m *singleflight) AddWriter(w http.ResponseWriter, r *http.Request) {
 	m.Lock()
-	m.requests = append(m.requests, request{w, r})
+	if m.err != nil {
+		m.Unlock()
+		return
+	}
+	req := &request{
+		writer:  w,
+		request: r,
+		done:    make(chan struct{}),
+	}
+	m.requests = append(m.requests, req)
+	m.writers[w] = req
 	done := m.done
 	m.Add(1)
 	m.Unlock()
@@ -82,6 +120,74 @@ func (m *singleflight) Cacheable() (bool, error) {
 	return m.cacheable, nil
 }
 
+// WaitWriter blocks until the response has been written to w.  If ctx
+// is done first, w is removed from the singleflight, and the context's
+// error is returned.  If the response could not be shared, it returns
+// ErrUncacheable without having written anything.
+func (m *singleflight) WaitWriter(ctx context.Context, w http.ResponseWriter) error {
+	m.RLock()
+	req := m.writers[w]
+	err := m.err
+	m.RUnlock()
+	if req == nil {
+		return err
+	}
+	select {
+	case <-req.done:
+		return req.err
+	case <-ctx.Done():
+	}
+	// Once Write has started writing to w, it can't be taken back, so
+	// wait for it to finish rather than writing to w concurrently.
+	m.Lock()
+	if req.started {
+		m.Unlock()
+		<-req.done
+		return req.err
+	}
+	req.started = true
+	for i, pending := range m.requests {
+		if pending == req {
+			m.requests = append(m.requests[:i], m.requests[i+1:]...)
+		}
+	}
+	m.Unlock()
+	m.Done()
+	return ctx.Err()
+}
+
+// start claims req to be written to, returning false if it has already
+// been claimed, e.g. because WaitWriter gave up waiting for it.
+func (m *singleflight) start(req *request) bool {
+	m.Lock()
+	defer m.Unlock()
+	if req.started {
+		return false
+	}
+	req.started = true
+	return true
+}
+
+// Fail releases all ResponseWriters added via AddWriter without writing
+// to them, e.g. because the backend could not be reached.  WaitWriter
+// will return err for each of them, and for any added afterwards.
+func (m *singleflight) Fail(err error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.done {
+		return
+	}
+	m.done = true
+	m.err = err
+	for _, req := range m.requests {
+		req.started = true
+		req.err = err
+		close(req.done)
+		m.Done()
+	}
+	m.requests = []*request{}
+}
+
 // Write will write the response to all ResponseWriters added
 // via AddWriter.  It will return true if it was able to write
 // the response (e.g. Cache-Control was not set to private or
@@ -90,35 +196,50 @@ func (m *singleflight) Cacheable() (bool, error) {
 // not in the cache, but that this response was not (initially)
 // for this request.
 func (m *singleflight) Write(r cache.Response) bool {
+	// Take the pending writers, but write to them outside the lock, so
+	// that a slow one doesn't stop the others from giving up waiting.
 	m.Lock()
-	defer func() {
-		m.response = r
-		m.done = true
-		m.requests = []request{}
-		m.Unlock()
-	}()
+	requests := m.requests
+	m.requests = []*request{}
+	m.response = r
+	m.done = true
 	vary := r.Header().Get("Vary")
-	if cc := r.Header().Get("Cache-Control"); strings.Contains(cc, "private") ||
-		strings.Contains(cc, "no-store") || vary == "*" {
+	cc := r.Header().Get("Cache-Control")
+	uncacheable := strings.Contains(cc, "private") || strings.Contains(cc, "no-store") || vary == "*"
+	if uncacheable {
 		m.cacheable = false
-		go func() {
-			for range m.requests {
-				m.Done()
+	}
+	m.Unlock()
+	if uncacheable {
+		for _, req := range requests {
+			if !m.start(req) {
+				continue
 			}
-		}()
+			req.err = ErrUncacheable
+			close(req.done)
+			m.Done()
+		}
 		m.Wait()
 		return false
 	}
-	// Bucket the requests based on whether their headers for the response Vary are the same
-	hash := utilities.GetVaryHeadersHash(r.RequestHeaders(), r, m.cacher.AllowedCookies(), vary)
-	buckets := make(map[string][]request)
-	for _, req := range m.requests {
-		h := utilities.GetVaryHeadersHash(req.request.Header, req.request, m.cacher.AllowedCookies(), vary)
+	// Bucket the requests based on whether they would be given the same
+	// variant of the response by the cacher, i.e. their headers for the
+	// response Vary, and the request placeholders of the key template,
+	// are the same
+	leader := *m.request
+	leader.Header = r.RequestHeaders()
+	hash := m.cacher.Variant(&leader, vary)
+	buckets := make(map[string][]*request)
+	for _, req := range requests {
+		h := m.cacher.Variant(req.request, vary)
 		buckets[h] = append(buckets[h], req)
 	}
 	// Respond to any that match the Vary
 	for _, req := range buckets[hash] {
-		go func(req request) {
+		if !m.start(req) {
+			continue
+		}
+		go func(req *request) {
 			for key, values := range r.Header() {
 				for _, value := range values {
 					req.writer.Header().Add(key, value)
@@ -126,12 +247,14 @@ func (m *singleflight) Write(r cache.Response) bool {
 			}
 			req.writer.Header().Set("X-Honey-Cache", "MISS (MULTIPLEXED)")
 			req.writer.Header().Set("Age", r.Age())
+			body := cache.Encode(req.writer.Header(), r, req.request.Header.Get("Accept-Encoding"))
 			if isNotModified(req.request, r) {
 				req.writer.WriteHeader(http.StatusNotModified)
 			} else {
 				req.writer.WriteHeader(r.StatusCode())
-				req.writer.Write(r.Body())
+				req.writer.Write(body)
 			}
+			close(req.done)
 			m.Done()
 		}(req)
 	}
@@ -143,8 +266,12 @@ func (m *singleflight) Write(r cache.Response) bool {
 			}
 			// TODO: GET THE RESPONSE FOR EACH BUCKET
 			for _, req := range requests {
+				if !m.start(req) {
+					continue
+				}
 				req.request.Header.Set("X-Honey-Vary", bucket)
 				m.handler(req.writer, req.request)
+				close(req.done)
 				m.Done()
 			}
 		}
@@ -155,6 +282,5 @@ func (m *singleflight) Write(r cache.Response) bool {
 }
 
 func isNotModified(r *http.Request, resp cache.Response) bool {
-	return r.Header.Get("If-None-Match") != "" &&
-		r.Header.Get("If-None-Match") == resp.Header().Get("Etag")
+	return cache.MatchEtag(r.Header.Get("If-None-Match"), resp.Header().Get("Etag"))
 }
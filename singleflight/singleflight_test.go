@@ -1,12 +1,15 @@
 package singleflight
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/davidjwilkins/honey/cache"
 )
@@ -145,3 +148,156 @@ func TestWriteReturnsDifferentResponseToMultipleRequestsIfVary(t *testing.T) {
 		t.Errorf("Requests with different Vary headers should get a different response. Got:\n%s\n%s", response1, response2)
 	}
 }
+
+func TestWriteBucketsRequestsByKeyTemplate(t *testing.T) {
+	server := testServer(10)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacher := cache.NewDefaultCacher()
+	cacher.SetKeyTemplate(cache.MustParseKeyTemplate("{method}{host}{path}{header:X-Device}"))
+	leader := newTestValidRequest()
+	leader.Header.Set("X-Device", "mobile")
+	singleflight := NewSingleflight(cacher, leader, (&testHandler{}).ServeHTTP)
+	rec1 := httptest.NewRecorder()
+	rec2 := httptest.NewRecorder()
+	req1 := newTestValidRequest()
+	req2 := newTestValidRequest()
+	req1.Header.Set("X-Device", "mobile")
+	req2.Header.Set("X-Device", "desktop")
+	singleflight.AddWriter(rec1, req1)
+	singleflight.AddWriter(rec2, req2)
+	resp.Request = leader
+	singleflight.Write(cacher.Standardize(resp))
+	response1 := string(rec1.Body.Bytes())
+	response2 := string(rec2.Body.Bytes())
+
+	if response1 != "Visitor count: 11." {
+		t.Errorf("Requests with the same key template values as the leader should get its response. Got: %s", response1)
+	}
+	if response1 == response2 {
+		t.Errorf("Requests with different key template values should get a different response. Got:\n%s\n%s", response1, response2)
+	}
+}
+
+func TestWaitWriterRemovesWriterWhenContextIsDone(t *testing.T) {
+	singleflight := newTestSingleflight(false).(*singleflight)
+	rec := httptest.NewRecorder()
+	singleflight.AddWriter(rec, newTestValidRequest())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := singleflight.WaitWriter(ctx, rec); err != context.DeadlineExceeded {
+		t.Errorf("WaitWriter should return the context's error if it is done first. Got: %v", err)
+	}
+	if len(singleflight.requests) != 0 {
+		t.Errorf("WaitWriter should remove the writer if the context is done first")
+	}
+	// Wait should not block on the writer which was removed
+	singleflight.Wait()
+}
+
+func TestWaitWriterTimesOutWhileAnotherWriterIsSlow(t *testing.T) {
+	server := testServer(0)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handled := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		handled++
+		close(started)
+		<-release
+	}
+	singleflight := NewSingleflight(cache.NewDefaultCacher(), newTestValidRequest(), handler)
+	// Neither matches the Vary of the response, so they are sent to the
+	// handler one after the other
+	slow, waiting := httptest.NewRecorder(), httptest.NewRecorder()
+	for _, rec := range []*httptest.ResponseRecorder{slow, waiting} {
+		req := newTestValidRequest()
+		req.Header.Set("Accept-Language", "fr")
+		singleflight.AddWriter(rec, req)
+	}
+	go singleflight.Write(cache.NewDefaultCacher().Standardize(resp))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errs := make(chan error)
+	go func() {
+		errs <- singleflight.WaitWriter(ctx, waiting)
+	}()
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Errorf("WaitWriter should return the context's error if it is done first. Got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("WaitWriter should not be blocked by another writer being written to")
+	}
+	close(release)
+	if err := singleflight.WaitWriter(context.Background(), slow); err != nil {
+		t.Errorf("WaitWriter should not return an error once the response has been written. Got: %v", err)
+	}
+	singleflight.Wait()
+	if handled != 1 {
+		t.Errorf("A writer which gave up waiting should not be written to. Got %d handled", handled)
+	}
+}
+
+func TestWaitWriterReturnsOnceWritten(t *testing.T) {
+	server := testServer(0)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleflight := newTestSingleflight(false)
+	rec := httptest.NewRecorder()
+	singleflight.AddWriter(rec, newTestValidRequest())
+	go singleflight.Write(cache.NewDefaultCacher().Standardize(resp))
+	if err := singleflight.WaitWriter(context.Background(), rec); err != nil {
+		t.Errorf("WaitWriter should not return an error once the response has been written. Got: %v", err)
+	}
+	if rec.Body.String() != "Visitor count: 1." {
+		t.Errorf("WaitWriter should return after the response has been written")
+	}
+}
+
+func TestWaitWriterReturnsErrUncacheable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleflight := newTestSingleflight(false)
+	rec := httptest.NewRecorder()
+	singleflight.AddWriter(rec, newTestValidRequest())
+	go singleflight.Write(cache.NewDefaultCacher().Standardize(resp))
+	if err := singleflight.WaitWriter(context.Background(), rec); err != ErrUncacheable {
+		t.Errorf("WaitWriter should return ErrUncacheable if the response can't be shared. Got: %v", err)
+	}
+}
+
+func TestFailReleasesWriters(t *testing.T) {
+	singleflight := newTestSingleflight(false)
+	rec := httptest.NewRecorder()
+	singleflight.AddWriter(rec, newTestValidRequest())
+	backendErr := errors.New("connection refused")
+	go singleflight.Fail(backendErr)
+	if err := singleflight.WaitWriter(context.Background(), rec); err != backendErr {
+		t.Errorf("WaitWriter should return the error the singleflight failed with. Got: %v", err)
+	}
+	late := httptest.NewRecorder()
+	singleflight.AddWriter(late, newTestValidRequest())
+	if err := singleflight.WaitWriter(context.Background(), late); err != backendErr {
+		t.Errorf("WaitWriter should return the error for writers added after the singleflight failed. Got: %v", err)
+	}
+	singleflight.Wait()
+}
@@ -0,0 +1,147 @@
+package transform
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/davidjwilkins/honey/cache"
+	"golang.org/x/net/html"
+)
+
+// CookielessOrder is the Stage Order of CookielessStage, which is after
+// MixedContentStage, so that assets it made secure are rewritten too.
+const CookielessOrder = 200
+
+var (
+	// cssURL matches the url in a css url()
+	cssURL = regexp.MustCompile(`(?i)(url\(\s*['"]?)([^'")\s]+)`)
+	// srcsetURL matches each url in an srcset attribute
+	srcsetURL = regexp.MustCompile(`(^|,)(\s*)([^\s,]+)`)
+)
+
+// assetAttrs are the attributes which may have the url of an asset in them
+var assetAttrs = map[string]bool{"src": true, "href": true, "poster": true}
+
+// CookielessStage returns a Stage which applies RewriteAssets with host
+// and static to html responses.
+func CookielessStage(host string, static cache.StaticPolicy) Stage {
+	return Stage{
+		Name:         "cookieless",
+		Transformer:  RewriteAssets(host, static),
+		Order:        CookielessOrder,
+		ContentTypes: []string{"text/html"},
+	}
+}
+
+// RewriteAssets returns a Transformer which rewrites the urls of static
+// files - by the extensions of static - on the host of the request in
+// html to host, so that browsers don't send the site's cookies with
+// them.  Relative urls are resolved against the page, and made protocol
+// relative.  src, href, srcset and poster attributes are rewritten, as
+// are css url()s in style elements and attributes.
+func RewriteAssets(host string, static cache.StaticPolicy) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		rewriter := &assetRewriter{
+			host:   host,
+			static: static,
+			site:   hostname(SiteHost(r)),
+			base:   &url.URL{Path: r.URL.Path},
+		}
+		return RewriteHTML(rewriter.rewrite).Transform(r, header, body)
+	})
+}
+
+// An assetRewriter rewrites the urls of assets in a single page.
+type assetRewriter struct {
+	// host is the cookieless host
+	host   string
+	static cache.StaticPolicy
+	// site is the host of the page, without its port
+	site string
+	// base is what relative urls are resolved against
+	base    *url.URL
+	inStyle bool
+}
+
+func (a *assetRewriter) rewrite(r *http.Request, token html.Token, raw []byte) []byte {
+	switch token.Type {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		a.inStyle = token.Data == "style" && token.Type == html.StartTagToken
+		changed := false
+		for i, attr := range token.Attr {
+			var val string
+			switch {
+			case token.Data == "base" && attr.Key == "href":
+				if base, err := url.Parse(attr.Val); err == nil {
+					a.base = a.base.ResolveReference(base)
+				}
+				continue
+			case assetAttrs[attr.Key]:
+				val = a.url(attr.Val)
+			case attr.Key == "srcset":
+				val = srcsetURL.ReplaceAllStringFunc(attr.Val, func(match string) string {
+					parts := srcsetURL.FindStringSubmatch(match)
+					return parts[1] + parts[2] + a.url(parts[3])
+				})
+			case attr.Key == "style":
+				val = string(a.css([]byte(attr.Val)))
+			default:
+				continue
+			}
+			if val != attr.Val {
+				token.Attr[i].Val = val
+				changed = true
+			}
+		}
+		if changed {
+			return []byte(token.String())
+		}
+	case html.TextToken:
+		if a.inStyle {
+			return a.css(raw)
+		}
+	case html.EndTagToken:
+		a.inStyle = false
+	}
+	return raw
+}
+
+func (a *assetRewriter) css(css []byte) []byte {
+	return cssURL.ReplaceAllFunc(css, func(match []byte) []byte {
+		parts := cssURL.FindSubmatch(match)
+		return append(append([]byte(nil), parts[1]...), a.url(string(parts[2]))...)
+	})
+}
+
+// url returns u on the cookieless host, if it is a static file on
+// the site's host, or as it is if not.
+func (a *assetRewriter) url(u string) string {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil || parsed.Opaque != "" || parsed.Path == "" {
+		return u
+	}
+	switch {
+	case parsed.Scheme != "" && parsed.Scheme != "http" && parsed.Scheme != "https":
+		return u
+	case parsed.Host != "" && hostname(parsed.Host) != a.site:
+		return u
+	case parsed.Host == "" && a.base.Host != "" && hostname(a.base.Host) != a.site:
+		// a <base> on another host
+		return u
+	}
+	resolved := a.base.ResolveReference(parsed)
+	if !a.static.IsStaticPath(resolved.Path) {
+		return u
+	}
+	rewritten := &url.URL{
+		Scheme:   parsed.Scheme,
+		Host:     a.host,
+		Path:     resolved.Path,
+		RawPath:  resolved.RawPath,
+		RawQuery: parsed.RawQuery,
+		Fragment: parsed.Fragment,
+	}
+	return rewritten.String()
+}
@@ -0,0 +1,49 @@
+package transform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func rewriteAssets(t *testing.T, uri, body string) string {
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	out, err := RewriteAssets("static.insomniac.com", cache.DefaultStaticPolicy()).Transform(r, http.Header{"Content-Type": []string{"text/html"}}, []byte(body))
+	assert.NoError(t, err)
+	return string(out)
+}
+
+func TestRewriteAssets(t *testing.T) {
+	out := rewriteAssets(t, "http://www.insomniac.com/blog/post",
+		`<img src="/logo.png" srcset="a.png 1x, https://www.insomniac.com/b.png?v=2 2x">`+
+			`<link href="//www.insomniac.com/style.css" rel="stylesheet">`+
+			`<a href="/about">About</a><script src="https://cdn.example.com/lib.js"></script>`)
+	assert.Equal(t,
+		`<img src="//static.insomniac.com/logo.png" srcset="//static.insomniac.com/blog/a.png 1x, https://static.insomniac.com/b.png?v=2 2x">`+
+			`<link href="//static.insomniac.com/style.css" rel="stylesheet">`+
+			`<a href="/about">About</a><script src="https://cdn.example.com/lib.js"></script>`, out,
+		"Only static files on the site should be rewritten")
+}
+
+func TestRewriteAssetsCSSAndBase(t *testing.T) {
+	out := rewriteAssets(t, "http://www.insomniac.com/",
+		`<base href="/theme/"><style>a { background: url('img/a.png') }</style><p style="background: url(/p.gif)">`)
+	assert.Equal(t,
+		`<base href="/theme/"><style>a { background: url('//static.insomniac.com/theme/img/a.png') }</style><p style="background: url(//static.insomniac.com/p.gif)">`, out)
+
+	page := `<base href="https://cdn.example.com/"><img src="a.png">`
+	assert.Equal(t, page, rewriteAssets(t, "http://www.insomniac.com/", page), "A base on another host should be left alone")
+}
+
+func TestRewriteAssetsUsesStaticPolicy(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	static := cache.StaticPolicy{Extensions: []string{".css", "webp"}}
+	out, err := RewriteAssets("static.insomniac.com", static).Transform(r, http.Header{"Content-Type": []string{"text/html"}},
+		[]byte(`<link href="/style.css" rel="stylesheet"><img src="/a.WEBP"><img src="/logo.png">`))
+	assert.NoError(t, err)
+	assert.Equal(t, `<link href="//static.insomniac.com/style.css" rel="stylesheet"><img src="//static.insomniac.com/a.WEBP"><img src="/logo.png">`, string(out),
+		"Only the extensions of the backend's static files should be rewritten")
+}
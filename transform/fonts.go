@@ -0,0 +1,241 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// GoogleFontsOrder is the Stage Order of GoogleFontsStage, which is
+// after MixedContentStage, so that links it made secure are combined
+// with those which already were.
+const GoogleFontsOrder = 150
+
+// googleFontsHost is the host of the Google Fonts stylesheets
+const googleFontsHost = "fonts.googleapis.com"
+
+// GoogleFontsStage returns a Stage which applies CombineGoogleFonts to
+// html responses.
+func GoogleFontsStage() Stage {
+	return Stage{
+		Name:         "google-fonts",
+		Transformer:  CombineGoogleFonts(),
+		Order:        GoogleFontsOrder,
+		ContentTypes: []string{"text/html"},
+	}
+}
+
+// CombineGoogleFonts returns a Transformer which combines the stylesheet
+// links to fonts.googleapis.com/css in html into one, which requests all
+// of their families with all of their weights and subsets.  Links with
+// a different display= are combined separately, since it changes how the
+// fonts are shown.  The combined link replaces the first of them.
+// Links with any other parameters, like text=, or with a media other
+// than all, are left alone, as are links to the css2 api.
+func CombineGoogleFonts() Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		groups, err := googleFontGroups(body)
+		if err != nil || !combinable(groups) {
+			return body, err
+		}
+		link := 0
+		return RewriteHTML(func(r *http.Request, token html.Token, raw []byte) []byte {
+			u, ok := googleFontsLink(token)
+			if !ok {
+				return raw
+			}
+			group := groups[u.Query().Get("display")]
+			index := link
+			link++
+			switch {
+			case len(group.links) < 2:
+				return raw
+			case index != group.links[0]:
+				return nil
+			}
+			for i, attr := range token.Attr {
+				if attr.Key == "href" {
+					token.Attr[i].Val = group.url()
+				}
+			}
+			return []byte(token.String())
+		}).Transform(r, header, body)
+	})
+}
+
+// A fontGroup is the Google Fonts links with the same display=, which
+// are combined into one.
+type fontGroup struct {
+	// links are the indexes of the links in the group, out of all of
+	// the Google Fonts links in the page
+	links []int
+	// base is the first link, whose scheme and host are kept
+	base     *url.URL
+	display  string
+	families []string
+	// variants are the weights and styles of each family - if it
+	// is empty, the family was only requested in its regular weight
+	variants map[string][]string
+	subsets  []string
+}
+
+// googleFontGroups returns the Google Fonts links in body, grouped by
+// their display=.
+func googleFontGroups(body []byte) (map[string]*fontGroup, error) {
+	groups := make(map[string]*fontGroup)
+	z := html.NewTokenizer(bytes.NewReader(body))
+	link := 0
+	for {
+		if z.Next() == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return groups, nil
+			}
+			return nil, z.Err()
+		}
+		u, ok := googleFontsLink(z.Token())
+		if !ok {
+			continue
+		}
+		query := u.Query()
+		display := query.Get("display")
+		group, found := groups[display]
+		if !found {
+			group = &fontGroup{base: u, display: display, variants: make(map[string][]string)}
+			groups[display] = group
+		}
+		group.links = append(group.links, link)
+		link++
+		for _, family := range strings.Split(query.Get("family"), "|") {
+			group.add(family)
+		}
+		for _, subset := range strings.Split(query.Get("subset"), ",") {
+			if subset = strings.TrimSpace(subset); subset != "" {
+				group.subsets = appendUnique(group.subsets, subset)
+			}
+		}
+	}
+}
+
+// add adds family, with its variants after a colon, e.g. Roboto:400,700i,
+// to the group.
+func (g *fontGroup) add(family string) {
+	name, variants := family, ""
+	if i := strings.Index(family, ":"); i >= 0 {
+		name, variants = family[:i], family[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	existing, found := g.variants[name]
+	if !found {
+		g.families = append(g.families, name)
+	}
+	var added []string
+	for _, variant := range strings.Split(variants, ",") {
+		if variant = strings.TrimSpace(variant); variant != "" {
+			added = append(added, variant)
+		}
+	}
+	// A family without variants is only the regular weight, which has
+	// to be listed once it is combined with one which has them
+	switch {
+	case found && len(existing) == 0 && len(added) > 0:
+		existing = []string{"400"}
+	case found && len(existing) > 0 && len(added) == 0:
+		added = []string{"400"}
+	}
+	for _, variant := range added {
+		existing = appendUnique(existing, variant)
+	}
+	g.variants[name] = existing
+}
+
+// url returns the url of the combined link.
+func (g *fontGroup) url() string {
+	families := make([]string, len(g.families))
+	for i, family := range g.families {
+		families[i] = strings.Replace(family, " ", "+", -1)
+		if variants := g.variants[family]; len(variants) > 0 {
+			families[i] += ":" + strings.Join(variants, ",")
+		}
+	}
+	query := "family=" + strings.Join(families, "|")
+	if len(g.subsets) > 0 {
+		query += "&subset=" + strings.Join(g.subsets, ",")
+	}
+	if g.display != "" {
+		query += "&display=" + url.QueryEscape(g.display)
+	}
+	u := url.URL{Scheme: g.base.Scheme, Host: g.base.Host, Path: g.base.Path, RawQuery: query}
+	return u.String()
+}
+
+// combinable returns whether any of groups has links to combine.
+func combinable(groups map[string]*fontGroup) bool {
+	for _, group := range groups {
+		if len(group.links) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// googleFontsLink returns the url of token, if it is a stylesheet link
+// to the Google Fonts css api which can be combined with others.
+func googleFontsLink(token html.Token) (*url.URL, bool) {
+	if token.Data != "link" || (token.Type != html.StartTagToken && token.Type != html.SelfClosingTagToken) {
+		return nil, false
+	}
+	var href string
+	stylesheet := false
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "href":
+			href = attr.Val
+		case "rel":
+			stylesheet = containsField(attr.Val, "stylesheet")
+		case "media":
+			if media := strings.TrimSpace(attr.Val); media != "" && !strings.EqualFold(media, "all") {
+				return nil, false
+			}
+		}
+	}
+	if !stylesheet {
+		return nil, false
+	}
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || !strings.EqualFold(u.Host, googleFontsHost) || u.Path != "/css" {
+		return nil, false
+	}
+	query := u.Query()
+	for key, values := range query {
+		if (key != "family" && key != "subset" && key != "display") || len(values) != 1 {
+			return nil, false
+		}
+	}
+	return u, query.Get("family") != ""
+}
+
+// containsField returns whether the space separated list has field.
+func containsField(list, field string) bool {
+	for _, f := range strings.Fields(list) {
+		if strings.EqualFold(f, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
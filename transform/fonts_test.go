@@ -0,0 +1,47 @@
+package transform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func combineGoogleFonts(t *testing.T, body string) string {
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	out, err := CombineGoogleFonts().Transform(r, http.Header{"Content-Type": []string{"text/html"}}, []byte(body))
+	assert.NoError(t, err)
+	return string(out)
+}
+
+func TestCombineGoogleFonts(t *testing.T) {
+	out := combineGoogleFonts(t, `<head>`+
+		`<link rel="stylesheet" id="theme-fonts-css" href="https://fonts.googleapis.com/css?family=Open+Sans:400,700|Roboto&amp;subset=latin,latin-ext" media="all">`+
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css?family=Roboto:700italic&amp;subset=cyrillic">`+
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css?family=Open+Sans:300">`+
+		`<link rel="stylesheet" href="/style.css"></head>`)
+	assert.Equal(t, `<head>`+
+		`<link rel="stylesheet" id="theme-fonts-css" href="https://fonts.googleapis.com/css?family=Open+Sans:400,700,300|Roboto:400,700italic&amp;subset=latin,latin-ext,cyrillic" media="all">`+
+		`<link rel="stylesheet" href="/style.css"></head>`, out)
+}
+
+func TestCombineGoogleFontsByDisplay(t *testing.T) {
+	out := combineGoogleFonts(t,
+		`<link rel="stylesheet" href="//fonts.googleapis.com/css?family=Lato&display=swap">`+
+			`<link rel="stylesheet" href="//fonts.googleapis.com/css?family=Oswald">`+
+			`<link rel="stylesheet" href="//fonts.googleapis.com/css?family=Lora&display=swap">`)
+	assert.Equal(t,
+		`<link rel="stylesheet" href="//fonts.googleapis.com/css?family=Lato|Lora&amp;display=swap">`+
+			`<link rel="stylesheet" href="//fonts.googleapis.com/css?family=Oswald">`, out,
+		"Links with different display= should be combined separately")
+}
+
+func TestCombineGoogleFontsLeavesOthersAlone(t *testing.T) {
+	page := `<link rel="stylesheet" href="https://fonts.googleapis.com/css?family=Lato">` +
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css?family=Lobster&text=Honey">` +
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css?family=Oswald" media="print">` +
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css2?family=Roboto:wght@700">` +
+		`<link rel="preconnect" href="https://fonts.googleapis.com/css?family=Lora">`
+	assert.Equal(t, page, combineGoogleFonts(t, page), "A single link should be left as it is")
+}
@@ -0,0 +1,38 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/html"
+)
+
+// An HTMLRewriter is called with each token of an html document, and
+// raw, the html it was parsed from.  It returns the html to write in its
+// place - raw, if it doesn't change it, token.String() or something else
+// if it does, or nothing to remove it.
+type HTMLRewriter func(r *http.Request, token html.Token, raw []byte) []byte
+
+// RewriteHTML returns a Transformer which tokenizes an html body as a
+// stream, and rewrites it one token at a time with rewrite.  Tokens
+// rewrite doesn't change are written exactly as they were.  It should
+// be added to a Stage with ContentTypes of text/html.
+func RewriteHTML(rewrite HTMLRewriter) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		var out bytes.Buffer
+		out.Grow(len(body))
+		z := html.NewTokenizer(bytes.NewReader(body))
+		for {
+			if z.Next() == html.ErrorToken {
+				if z.Err() == io.EOF {
+					return out.Bytes(), nil
+				}
+				return nil, z.Err()
+			}
+			// Raw is only valid until the next token, so it is copied
+			raw := append([]byte(nil), z.Raw()...)
+			out.Write(rewrite(r, z.Token(), raw))
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package transform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/html"
+)
+
+func TestRewriteHTMLKeepsUnchangedTokens(t *testing.T) {
+	page := `<!DOCTYPE html><p class=a>Tom &amp; Jerry</p><script>if (a < b) { x() }</script>`
+	transformer := RewriteHTML(func(r *http.Request, token html.Token, raw []byte) []byte {
+		return raw
+	})
+	out, err := transformer.Transform(httptest.NewRequest(http.MethodGet, "/", nil), http.Header{}, []byte(page))
+	assert.NoError(t, err)
+	assert.Equal(t, page, string(out), "Unchanged tokens should be written exactly as they were")
+}
+
+func TestRewriteHTMLChangesTokens(t *testing.T) {
+	page := `<p><img src="http://example.com/a.png"><!-- drop --></p>`
+	transformer := RewriteHTML(func(r *http.Request, token html.Token, raw []byte) []byte {
+		switch {
+		case token.Type == html.CommentToken:
+			return nil
+		case token.Data == "img":
+			for i, attr := range token.Attr {
+				if attr.Key == "src" {
+					token.Attr[i].Val = "https://example.com/a.png"
+				}
+			}
+			return []byte(token.String())
+		}
+		return raw
+	})
+	out, err := transformer.Transform(httptest.NewRequest(http.MethodGet, "/", nil), http.Header{}, []byte(page))
+	assert.NoError(t, err)
+	assert.Equal(t, `<p><img src="https://example.com/a.png"></p>`, string(out))
+}
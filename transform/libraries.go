@@ -0,0 +1,152 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// LibrariesOrder is the Stage Order of the libraries Stage, which is
+// before CookielessStage, since scripts on a cookieless host aren't
+// recognised as the site's own.
+const LibrariesOrder = 180
+
+// A Library is a copy of a popular javascript library hosted by a
+// javascript library hosting service, which browsers may already have
+// cached from another site.
+type Library struct {
+	Name    string
+	Version string
+	// URL is where the library is hosted
+	URL string
+}
+
+// A LibraryManifest maps the hashes of the content of libraries, in
+// subresource integrity format - sha256-, then the base64 encoded sha256
+// - to the Library with that content.
+type LibraryManifest map[string]Library
+
+// DefaultLibraryManifest returns a copy of the LibraryManifest honey
+// comes with, so that more Libraries can be added to it.
+func DefaultLibraryManifest() LibraryManifest {
+	manifest := make(LibraryManifest, len(bundledLibraries))
+	for hash, library := range bundledLibraries {
+		manifest[hash] = library
+	}
+	return manifest
+}
+
+// ScriptIntegrity is the subresource integrity of the body of a
+// script, which is all CanonicalizeLibraries needs of it.
+type ScriptIntegrity struct {
+	// SHA256 is how the script is found in a LibraryManifest
+	SHA256 string
+	// SHA384 is the integrity attribute the hosted copy is given
+	SHA384 string
+}
+
+// NewScriptIntegrity returns the ScriptIntegrity of body.
+func NewScriptIntegrity(body []byte) ScriptIntegrity {
+	return ScriptIntegrity{SHA256: Integrity256(body), SHA384: integrity384(body)}
+}
+
+// A ScriptFetcher returns the ScriptIntegrity of the script at src,
+// which is on the host of r, e.g. from the cache.
+type ScriptFetcher func(r *http.Request, src *url.URL) (ScriptIntegrity, error)
+
+// CanonicalizeLibraries returns a Transformer which replaces scripts in
+// html which are on the host of the request, and whose content - whose
+// integrity it gets with fetch - is a Library in manifest, with the hosted copy
+// of the Library.  Since they are matched by content, rather than by
+// name, only unmodified copies are replaced.  The replaced scripts are
+// given an integrity attribute, so browsers check the hosted copy is
+// the same.  Scripts which already have one are left alone.
+func CanonicalizeLibraries(manifest LibraryManifest, fetch ScriptFetcher) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		base := &url.URL{Path: r.URL.Path}
+		site := hostname(SiteHost(r))
+		return RewriteHTML(func(r *http.Request, token html.Token, raw []byte) []byte {
+			if token.Data == "base" && token.Type != html.EndTagToken {
+				if href, found := attr(token, "href"); found {
+					if parsed, err := url.Parse(href); err == nil {
+						base = base.ResolveReference(parsed)
+					}
+				}
+				return raw
+			}
+			if token.Data != "script" || token.Type != html.StartTagToken {
+				return raw
+			}
+			if _, found := attr(token, "integrity"); found {
+				return raw
+			}
+			src, found := attr(token, "src")
+			if !found {
+				return raw
+			}
+			parsed, err := url.Parse(strings.TrimSpace(src))
+			if err != nil {
+				return raw
+			}
+			resolved := base.ResolveReference(parsed)
+			if resolved.Host != "" && hostname(resolved.Host) != site {
+				return raw
+			}
+			script, err := fetch(r, resolved)
+			if err != nil {
+				return raw
+			}
+			library, found := manifest[script.SHA256]
+			if !found {
+				return raw
+			}
+			setAttr(&token, "src", library.URL)
+			setAttr(&token, "integrity", script.SHA384)
+			setAttr(&token, "crossorigin", "anonymous")
+			return []byte(token.String())
+		}).Transform(r, header, body)
+	})
+}
+
+// Integrity256 returns the sha256 subresource integrity of body, which
+// is how it is found in a LibraryManifest.
+// https://www.w3.org/TR/SRI/
+func Integrity256(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// integrity384 returns the sha384 subresource integrity of body, which
+// is what is recommended for integrity attributes.
+func integrity384(body []byte) string {
+	sum := sha512.Sum384(body)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// attr returns the value of the attribute key of token, and whether
+// it has it.
+func attr(token html.Token, key string) (string, bool) {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// setAttr sets the attribute key of token to val, adding it if it
+// doesn't have it.
+func setAttr(token *html.Token, key, val string) {
+	for i, a := range token.Attr {
+		if a.Key == key {
+			token.Attr[i].Val = val
+			return
+		}
+	}
+	token.Attr = append(token.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -0,0 +1,46 @@
+package transform
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeLibraries(t *testing.T) {
+	library := []byte("window.library = {};")
+	manifest := LibraryManifest{Integrity256(library): {Name: "library", URL: "https://cdn.example.com/library.js"}}
+	var fetched []string
+	transformer := CanonicalizeLibraries(manifest, func(r *http.Request, src *url.URL) (ScriptIntegrity, error) {
+		fetched = append(fetched, src.String())
+		if src.Path == "/theme/library.js" {
+			return NewScriptIntegrity(library), nil
+		}
+		return ScriptIntegrity{}, errors.New("not found")
+	})
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/blog/post", nil)
+	out, err := transformer.Transform(r, http.Header{}, []byte(
+		`<base href="/theme/"><script src="library.js" defer></script>`+
+			`<script src="missing.js"></script>`+
+			`<script src="library.js" integrity="sha256-abc"></script>`+
+			`<script src="https://cdn.example.com/other.js"></script>`))
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`<base href="/theme/"><script src="https://cdn.example.com/library.js" defer="" integrity="`+integrity384(library)+`" crossorigin="anonymous"></script>`+
+			`<script src="missing.js"></script>`+
+			`<script src="library.js" integrity="sha256-abc"></script>`+
+			`<script src="https://cdn.example.com/other.js"></script>`, string(out))
+	assert.Equal(t, []string{"/theme/library.js", "/theme/missing.js"}, fetched,
+		"Scripts with an integrity attribute, or on other hosts, shouldn't be fetched")
+}
+
+func TestDefaultLibraryManifest(t *testing.T) {
+	manifest := DefaultLibraryManifest()
+	assert.NotEmpty(t, manifest)
+	manifest["sha256-test"] = Library{Name: "test"}
+	_, found := DefaultLibraryManifest()["sha256-test"]
+	assert.False(t, found, "The bundled manifest shouldn't be changed")
+}
@@ -0,0 +1,18 @@
+package transform
+
+// bundledLibraries are the releases of jQuery hosted on code.jquery.com,
+// by the sha256 subresource integrity it publishes for each of them.
+var bundledLibraries = LibraryManifest{
+	"sha256-ZosEbRLbNQzLpnKIkEdrPv7lOy9C27hHQ+Xp8a4MxAQ=": {Name: "jquery", Version: "1.12.4", URL: "https://code.jquery.com/jquery-1.12.4.min.js"},
+	"sha256-Qw82+bXyGq6MydymqBxNPYTaUXXq7c8v3CwiYwLLNXU=": {Name: "jquery", Version: "1.12.4", URL: "https://code.jquery.com/jquery-1.12.4.js"},
+	"sha256-hwg4gsxgFZhOsEEamdOYGBf13FyQuiTwlAQgxVSNgt4=": {Name: "jquery", Version: "3.2.1", URL: "https://code.jquery.com/jquery-3.2.1.min.js"},
+	"sha256-FgpCb/KJQlLNfOu91ta32o/NMZxltwRo8QtmkMRdAu8=": {Name: "jquery", Version: "3.3.1", URL: "https://code.jquery.com/jquery-3.3.1.min.js"},
+	"sha256-CSXorXvZcTkaix6Yvo6HppcZGetbYMGWSFlBw8HfCJo=": {Name: "jquery", Version: "3.4.1", URL: "https://code.jquery.com/jquery-3.4.1.min.js"},
+	"sha256-WpOohJOqMqqyKL9FccASB9O0KwACQJpFTUBLTYOVvVU=": {Name: "jquery", Version: "3.4.1", URL: "https://code.jquery.com/jquery-3.4.1.js"},
+	"sha256-9/aliU8dGd2tb6OSsuzixeV4y/faTqgFtohetphbbj0=": {Name: "jquery", Version: "3.5.1", URL: "https://code.jquery.com/jquery-3.5.1.min.js"},
+	"sha256-QWo7LDvxbWT2tbbQ97B53yJnYU3WhH/C8ycbRAkjPDc=": {Name: "jquery", Version: "3.5.1", URL: "https://code.jquery.com/jquery-3.5.1.js"},
+	"sha256-/xUj+3OJU5yExlq6GSYGSHk7tPXikynS7ogEvDej/m4=": {Name: "jquery", Version: "3.6.0", URL: "https://code.jquery.com/jquery-3.6.0.min.js"},
+	"sha256-H+K7U5CnXl1h5ywQfKtSj8PCmoN9aaq30gDh27Xc0jk=": {Name: "jquery", Version: "3.6.0", URL: "https://code.jquery.com/jquery-3.6.0.js"},
+	"sha256-SOuLUArmo4YXtXONKz+uxIGSKneCJG4x0nVcA0pFzV0=": {Name: "jquery-migrate", Version: "1.4.1", URL: "https://code.jquery.com/jquery-migrate-1.4.1.min.js"},
+	"sha256-VazP97ZCwtekAsvgPBSUwPFKdrwD3unUfSGVYrahUqU=": {Name: "jquery-ui", Version: "1.12.1", URL: "https://code.jquery.com/ui/1.12.1/jquery-ui.min.js"},
+}
@@ -0,0 +1,206 @@
+package transform
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/davidjwilkins/honey/cache"
+	"golang.org/x/net/html"
+)
+
+// MixedContentOptions decide which insecure references an https site's
+// pages have are rewritten to be secure.
+type MixedContentOptions struct {
+	// Hosts are the hosts, other than the site's own, which are known
+	// to support https.  One starting with *. matches any subdomain.
+	Hosts []string
+	// ProtocolRelative rewrites http://host/ to //host/ rather than
+	// https://host/, so the page still works over http.
+	ProtocolRelative bool
+	// UpgradeInsecureRequests adds Content-Security-Policy:
+	// upgrade-insecure-requests to html responses, so browsers
+	// upgrade any references which weren't rewritten.
+	UpgradeInsecureRequests bool
+}
+
+// MixedContentOrder is the Stage Order of MixedContentStage, which is
+// early, so that other Stages see the secure references.
+const MixedContentOrder = 100
+
+// upgradeInsecureRequests is the Content-Security-Policy directive
+// which makes browsers request http references with https.
+// https://www.w3.org/TR/upgrade-insecure-requests/
+const upgradeInsecureRequests = "upgrade-insecure-requests"
+
+var (
+	// insecureURL matches the start of an http url, up to the end of
+	// its host and port.
+	insecureURL = regexp.MustCompile(`(?i)^http://([^/?#\s'"(),\\]+)`)
+	// insecureCSS matches http urls in css, in url() or @import.
+	insecureCSS = regexp.MustCompile(`(?i)(url\(\s*['"]?|@import\s+['"])(http://[^/?#\s'"(),\\]+)`)
+	// insecureSrcset matches http urls in an srcset attribute, which
+	// is a comma separated list of urls with descriptors.
+	insecureSrcset = regexp.MustCompile(`(?i)(^|,)(\s*)(http://[^/?#\s'"(),\\]+)`)
+)
+
+// mixedContentAttrs are the attributes which have a url in them
+var mixedContentAttrs = map[string]bool{"src": true, "href": true}
+
+// MixedContentStage returns a Stage which applies FixMixedContent with
+// opts to html and css responses.
+func MixedContentStage(opts MixedContentOptions) Stage {
+	return Stage{
+		Name:         "mixed-content",
+		Transformer:  FixMixedContent(opts),
+		Order:        MixedContentOrder,
+		ContentTypes: []string{"text/html", "text/css"},
+	}
+}
+
+// FixMixedContent returns a Transformer which rewrites http references
+// to the host of the request, and the Hosts in opts, to https in html
+// and css - in src, href and srcset attributes, and css url()s and
+// @imports, including those in style elements and attributes.  Other
+// responses are returned as they are.
+func FixMixedContent(opts MixedContentOptions) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		fixer := &mixedContentFixer{opts: opts, host: hostname(SiteHost(r))}
+		switch {
+		case cache.MatchContentType(header.Get("Content-Type"), []string{"text/css"}):
+			return fixer.css(body), nil
+		case cache.MatchContentType(header.Get("Content-Type"), []string{"text/html"}):
+			if opts.UpgradeInsecureRequests {
+				addUpgradeInsecureRequests(header)
+			}
+			return fixer.html(r, body)
+		}
+		return body, nil
+	})
+}
+
+// A mixedContentFixer rewrites the insecure references in a single
+// response.
+type mixedContentFixer struct {
+	opts MixedContentOptions
+	// host is the site's own host, without its port
+	host string
+}
+
+func (f *mixedContentFixer) html(r *http.Request, body []byte) ([]byte, error) {
+	inStyle := false
+	return RewriteHTML(func(r *http.Request, token html.Token, raw []byte) []byte {
+		switch token.Type {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			inStyle = token.Data == "style" && token.Type == html.StartTagToken
+			changed := false
+			for i, attr := range token.Attr {
+				var val string
+				switch {
+				case mixedContentAttrs[attr.Key]:
+					val = f.url(attr.Val)
+				case attr.Key == "srcset":
+					val = f.srcset(attr.Val)
+				case attr.Key == "style":
+					val = string(f.css([]byte(attr.Val)))
+				default:
+					continue
+				}
+				if val != attr.Val {
+					token.Attr[i].Val = val
+					changed = true
+				}
+			}
+			if changed {
+				return []byte(token.String())
+			}
+		case html.TextToken:
+			// The text of a style element is raw css
+			if inStyle {
+				return f.css(raw)
+			}
+		case html.EndTagToken:
+			inStyle = false
+		}
+		return raw
+	}).Transform(r, nil, body)
+}
+
+// url returns u with its scheme rewritten, if it is an http url to
+// a secure host.
+func (f *mixedContentFixer) url(u string) string {
+	return insecureURL.ReplaceAllStringFunc(u, f.secure)
+}
+
+func (f *mixedContentFixer) srcset(srcset string) string {
+	return insecureSrcset.ReplaceAllStringFunc(srcset, func(match string) string {
+		parts := insecureSrcset.FindStringSubmatch(match)
+		return parts[1] + parts[2] + f.secure(parts[3])
+	})
+}
+
+func (f *mixedContentFixer) css(css []byte) []byte {
+	return insecureCSS.ReplaceAllFunc(css, func(match []byte) []byte {
+		parts := insecureCSS.FindSubmatch(match)
+		return append(append([]byte(nil), parts[1]...), f.secure(string(parts[2]))...)
+	})
+}
+
+// secure returns the http://host prefix of a url with a secure scheme,
+// or as it is if the host isn't secure.  A port of 80 is removed, and
+// urls with any other port are left alone.
+func (f *mixedContentFixer) secure(prefix string) string {
+	host := prefix[len("http://"):]
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if port != "80" {
+			return prefix
+		}
+		host = h
+	}
+	if !f.secureHost(strings.ToLower(host)) {
+		return prefix
+	}
+	if f.opts.ProtocolRelative {
+		return "//" + host
+	}
+	return "https://" + host
+}
+
+func (f *mixedContentFixer) secureHost(host string) bool {
+	if host == f.host {
+		return true
+	}
+	for _, allowed := range f.opts.Hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed ||
+			(strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// addUpgradeInsecureRequests adds the upgrade-insecure-requests directive
+// to the Content-Security-Policy in header, unless it is already there.
+func addUpgradeInsecureRequests(header http.Header) {
+	policy := header.Get("Content-Security-Policy")
+	for _, directive := range strings.Split(policy, ";") {
+		if strings.EqualFold(strings.TrimSpace(directive), upgradeInsecureRequests) {
+			return
+		}
+	}
+	if strings.TrimSpace(policy) == "" {
+		header.Set("Content-Security-Policy", upgradeInsecureRequests)
+		return
+	}
+	header.Set("Content-Security-Policy", strings.TrimRight(policy, "; ")+"; "+upgradeInsecureRequests)
+}
+
+// hostname returns host without its port, in lower case.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,69 @@
+package transform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixMixedContent(t *testing.T, opts MixedContentOptions, contentType, body string) (http.Header, string) {
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	header := http.Header{"Content-Type": []string{contentType}}
+	out, err := FixMixedContent(opts).Transform(r, header, []byte(body))
+	assert.NoError(t, err)
+	return header, string(out)
+}
+
+func TestFixMixedContentHTML(t *testing.T) {
+	opts := MixedContentOptions{Hosts: []string{"*.googleapis.com"}}
+	_, out := fixMixedContent(t, opts, "text/html; charset=utf-8",
+		`<img src="http://www.insomniac.com/a.png" srcset="http://www.insomniac.com/a.png 1x, http://cdn.example.com/b.png 2x">`+
+			`<link href="http://fonts.googleapis.com/css?family=Roboto" rel="stylesheet">`+
+			`<a href="http://example.com/">elsewhere</a>`)
+	assert.Equal(t,
+		`<img src="https://www.insomniac.com/a.png" srcset="https://www.insomniac.com/a.png 1x, http://cdn.example.com/b.png 2x">`+
+			`<link href="https://fonts.googleapis.com/css?family=Roboto" rel="stylesheet">`+
+			`<a href="http://example.com/">elsewhere</a>`, out,
+		"Only references to the site and secure hosts should be rewritten")
+}
+
+func TestFixMixedContentCSS(t *testing.T) {
+	css := `@import "http://www.insomniac.com/base.css"; a { background: url( 'http://www.insomniac.com:80/a.png' ) } b { background: url(http://www.insomniac.com:8080/b.png) }`
+	_, out := fixMixedContent(t, MixedContentOptions{ProtocolRelative: true}, "text/css", css)
+	assert.Equal(t, `@import "//www.insomniac.com/base.css"; a { background: url( '//www.insomniac.com/a.png' ) } b { background: url(http://www.insomniac.com:8080/b.png) }`, out)
+
+	_, out = fixMixedContent(t, MixedContentOptions{}, "text/html",
+		`<style>a { background: url(http://www.insomniac.com/a.png) }</style><p style="background: url(http://www.insomniac.com/p.png)">http://www.insomniac.com/</p>`)
+	assert.Equal(t,
+		`<style>a { background: url(https://www.insomniac.com/a.png) }</style><p style="background: url(https://www.insomniac.com/p.png)">http://www.insomniac.com/</p>`, out,
+		"CSS in style elements and attributes should be rewritten, but not text")
+}
+
+func TestFixMixedContentUpgradeInsecureRequests(t *testing.T) {
+	opts := MixedContentOptions{UpgradeInsecureRequests: true}
+	header, _ := fixMixedContent(t, opts, "text/html", "<p>")
+	assert.Equal(t, "upgrade-insecure-requests", header.Get("Content-Security-Policy"))
+
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	header = http.Header{"Content-Type": []string{"text/html"}, "Content-Security-Policy": []string{"default-src 'self';"}}
+	FixMixedContent(opts).Transform(r, header, []byte("<p>"))
+	assert.Equal(t, "default-src 'self'; upgrade-insecure-requests", header.Get("Content-Security-Policy"))
+	FixMixedContent(opts).Transform(r, header, []byte("<p>"))
+	assert.Equal(t, "default-src 'self'; upgrade-insecure-requests", header.Get("Content-Security-Policy"), "It should only be added once")
+
+	header, _ = fixMixedContent(t, opts, "text/css", "a{}")
+	assert.Empty(t, header.Get("Content-Security-Policy"), "It should only be added to html")
+}
+
+func TestMixedContentStage(t *testing.T) {
+	pipeline := NewPipeline(nil)
+	pipeline.Add(MixedContentStage(MixedContentOptions{}))
+	r, _, resp := newResponse("http://www.insomniac.com/", "text/html", `<script src="http://www.insomniac.com/a.js"></script>`)
+	pipeline.Apply(r, resp)
+	assert.Equal(t, `<script src="https://www.insomniac.com/a.js"></script>`, string(resp.Body()))
+	r, _, resp = newResponse("http://www.insomniac.com/a.js", "application/javascript", `load("http://www.insomniac.com/b.js")`)
+	pipeline.Apply(r, resp)
+	assert.Equal(t, `load("http://www.insomniac.com/b.js")`, string(resp.Body()), "Javascript should be left alone")
+}
@@ -0,0 +1,173 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PreloadOrder is the Stage Order of preload extraction, which is after
+// the Stages which rewrite urls, like CookielessStage, so that the urls
+// preloaded are the ones in the page.
+const PreloadOrder = 900
+
+// ExtractPreloads returns a Transformer which adds a Link header with
+// rel=preload for each of the first max critical assets in the head of
+// an html page - its stylesheets, and the assets it preloads itself,
+// like fonts - so that they can be sent as 103 Early Hints, or pushed,
+// before the page.  The body isn't changed.
+// https://www.w3.org/TR/preload/#link-element-interface-extensions
+func ExtractPreloads(max int) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		existing := make(map[string]bool)
+		for _, link := range PreloadLinks(header) {
+			existing[link.URL] = true
+		}
+		z := html.NewTokenizer(bytes.NewReader(body))
+		for added := 0; added < max; {
+			tt := z.Next()
+			if tt == html.ErrorToken {
+				if z.Err() == io.EOF {
+					break
+				}
+				return nil, z.Err()
+			}
+			token := z.Token()
+			// Only the assets in the head are critical
+			if token.Data == "body" || (token.Data == "head" && tt == html.EndTagToken) {
+				break
+			}
+			link, ok := preload(token)
+			if !ok || existing[link.URL] {
+				continue
+			}
+			existing[link.URL] = true
+			header.Add("Link", link.String())
+			added++
+		}
+		return body, nil
+	})
+}
+
+// A Preload is a Link header with rel=preload.
+type Preload struct {
+	URL string
+	// As is the destination of the asset, like style or font
+	As          string
+	Type        string
+	CrossOrigin bool
+}
+
+// String returns the Preload as the value of a Link header.
+func (p Preload) String() string {
+	value := fmt.Sprintf("<%s>; rel=preload", p.URL)
+	if p.As != "" {
+		value += "; as=" + p.As
+	}
+	if p.Type != "" {
+		value += fmt.Sprintf("; type=%q", p.Type)
+	}
+	if p.CrossOrigin {
+		value += "; crossorigin"
+	}
+	return value
+}
+
+// preload returns the Preload for token, if it is a stylesheet link or
+// a preload link.
+func preload(token html.Token) (Preload, bool) {
+	if token.Data != "link" || (token.Type != html.StartTagToken && token.Type != html.SelfClosingTagToken) {
+		return Preload{}, false
+	}
+	href, _ := attr(token, "href")
+	rel, _ := attr(token, "rel")
+	if strings.TrimSpace(href) == "" {
+		return Preload{}, false
+	}
+	if media, found := attr(token, "media"); found && !strings.EqualFold(strings.TrimSpace(media), "all") && strings.TrimSpace(media) != "" {
+		return Preload{}, false
+	}
+	link := Preload{URL: strings.TrimSpace(href)}
+	switch {
+	case containsField(rel, "stylesheet"):
+		link.As = "style"
+	case containsField(rel, "preload"):
+		link.As, _ = attr(token, "as")
+		link.Type, _ = attr(token, "type")
+	default:
+		return Preload{}, false
+	}
+	_, link.CrossOrigin = attr(token, "crossorigin")
+	// Fonts are always fetched in cors mode, so their preloads must be
+	// https://www.w3.org/TR/preload/#h-note3
+	if link.As == "font" {
+		link.CrossOrigin = true
+	}
+	return link, true
+}
+
+// PreloadLinks returns the Link headers in header with rel=preload.
+func PreloadLinks(header http.Header) []Preload {
+	var links []Preload
+	for _, value := range header["Link"] {
+		for _, part := range splitLinks(value) {
+			if link, ok := parsePreload(part); ok {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// splitLinks splits the value of a Link header into its links, at the
+// commas which aren't in a url or a quoted parameter.
+func splitLinks(value string) []string {
+	var links []string
+	start, inURL, inQuote := 0, false, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '<' && !inQuote:
+			inURL = true
+		case c == '>' && !inQuote:
+			inURL = false
+		case c == '"' && !inURL:
+			inQuote = !inQuote
+		case c == ',' && !inURL && !inQuote:
+			links = append(links, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(links, value[start:])
+}
+
+// parsePreload returns the Preload link is, if it has rel=preload.
+func parsePreload(link string) (Preload, bool) {
+	link = strings.TrimSpace(link)
+	end := strings.Index(link, ">")
+	if !strings.HasPrefix(link, "<") || end < 0 {
+		return Preload{}, false
+	}
+	preload := Preload{URL: link[1:end]}
+	isPreload := false
+	for _, param := range strings.Split(link[end+1:], ";") {
+		key, value := strings.TrimSpace(param), ""
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value = strings.TrimSpace(key[:i]), strings.Trim(strings.TrimSpace(key[i+1:]), `"`)
+		}
+		switch strings.ToLower(key) {
+		case "rel":
+			isPreload = containsField(value, "preload")
+		case "as":
+			preload.As = value
+		case "type":
+			preload.Type = value
+		case "crossorigin":
+			preload.CrossOrigin = true
+		}
+	}
+	return preload, isPreload
+}
@@ -0,0 +1,44 @@
+package transform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractPreloads(t *testing.T) {
+	page := `<html><head>` +
+		`<link rel="stylesheet" href="/style.css">` +
+		`<link rel="stylesheet" href="/print.css" media="print">` +
+		`<link rel="preload" href="/fonts/a.woff2" as="font" type="font/woff2">` +
+		`<link rel="stylesheet" href="/existing.css">` +
+		`<link rel="icon" href="/favicon.ico">` +
+		`</head><body><link rel="stylesheet" href="/late.css"></body></html>`
+	r := httptest.NewRequest(http.MethodGet, "http://www.insomniac.com/", nil)
+	header := http.Header{"Link": []string{`</existing.css>; rel=preload; as=style, <https://api.w.org/>; rel="https://api.w.org/"`}}
+	out, err := ExtractPreloads(10).Transform(r, header, []byte(page))
+	assert.NoError(t, err)
+	assert.Equal(t, page, string(out), "The body shouldn't be changed")
+	assert.Equal(t, []string{
+		`</existing.css>; rel=preload; as=style, <https://api.w.org/>; rel="https://api.w.org/"`,
+		`</style.css>; rel=preload; as=style`,
+		`</fonts/a.woff2>; rel=preload; as=font; type="font/woff2"; crossorigin`,
+	}, header["Link"])
+
+	header = http.Header{}
+	ExtractPreloads(1).Transform(r, header, []byte(page))
+	assert.Equal(t, []string{`</style.css>; rel=preload; as=style`}, header["Link"], "Only max assets should be added")
+}
+
+func TestPreloadLinks(t *testing.T) {
+	header := http.Header{"Link": []string{
+		`</a,b.css>; rel="preload"; as=style, <https://api.w.org/>; rel="https://api.w.org/"`,
+		`</font.woff2>; rel=preload; as=font; crossorigin`,
+	}}
+	assert.Equal(t, []Preload{
+		{URL: "/a,b.css", As: "style"},
+		{URL: "/font.woff2", As: "font", CrossOrigin: true},
+	}, PreloadLinks(header))
+}
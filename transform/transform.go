@@ -0,0 +1,237 @@
+// Package transform rewrites responses after they are standardized, and
+// before they are cached, with a Pipeline of Transformers - e.g. to
+// minify them, or to fix links to insecure content.  Since a response
+// is only transformed once, when it is cached, a Transformer can take
+// its time.
+package transform
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/metrics"
+)
+
+// A Transformer rewrites the body of the response to r, and may change
+// its header.  If it returns an error, the response is left as it was
+// before the Transformer was applied.
+type Transformer interface {
+	Transform(r *http.Request, header http.Header, body []byte) ([]byte, error)
+}
+
+// TransformerFunc is a function which is a Transformer.
+type TransformerFunc func(r *http.Request, header http.Header, body []byte) ([]byte, error)
+
+// Transform calls f.
+func (f TransformerFunc) Transform(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+	return f(r, header, body)
+}
+
+// HeaderFunc is a function which changes the header of the response to
+// r, but not its body.  It is a Transformer.
+type HeaderFunc func(r *http.Request, header http.Header) error
+
+// Transform calls f, and returns body as it is.
+func (f HeaderFunc) Transform(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+	return body, f(r, header)
+}
+
+// SiteHost returns the host of the site r is for.  r is the request
+// sent to the backend, whose Host may be the backend's, so it is the
+// X-Forwarded-Host fetch.SwitchBackend sets, or r's Host if it has none.
+func SiteHost(r *http.Request) string {
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// A Stage is a Transformer in a Pipeline, and the responses it is
+// applied to.
+type Stage struct {
+	// Name identifies the Stage in metrics
+	Name        string
+	Transformer Transformer
+	// Order decides when the Stage is applied - lower first.  Stages
+	// with the same Order are applied in the order they were added.
+	Order int
+	// ContentTypes are the media types of the responses the Stage
+	// is applied to, which may end in /* to match any subtype.  If
+	// it is empty, it is applied to every response.
+	ContentTypes []string
+	// Routes are the paths the Stage is applied to.  If it is empty,
+	// it is applied to every path not in Skip.
+	Routes []*regexp.Regexp
+	// Skip are paths the Stage is never applied to
+	Skip []*regexp.Regexp
+	// Enabled decides whether the Stage is applied to a request,
+	// e.g. from per-route configuration.  If it is nil, it always is.
+	Enabled func(r *http.Request) bool
+}
+
+// The metrics a Pipeline records for each Stage, after the Stage's Name
+const (
+	// MetricApplied counts the responses a Stage changed
+	MetricApplied = "applied"
+	// MetricErrors counts the responses a Stage returned an error for
+	MetricErrors = "errors"
+)
+
+// A Pipeline applies its Stages in order to responses before they
+// are cached.  The zero value is an empty Pipeline.
+type Pipeline struct {
+	mu      sync.RWMutex
+	stages  []Stage
+	metrics *metrics.Counters
+}
+
+// NewPipeline returns an empty Pipeline, which records what its Stages
+// do in counters, if it isn't nil, as transform.<name>.applied and
+// transform.<name>.errors.
+func NewPipeline(counters *metrics.Counters) *Pipeline {
+	return &Pipeline{metrics: counters}
+}
+
+// Add adds stage to the Pipeline.
+func (p *Pipeline) Add(stage Stage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages = append(p.stages, stage)
+	sort.SliceStable(p.stages, func(i, j int) bool {
+		return p.stages[i].Order < p.stages[j].Order
+	})
+}
+
+// Stages returns the names of the Pipeline's Stages, in the order
+// they are applied.
+func (p *Pipeline) Stages() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, len(p.stages))
+	for i, stage := range p.stages {
+		names[i] = stage.Name
+	}
+	return names
+}
+
+// Apply applies the Stages to resp, the response to r.  Only successful
+// responses are transformed, and never ones with Cache-Control:
+// no-transform.  The body is decompressed once for all the Stages, and
+// the Etag and Content-Length are updated if it changes.
+// https://tools.ietf.org/html/rfc7234#section-5.2.2.4
+func (p *Pipeline) Apply(r *http.Request, resp cache.Response) {
+	if p == nil {
+		return
+	}
+	stages := p.enabled(r)
+	if len(stages) == 0 {
+		return
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 ||
+		strings.Contains(resp.Header().Get("Cache-Control"), "no-transform") {
+		return
+	}
+	header := cloneHeader(resp.Header())
+	var body, original []byte
+	loaded, changedHeader := false, false
+	for _, stage := range stages {
+		if len(stage.ContentTypes) > 0 && !cache.MatchContentType(header.Get("Content-Type"), stage.ContentTypes) {
+			continue
+		}
+		if !loaded {
+			body = resp.Body()
+			original, loaded = body, true
+		}
+		stageHeader := cloneHeader(header)
+		out, err := stage.Transformer.Transform(r, stageHeader, body)
+		if err != nil {
+			p.count(stage.Name, MetricErrors)
+			continue
+		}
+		headerChanged := !equalHeader(header, stageHeader)
+		if !headerChanged && bytes.Equal(out, body) {
+			continue
+		}
+		p.count(stage.Name, MetricApplied)
+		header, body = stageHeader, out
+		changedHeader = changedHeader || headerChanged
+	}
+	if changedHeader {
+		cache.SetHeader(resp, header)
+	}
+	if loaded && !bytes.Equal(body, original) {
+		cache.SetBody(resp, body)
+	}
+}
+
+// enabled returns the Stages which apply to r.
+func (p *Pipeline) enabled(r *http.Request) []Stage {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var stages []Stage
+	for _, stage := range p.stages {
+		if stage.appliesTo(r) {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+func (s Stage) appliesTo(r *http.Request) bool {
+	path := r.URL.Path
+	for _, skip := range s.Skip {
+		if skip.MatchString(path) {
+			return false
+		}
+	}
+	if len(s.Routes) > 0 {
+		matched := false
+		for _, route := range s.Routes {
+			if route.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return s.Enabled == nil || s.Enabled(r)
+}
+
+func (p *Pipeline) count(name, metric string) {
+	if p.metrics != nil {
+		p.metrics.Add("transform."+name+"."+metric, 1)
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+func equalHeader(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, values := range a {
+		other, found := b[key]
+		if !found || len(other) != len(values) {
+			return false
+		}
+		for i := range values {
+			if values[i] != other[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
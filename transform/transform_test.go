@@ -0,0 +1,127 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/davidjwilkins/honey/cache"
+	"github.com/davidjwilkins/honey/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newResponse(uri, contentType, body string) (*http.Request, *http.Response, cache.Response) {
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{contentType}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    r,
+	}
+	return r, response, cache.NewDefaultCacher().Standardize(response)
+}
+
+func appender(suffix string) Transformer {
+	return TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		return append(append([]byte(nil), body...), suffix...), nil
+	})
+}
+
+func TestPipelineAppliesStagesInOrder(t *testing.T) {
+	counters := metrics.NewCounters()
+	pipeline := NewPipeline(counters)
+	pipeline.Add(Stage{Name: "b", Transformer: appender("b"), Order: 10})
+	pipeline.Add(Stage{Name: "a", Transformer: appender("a")})
+	pipeline.Add(Stage{Name: "c", Transformer: appender("c"), Order: 10})
+	assert.Equal(t, []string{"a", "b", "c"}, pipeline.Stages())
+	r, _, resp := newResponse("http://www.insomniac.com/", "text/plain", "body:")
+	etag := resp.Header().Get("Etag")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "body:abc", string(resp.Body()))
+	assert.NotEqual(t, etag, resp.Header().Get("Etag"), "The Etag should be updated")
+	assert.Equal(t, int64(1), counters.Get("transform.a.applied"))
+}
+
+func TestPipelineFiltersStages(t *testing.T) {
+	pipeline := NewPipeline(nil)
+	pipeline.Add(Stage{Name: "html", Transformer: appender("h"), ContentTypes: []string{"text/html"}})
+	pipeline.Add(Stage{Name: "route", Transformer: appender("r"), Routes: []*regexp.Regexp{regexp.MustCompile("^/blog")}})
+	pipeline.Add(Stage{Name: "skip", Transformer: appender("s"), Skip: []*regexp.Regexp{regexp.MustCompile("^/blog/raw")}})
+	pipeline.Add(Stage{Name: "off", Transformer: appender("o"), Enabled: func(*http.Request) bool { return false }})
+
+	r, _, resp := newResponse("http://www.insomniac.com/blog/post", "text/html; charset=utf-8", "")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "hrs", string(resp.Body()))
+	r, _, resp = newResponse("http://www.insomniac.com/blog/raw", "text/css", "")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "r", string(resp.Body()))
+	r, _, resp = newResponse("http://www.insomniac.com/about", "text/css", "")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "s", string(resp.Body()))
+}
+
+func TestPipelineHeaderFunc(t *testing.T) {
+	pipeline := NewPipeline(nil)
+	pipeline.Add(Stage{Name: "header", Transformer: HeaderFunc(func(r *http.Request, header http.Header) error {
+		header.Set("X-Transformed", "yes")
+		header.Del("X-Powered-By")
+		return nil
+	})})
+	r, response, resp := newResponse("http://www.insomniac.com/", "text/plain", "body")
+	resp.Header().Set("X-Powered-By", "PHP")
+	response.Header.Set("X-Powered-By", "PHP")
+	response.Header.Set("Set-Cookie", "session=1")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "yes", resp.Header().Get("X-Transformed"))
+	assert.Empty(t, resp.Header().Get("X-Powered-By"))
+	assert.Equal(t, "PHP", response.Header.Get("X-Powered-By"), "The response which was cached from shouldn't be changed")
+	assert.Equal(t, "body", string(resp.Body()))
+}
+
+func TestSiteHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/", nil)
+	assert.Equal(t, "127.0.0.1:8080", SiteHost(r))
+	r.Header.Set("X-Forwarded-Host", "www.insomniac.com")
+	assert.Equal(t, "www.insomniac.com", SiteHost(r), "The host the client asked for should be used, not the backend's")
+}
+
+func TestPipelineErrorsLeaveResponse(t *testing.T) {
+	counters := metrics.NewCounters()
+	pipeline := NewPipeline(counters)
+	pipeline.Add(Stage{Name: "first", Transformer: appender("1")})
+	pipeline.Add(Stage{Name: "broken", Order: 1, Transformer: TransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+		header.Set("X-Broken", "yes")
+		return nil, errors.New("broken")
+	})})
+	r, _, resp := newResponse("http://www.insomniac.com/", "text/plain", "body")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "body1", string(resp.Body()), "A failing stage should not undo the ones before it")
+	assert.Empty(t, resp.Header().Get("X-Broken"))
+	assert.Equal(t, int64(1), counters.Get("transform.broken.errors"))
+}
+
+func TestPipelineRespectsNoTransform(t *testing.T) {
+	pipeline := NewPipeline(nil)
+	pipeline.Add(Stage{Name: "a", Transformer: appender("a")})
+	r, _, resp := newResponse("http://www.insomniac.com/", "text/plain", "body")
+	resp.Header().Set("Cache-Control", "public, max-age=60, no-transform")
+	pipeline.Apply(r, resp)
+	assert.Equal(t, "body", string(resp.Body()))
+}
+
+func TestPipelineRecompresses(t *testing.T) {
+	pipeline := NewPipeline(nil)
+	pipeline.Add(Stage{Name: "a", Transformer: appender("a")})
+	body := strings.Repeat("<p>Hello</p>", 100)
+	r, _, resp := newResponse("http://www.insomniac.com/", "text/html", body)
+	pipeline.Apply(r, resp)
+	h := http.Header{}
+	cache.Encode(h, resp, "gzip")
+	assert.Equal(t, "gzip", h.Get("Content-Encoding"))
+	assert.Equal(t, body+"a", string(resp.Body()))
+}
@@ -2,6 +2,7 @@ package utilities
 
 import (
 	"path/filepath"
+	"sort"
 )
 
 // IsStaticFile returns true if a path has a file
@@ -11,6 +12,19 @@ func IsStaticFile(path string) bool {
 	return found && isFile
 }
 
+// StaticFileExtensions returns the file extensions, with their
+// leading dot, which IsStaticFile assumes to be static.
+func StaticFileExtensions() []string {
+	extensions := make([]string, 0, len(fileExtensions))
+	for extension, isFile := range fileExtensions {
+		if isFile {
+			extensions = append(extensions, extension)
+		}
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
 var fileExtensions = map[string]bool{
 	".7z":    true,
 	".avi":   true,